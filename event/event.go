@@ -2,7 +2,10 @@
 // the libclick module.
 package event
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 // Event is a single log event
 type Event struct {
@@ -17,3 +20,41 @@ type Event struct {
 	// metrics to submit in this event
 	Data map[string]interface{}
 }
+
+// Size returns a rough estimate of how many bytes the event will take up once
+// it's been serialized to be sent. It's meant for budgeting, not accounting, so
+// it doesn't try to be exact.
+func (e *Event) Size() int {
+	size := 0
+	for k, v := range e.Data {
+		size += len(k) + valueSize(v)
+	}
+	return size
+}
+
+func valueSize(v interface{}) int {
+	switch v := v.(type) {
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	case bool, nil:
+		return 5
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return 8
+	case map[string]interface{}:
+		size := 0
+		for k, inner := range v {
+			size += len(k) + valueSize(inner)
+		}
+		return size
+	case []interface{}:
+		size := 0
+		for _, inner := range v {
+			size += valueSize(inner)
+		}
+		return size
+	default:
+		return len(fmt.Sprint(v))
+	}
+}
@@ -155,6 +155,32 @@ func GetTimestamp(m map[string]interface{}, timeFieldName, timeFieldFormat strin
 	return ts
 }
 
+// FindTimestamp is like GetTimestamp, but it returns false instead of the
+// current time when there's no timestamp to be found, and it leaves the map
+// alone and doesn't warn.
+func FindTimestamp(m map[string]interface{}, timeFieldName, timeFieldFormat string) (time.Time, bool) {
+	fieldNames := possibleTimeFieldNames
+	if timeFieldName != "" {
+		fieldNames = []string{timeFieldName}
+	}
+	for _, timeField := range fieldNames {
+		timeStr := ""
+		switch v := m[timeField].(type) {
+		case string:
+			timeStr = v
+		case int:
+			timeStr = strconv.Itoa(v)
+		}
+		if timeStr == "" {
+			continue
+		}
+		if ts := tryTimeFormats(timeStr, timeFieldFormat); !ts.IsZero() {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
+
 // Parse wraps time.ParseInLocation to use httime's Location from parsers
 func Parse(format, timespec string) (time.Time, error) {
 	return time.ParseInLocation(format, timespec, Location)
@@ -177,6 +177,27 @@ func TestGetTimestampInvalid(t *testing.T) {
 	}
 }
 
+func TestFindTimestamp(t *testing.T) {
+	Location = utc
+	m := map[string]interface{}{"timestamp": "2014-04-10T19:57:38-08:00"}
+	ts, ok := FindTimestamp(m, "", "")
+	if !ok || !ts.Equal(time.Unix(1397188658, 0)) {
+		t.Errorf("expected the timestamp to be found, got %s, %v", ts, ok)
+	}
+	if _, ok := m["timestamp"]; !ok {
+		t.Error("expected the time field to be left in the map")
+	}
+	if ts, ok := FindTimestamp(map[string]interface{}{"noTimeField": "not used"}, "", ""); ok {
+		t.Errorf("expected no timestamp to be found, got %s", ts)
+	}
+	if ts, ok := FindTimestamp(map[string]interface{}{"time": "not a valid date"}, "", ""); ok {
+		t.Errorf("expected no timestamp to be found, got %s", ts)
+	}
+	if ts, ok := FindTimestamp(m, "funkyTime", ""); ok {
+		t.Errorf("expected only the named field to be looked at, got %s", ts)
+	}
+}
+
 func TestGetTimestampCustomFormat(t *testing.T) {
 	weirdFormat := "Mon // 02 ---- Jan ... 06 15:04:05 -0700"
 
@@ -0,0 +1,220 @@
+package inputs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/metrics"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+type ExecOptions struct {
+	Command        []string `long:"command" description:"Command to run on a schedule, with sh -c. Each line it prints is passed to the parser as it is printed, and _command and _run_id fields are added to the event, along with _exit_code for the last line of the run. May be specified multiple times"`
+	Interval       uint     `long:"interval" description:"How often, in seconds, to run the commands" default:"60"`
+	Timeout        uint     `long:"timeout" description:"How long, in seconds, a command can run before it's killed" default:"30"`
+	MaxOutputBytes uint     `long:"max_output_bytes" description:"Maximum size of the output of one run of a command. Anything after that is dropped" default:"10485760"`
+}
+
+// execFields are the fields added to each line a command prints
+var execFields = tail.NewHeader("_command", "_exit_code", "_run_id")
+
+// Exec starts running the commands in opts on a schedule. The lines they
+// print are passed on as the lines of the Source returned, which is closed
+// once ctx is cancelled.
+func Exec(ctx context.Context, opts ExecOptions) tail.Source {
+	lines := make(chan tail.Line)
+	source := tail.Source{
+		Path:   "exec",
+		Lines:  lines,
+		Header: execFields.Regex(),
+	}
+	interval := time.Duration(opts.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	wg := sync.WaitGroup{}
+	for _, command := range opts.Command {
+		wg.Add(1)
+		go func(command string) {
+			defer wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			// runs of the same command never overlap; if one takes longer
+			// than the interval, the next starts as soon as it's done
+			for {
+				runCommand(ctx, command, opts, lines)
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(command)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+	return source
+}
+
+// runCommand runs command once, and passes on the lines it prints as they're
+// printed. The exit code isn't known until it's finished, so the last line is
+// held back until then, and is the only one with an _exit_code.
+func runCommand(ctx context.Context, command string, opts ExecOptions, lines chan tail.Line) {
+	runID := newRunID()
+	logger := logrus.WithFields(logrus.Fields{"command": command, "run_id": runID})
+	stderr := &limitedBuffer{max: 1024}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = stderr
+	// the command gets a process group of its own, so anything it starts is
+	// killed along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	metrics.Increment("exec_runs")
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		metrics.Increment("exec_failures")
+		logger.WithFields(logrus.Fields{"err": err}).Error("Error running command")
+		return
+	}
+
+	// the output past --exec.max_output_bytes is read and thrown away, so the
+	// command doesn't block printing it
+	printed := make(chan string)
+	truncated := false
+	go func() {
+		defer close(printed)
+		max := int(opts.MaxOutputBytes)
+		scanner := bufio.NewScanner(stdout)
+		if max > 0 {
+			scanner.Buffer(make([]byte, 0, 4096), max)
+		} else {
+			scanner.Buffer(make([]byte, 0, 4096), math.MaxInt32)
+		}
+		size := 0
+		for scanner.Scan() {
+			size += len(scanner.Bytes()) + 1
+			if max > 0 && size > max {
+				truncated = true
+				break
+			}
+			printed <- scanner.Text()
+		}
+		if scanner.Err() == bufio.ErrTooLong {
+			truncated = true
+		}
+		io.Copy(ioutil.Discard, stdout)
+	}()
+	send := func(line, exitCode string) bool {
+		select {
+		case lines <- tail.Line{Text: execFields.Add([]string{command, exitCode, runID}, line)}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	kill := func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		for range printed {
+		}
+		cmd.Wait()
+	}
+
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(opts.Timeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	timedOut := false
+	// each line is sent once the next one turns up
+	var last *string
+ReadOutput:
+	for {
+		select {
+		case line, ok := <-printed:
+			if !ok {
+				break ReadOutput
+			}
+			if last != nil && !send(*last, "") {
+				kill()
+				return
+			}
+			last = &line
+		case <-timeout:
+			// the output ends once the command is killed
+			timedOut = true
+			timeout = nil
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-ctx.Done():
+			kill()
+			return
+		}
+	}
+	err = cmd.Wait()
+
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// a command that's killed has an exit code of -1
+		exitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	} else if err != nil {
+		exitCode = -1
+	}
+	switch {
+	case timedOut:
+		metrics.Increment("exec_timeouts")
+		logger.WithFields(logrus.Fields{"timeout": opts.Timeout}).Error("Command timed out and was killed")
+	case exitCode != 0:
+		metrics.Increment("exec_failures")
+		logger.WithFields(logrus.Fields{"exit_code": exitCode, "stderr": stderr.String()}).Error("Command failed")
+	}
+	if truncated {
+		metrics.Increment("exec_output_truncated")
+		logger.WithFields(logrus.Fields{"max_output_bytes": opts.MaxOutputBytes}).Error("Command printed too much; the rest of its output was dropped")
+	}
+
+	if last != nil {
+		send(*last, strconv.Itoa(exitCode))
+	}
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// limitedBuffer keeps the first max bytes written to it, and drops the rest
+// rather than making the writer wait. A max of 0 keeps everything.
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); b.max > 0 && len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
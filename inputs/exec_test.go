@@ -0,0 +1,94 @@
+package inputs
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/honeycombio/honeytail/metrics"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+func TestExec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timeoutsBefore := metrics.Get("exec_timeouts")
+	failuresBefore := metrics.Get("exec_failures")
+	source := Exec(ctx, ExecOptions{
+		Command: []string{
+			`printf 'one\ntwo\n'`,
+			`echo failed; exit 3`,
+			`echo started; sleep 10; echo finished`,
+		},
+		Interval: 3600,
+		Timeout:  1,
+	})
+
+	var lines []string
+	for len(lines) < 4 {
+		lines = append(lines, receiveLine(t, source.Lines))
+	}
+	// the commands run at the same time, so their lines can come in any order
+	sort.Strings(lines)
+	checkHeaderLine(t, execFields, lines[0], map[string]string{"_command": `echo failed; exit 3`, "_exit_code": "3"}, "failed")
+	checkHeaderLine(t, execFields, lines[1], map[string]string{"_command": `echo started; sleep 10; echo finished`, "_exit_code": "-1"}, "started")
+	// only the last line of a run has the exit code
+	checkHeaderLine(t, execFields, lines[2], map[string]string{"_command": `printf 'one\ntwo\n'`, "_exit_code": ""}, "one")
+	checkHeaderLine(t, execFields, lines[3], map[string]string{"_command": `printf 'one\ntwo\n'`, "_exit_code": "0"}, "two")
+
+	// lines from the same run share a run ID
+	regex := &parsers.ExtRegexp{Regexp: regexp.MustCompile(execFields.Regex())}
+	_, first := regex.FindStringSubmatchMap(lines[2])
+	_, second := regex.FindStringSubmatchMap(lines[3])
+	_, other := regex.FindStringSubmatchMap(lines[0])
+	if first["_run_id"] == "" || first["_run_id"] != second["_run_id"] || first["_run_id"] == other["_run_id"] {
+		t.Errorf("expected a run ID for each run, got %q, %q and %q", first["_run_id"], second["_run_id"], other["_run_id"])
+	}
+
+	if n := metrics.Get("exec_timeouts") - timeoutsBefore; n != 1 {
+		t.Errorf("expected one timeout, got %d", n)
+	}
+	if n := metrics.Get("exec_failures") - failuresBefore; n != 1 {
+		t.Errorf("expected one failure, got %d", n)
+	}
+
+	cancel()
+	for range source.Lines {
+	}
+}
+
+func TestExecStreamsLines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := Exec(ctx, ExecOptions{
+		Command:  []string{`echo first; echo second; sleep 10`},
+		Interval: 3600,
+		Timeout:  60,
+	})
+
+	// lines are passed on while the command is still running
+	checkHeaderLine(t, execFields, receiveLine(t, source.Lines), map[string]string{"_exit_code": ""}, "first")
+
+	cancel()
+	for range source.Lines {
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{max: 5}
+	for _, s := range []string{"abc", "def", "ghi"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Errorf("expected the whole write to be taken, got %d, %v", n, err)
+		}
+	}
+	if b.String() != "abcde" || !b.truncated {
+		t.Errorf("expected the first 5 bytes and to be truncated, got %q, %v", b.String(), b.truncated)
+	}
+	b = &limitedBuffer{}
+	b.Write([]byte(strings.Repeat("x", 100)))
+	if b.Len() != 100 || b.truncated {
+		t.Errorf("expected no limit, got %d bytes", b.Len())
+	}
+}
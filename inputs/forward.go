@@ -0,0 +1,315 @@
+package inputs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+type ForwardOptions struct {
+	Listen          string `long:"listen" description:"Address to receive records from Fluentd and Fluent Bit on over the Forward protocol, like :24224"`
+	SharedKey       string `long:"shared_key" description:"If set, clients have to authenticate with this shared key in the Forward handshake"`
+	SelfHostname    string `long:"self_hostname" description:"Hostname to give clients in the handshake. Defaults to this host's name"`
+	TagField        string `long:"tag_field" description:"Name of the field to put each record's tag in" default:"tag"`
+	MaxMessageBytes uint   `long:"max_message_bytes" description:"Maximum size of a Forward message, and of its records once they're uncompressed. Connections that send bigger ones are closed" default:"10485760"`
+}
+
+// forwardInput is a Fluent Forward protocol server
+type forwardInput struct {
+	opts     ForwardOptions
+	hostname string
+	maxBytes int
+	events   chan event.Event
+}
+
+// Forward starts receiving records over the Fluent Forward protocol, as set
+// in opts. Each record is passed on as an event by the channel returned, until
+// ctx is cancelled.
+func Forward(ctx context.Context, opts ForwardOptions) (chan event.Event, error) {
+	f := &forwardInput{
+		opts:     opts,
+		hostname: opts.SelfHostname,
+		maxBytes: int(opts.MaxMessageBytes),
+		events:   make(chan event.Event),
+	}
+	if f.hostname == "" {
+		f.hostname, _ = os.Hostname()
+	}
+	if f.maxBytes <= 0 {
+		f.maxBytes = 10485760
+	}
+	listener, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"address": listener.Addr().String()}).Info("Receiving records over the Forward protocol")
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		f.accept(ctx, listener)
+		close(f.events)
+	}()
+	return f.events, nil
+}
+
+// accept serves each connection made to listener until it's closed
+func (f *forwardInput) accept(ctx context.Context, listener net.Listener) {
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Error("Error accepting Forward connections")
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			if err := f.serve(ctx, conn); err != nil && err != io.EOF && ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"err": err, "client": conn.RemoteAddr().String()}).Error("Error receiving Forward messages")
+			}
+			conn.Close()
+		}()
+	}
+}
+
+// serve authenticates a client if there's a shared key, then reads its
+// messages until it hangs up
+func (f *forwardInput) serve(ctx context.Context, conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	decoder := newMsgpackDecoder(reader)
+	if f.opts.SharedKey != "" {
+		if err := f.handshake(conn, decoder); err != nil {
+			return err
+		}
+	}
+	for {
+		msg, err := decoder.decode(f.maxBytes)
+		if err != nil {
+			return err
+		}
+		chunk, err := f.receive(ctx, msg)
+		if err != nil {
+			return err
+		}
+		if chunk != "" {
+			ack := appendMsgpack(nil, map[string]interface{}{"ack": chunk})
+			if _, err := conn.Write(ack); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handshake sends a HELO and checks the PING the client answers with, which
+// has to be signed with the shared key. The PONG sent back is signed too, so
+// the client knows the server has the key as well.
+func (f *forwardInput) handshake(conn net.Conn, decoder *msgpackDecoder) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	helo := []interface{}{"HELO", map[string]interface{}{"nonce": nonce, "auth": "", "keepalive": true}}
+	if _, err := conn.Write(appendMsgpack(nil, helo)); err != nil {
+		return err
+	}
+	msg, err := decoder.decode(f.maxBytes)
+	if err != nil {
+		return err
+	}
+	ping, ok := msg.([]interface{})
+	if !ok || len(ping) < 4 || msgpackString(ping[0]) != "PING" {
+		return errors.New("expected a PING in the Forward handshake")
+	}
+	clientHostname := msgpackString(ping[1])
+	salt := msgpackString(ping[2])
+	digest := msgpackString(ping[3])
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(f.digest(salt, clientHostname, nonce))) != 1 {
+		metrics.Increment("forward_auth_failures")
+		pong := []interface{}{"PONG", false, "shared_key mismatch", f.hostname, ""}
+		conn.Write(appendMsgpack(nil, pong))
+		return fmt.Errorf("client %s didn't have the shared key", clientHostname)
+	}
+	pong := []interface{}{"PONG", true, "", f.hostname, f.digest(salt, f.hostname, nonce)}
+	_, err = conn.Write(appendMsgpack(nil, pong))
+	return err
+}
+
+func (f *forwardInput) digest(salt, hostname string, nonce []byte) string {
+	h := sha512.New()
+	io.WriteString(h, salt)
+	io.WriteString(h, hostname)
+	h.Write(nonce)
+	io.WriteString(h, f.opts.SharedKey)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// receive passes on the records in a message, in any of the Message, Forward
+// and PackedForward modes. It returns the chunk to acknowledge, if the client
+// asked for one.
+func (f *forwardInput) receive(ctx context.Context, msg interface{}) (string, error) {
+	array, ok := msg.([]interface{})
+	if !ok || len(array) < 2 {
+		return "", errors.New("expected a Forward message to be an array")
+	}
+	tag := msgpackString(array[0])
+	var entries []interface{}
+	var option map[string]interface{}
+	switch entry := array[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		entries = entry
+		option = forwardOption(array, 2)
+	case string, []byte:
+		// PackedForward mode: [tag, entries packed one after another, option]
+		option = forwardOption(array, 2)
+		var err error
+		if entries, err = f.unpack([]byte(msgpackString(entry)), option); err != nil {
+			return "", err
+		}
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(array) < 3 {
+			return "", errors.New("expected a record in a Forward message")
+		}
+		entries = []interface{}{array[1:3]}
+		option = forwardOption(array, 3)
+	}
+	for _, entry := range entries {
+		ev, err := f.event(tag, entry)
+		if err != nil {
+			return "", err
+		}
+		select {
+		case f.events <- ev:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	metrics.Add("forward_records_received", int64(len(entries)))
+	if chunk, ok := option["chunk"]; ok {
+		return msgpackString(chunk), nil
+	}
+	return "", nil
+}
+
+// forwardOption returns the option map at array[i], if there is one
+func forwardOption(array []interface{}, i int) map[string]interface{} {
+	if len(array) > i {
+		if option, ok := array[i].(map[string]interface{}); ok {
+			return option
+		}
+	}
+	return nil
+}
+
+// unpack reads the entries packed into a PackedForward message, uncompressing
+// them first if they're gzipped
+func (f *forwardInput) unpack(packed []byte, option map[string]interface{}) ([]interface{}, error) {
+	if compressed, ok := option["compressed"]; ok {
+		if msgpackString(compressed) != "gzip" {
+			return nil, fmt.Errorf("can't uncompress %v records", compressed)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(packed))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		if packed, err = ioutil.ReadAll(io.LimitReader(gz, int64(f.maxBytes)+1)); err != nil {
+			return nil, err
+		}
+		if len(packed) > f.maxBytes {
+			return nil, errMsgpackTooBig
+		}
+	}
+	var entries []interface{}
+	reader := bytes.NewReader(packed)
+	decoder := newMsgpackDecoder(reader)
+	for reader.Len() > 0 {
+		entry, err := decoder.decode(reader.Len())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// event makes an entry, [time, record], into an event with the tag in it
+func (f *forwardInput) event(tag string, entry interface{}) (event.Event, error) {
+	pair, ok := entry.([]interface{})
+	if !ok || len(pair) < 2 {
+		return event.Event{}, errors.New("expected a Forward entry to be a time and a record")
+	}
+	timestamp, err := forwardTime(pair[0])
+	if err != nil {
+		return event.Event{}, err
+	}
+	data, ok := pair[1].(map[string]interface{})
+	if !ok {
+		return event.Event{}, errors.New("expected a Forward record to be a map")
+	}
+	for key, value := range data {
+		// Fluentd can send strings as binary
+		if b, ok := value.([]byte); ok {
+			data[key] = string(b)
+		}
+	}
+	if f.opts.TagField != "" {
+		data[f.opts.TagField] = tag
+	}
+	return event.Event{Timestamp: timestamp, Data: data}, nil
+}
+
+// forwardTime reads the time of an entry, which is either seconds since the
+// epoch, or an EventTime with nanoseconds too
+func forwardTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case int64:
+		return time.Unix(t, 0).UTC(), nil
+	case uint64:
+		return time.Unix(int64(t), 0).UTC(), nil
+	case float64:
+		sec := int64(t)
+		return time.Unix(sec, int64((t-float64(sec))*1e9)).UTC(), nil
+	case msgpackExt:
+		if t.typ == 0 && len(t.data) == 8 {
+			sec := binary.BigEndian.Uint32(t.data)
+			nsec := binary.BigEndian.Uint32(t.data[4:])
+			return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't read the time %v in a Forward entry", v)
+}
@@ -0,0 +1,206 @@
+package inputs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func decodeMsgpack(t *testing.T, b []byte) interface{} {
+	v, err := newMsgpackDecoder(bytes.NewReader(b)).decode(len(b))
+	if err != nil {
+		t.Fatalf("decoding %x: %s", b, err)
+	}
+	return v
+}
+
+func TestMsgpack(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	values := []interface{}{
+		nil, true, false, "", "short", long, []byte{1, 2, 3},
+		[]interface{}{"a", []interface{}{}, map[string]interface{}{"b": true}},
+		map[string]interface{}{"key": "value", "long": long},
+	}
+	for _, v := range values {
+		if got := decodeMsgpack(t, appendMsgpack(nil, v)); !reflect.DeepEqual(got, v) {
+			t.Errorf("expected %#v, got %#v", v, got)
+		}
+	}
+
+	tests := []struct {
+		msgpack  []byte
+		expected interface{}
+	}{
+		{[]byte{0x05}, int64(5)},
+		{[]byte{0xff}, int64(-1)},
+		{[]byte{0xd0, 0x80}, int64(-128)},
+		{[]byte{0xd1, 0xff, 0x00}, int64(-256)},
+		{[]byte{0xcd, 0x01, 0x00}, int64(256)},
+		{[]byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(1<<64 - 1)},
+		{[]byte{0xca, 0x3f, 0x00, 0x00, 0x00}, 0.5},
+		{[]byte{0xd9, 0x02, 'h', 'i'}, "hi"},
+		{[]byte{0xd6, 0x01, 1, 2, 3, 4}, msgpackExt{typ: 1, data: []byte{1, 2, 3, 4}}},
+		// keys that aren't strings are made into strings
+		{[]byte{0x81, 0x01, 0xc3}, map[string]interface{}{"1": true}},
+	}
+	for _, test := range tests {
+		if got := decodeMsgpack(t, test.msgpack); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("decoding %x: expected %#v, got %#v", test.msgpack, test.expected, got)
+		}
+	}
+
+	// a length that's longer than what's allowed doesn't get allocated
+	if _, err := newMsgpackDecoder(bytes.NewReader([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})).decode(100); err != errMsgpackTooBig {
+		t.Errorf("expected a huge array to be too big, got %v", err)
+	}
+}
+
+// eventTime packs t as a Fluentd EventTime
+func eventTime(t time.Time) []byte {
+	b := []byte{0xd7, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}
+	sec, nsec := uint32(t.Unix()), uint32(t.Nanosecond())
+	b[2], b[3], b[4], b[5] = byte(sec>>24), byte(sec>>16), byte(sec>>8), byte(sec)
+	b[6], b[7], b[8], b[9] = byte(nsec>>24), byte(nsec>>16), byte(nsec>>8), byte(nsec)
+	return b
+}
+
+// forwardEntry packs [time, record]
+func forwardEntry(t time.Time, record map[string]interface{}) []byte {
+	return appendMsgpack(append([]byte{0x92}, eventTime(t)...), record)
+}
+
+func receiveEvent(t *testing.T, events chan event.Event) event.Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a Forward record")
+	}
+	return event.Event{}
+}
+
+func TestForward(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := ForwardOptions{Listen: addr, SharedKey: "secret", SelfHostname: "server", TagField: "tag", MaxMessageBytes: 10000}
+	events, err := Forward(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &forwardInput{opts: opts}
+
+	// a client with the wrong key is turned away
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := newMsgpackDecoder(bufio.NewReader(conn))
+	var helo interface{}
+	if helo, err = decoder.decode(1000); err != nil {
+		t.Fatal(err)
+	}
+	nonce := helo.([]interface{})[1].(map[string]interface{})["nonce"].([]byte)
+	wrong := &forwardInput{opts: ForwardOptions{SharedKey: "wrong"}}
+	conn.Write(appendMsgpack(nil, []interface{}{"PING", "client", "salt", wrong.digest("salt", "client", nonce), "", ""}))
+	pong, err := decoder.decode(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong.([]interface{})[1] != false {
+		t.Errorf("expected the wrong key to be turned away, got %v", pong)
+	}
+	conn.Close()
+
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	decoder = newMsgpackDecoder(bufio.NewReader(conn))
+	if helo, err = decoder.decode(1000); err != nil {
+		t.Fatal(err)
+	}
+	nonce = helo.([]interface{})[1].(map[string]interface{})["nonce"].([]byte)
+	conn.Write(appendMsgpack(nil, []interface{}{"PING", "client", "salt", f.digest("salt", "client", nonce), "", ""}))
+	if pong, err = decoder.decode(1000); err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"PONG", true, "", "server", f.digest("salt", "server", nonce)}
+	if !reflect.DeepEqual(pong, expected) {
+		t.Errorf("expected %v, got %v", expected, pong)
+	}
+
+	now := time.Date(2017, 10, 16, 9, 0, 0, 123456789, time.UTC)
+
+	// Message mode, asking for an ack
+	msg := append([]byte{0x94}, appendMsgpack(nil, "app.web")...)
+	msg = append(msg, eventTime(now)...)
+	msg = appendMsgpack(msg, map[string]interface{}{"log": []byte("hello")})
+	msg = appendMsgpack(msg, map[string]interface{}{"chunk": "c1"})
+	conn.Write(msg)
+	ev := receiveEvent(t, events)
+	if !ev.Timestamp.Equal(now) {
+		t.Errorf("expected the time with nanoseconds, got %s", ev.Timestamp)
+	}
+	if !reflect.DeepEqual(ev.Data, map[string]interface{}{"log": "hello", "tag": "app.web"}) {
+		t.Errorf("expected the record with its tag, got %v", ev.Data)
+	}
+	ack, err := decoder.decode(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ack, map[string]interface{}{"ack": "c1"}) {
+		t.Errorf("expected an ack for the chunk, got %v", ack)
+	}
+
+	// Forward mode, with the time in seconds
+	msg = append([]byte{0x92}, appendMsgpack(nil, "app.db")...)
+	msg = append(msg, 0x92, 0x92, 0xce, 0x59, 0xe4, 0x75, 0x90)
+	msg = appendMsgpack(msg, map[string]interface{}{"n": "1"})
+	msg = append(msg, forwardEntry(now, map[string]interface{}{"n": "2"})...)
+	conn.Write(msg)
+	for _, n := range []string{"1", "2"} {
+		ev := receiveEvent(t, events)
+		if ev.Data["n"] != n || ev.Data["tag"] != "app.db" {
+			t.Errorf("expected record %s with its tag, got %v", n, ev.Data)
+		}
+	}
+
+	// gzipped PackedForward mode
+	packed := &bytes.Buffer{}
+	gz := gzip.NewWriter(packed)
+	gz.Write(forwardEntry(now, map[string]interface{}{"n": "3"}))
+	gz.Write(forwardEntry(now, map[string]interface{}{"n": "4"}))
+	gz.Close()
+	msg = append([]byte{0x93}, appendMsgpack(nil, "app.packed")...)
+	msg = appendMsgpack(msg, packed.Bytes())
+	msg = appendMsgpack(msg, map[string]interface{}{"compressed": "gzip", "chunk": "c2"})
+	conn.Write(msg)
+	for _, n := range []string{"3", "4"} {
+		ev := receiveEvent(t, events)
+		if ev.Data["n"] != n || ev.Data["tag"] != "app.packed" {
+			t.Errorf("expected record %s with its tag, got %v", n, ev.Data)
+		}
+	}
+	if ack, err = decoder.decode(1000); err != nil || !reflect.DeepEqual(ack, map[string]interface{}{"ack": "c2"}) {
+		t.Errorf("expected an ack for the chunk, got %v, %v", ack, err)
+	}
+
+	// the events are closed once it's cancelled
+	cancel()
+	for range events {
+	}
+}
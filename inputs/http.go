@@ -0,0 +1,209 @@
+package inputs
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/httime"
+	"github.com/honeycombio/honeytail/metrics"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+type HTTPOptions struct {
+	Listen          string `long:"listen" description:"Address to receive logs over HTTP on, like :8090. POST lines to /lines to have them parsed, or a JSON array of events to /events to send them as they are"`
+	AuthToken       string `long:"auth_token" description:"If set, requests need an 'Authorization: Bearer <token>' header with this token"`
+	MaxBodyBytes    uint   `long:"max_body_bytes" description:"Maximum size of a request body, once it's uncompressed" default:"10485760"`
+	QueueSize       uint   `long:"queue_size" description:"How many lines, and how many events, can be waiting to be parsed or sent. Requests that don't fit get a 429 response" default:"10000"`
+	TimeFieldName   string `long:"timefield" description:"Name of the field with the time in the events sent to /events. If it isn't set, fields like time and timestamp are tried"`
+	TimeFieldFormat string `long:"time_format" description:"Format of the time in the events sent to /events (supports strftime and Golang time formats)"`
+}
+
+// httpInput is a server logs can be sent to over HTTP. Every line or event in
+// a request is queued, or none of them are.
+type httpInput struct {
+	opts   HTTPOptions
+	lines  chan tail.Line
+	events chan event.Event
+
+	// lock is held while a request's lines or events are queued, so no
+	// other request can take the room they need
+	lock   sync.Mutex
+	closed bool
+}
+
+// HTTP starts receiving logs over HTTP, as set in opts. Lines are passed on
+// by the Source returned, and events by the channel, until ctx is cancelled.
+func HTTP(ctx context.Context, opts HTTPOptions) (tail.Source, chan event.Event, error) {
+	h := newHTTPInput(opts)
+	source := tail.Source{Path: "http", Lines: h.lines}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lines", h.handleLines)
+	mux.HandleFunc("/events", h.handleEvents)
+	if err := h.serve(ctx, mux, "HTTP"); err != nil {
+		return source, nil, err
+	}
+	return source, h.events, nil
+}
+
+func newHTTPInput(opts HTTPOptions) *httpInput {
+	queueSize := int(opts.QueueSize)
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	return &httpInput{
+		opts:   opts,
+		lines:  make(chan tail.Line, queueSize),
+		events: make(chan event.Event, queueSize),
+	}
+}
+
+// serve starts serving handler on the address in the options, and closes the
+// lines and events once ctx is cancelled. name is the kind of logs received,
+// for the log messages.
+func (h *httpInput) serve(ctx context.Context, handler http.Handler, name string) error {
+	listener, err := net.Listen("tcp", h.opts.Listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: handler}
+	logrus.WithFields(logrus.Fields{"address": listener.Addr().String()}).Info("Receiving logs over " + name)
+	go func() {
+		err := server.Serve(listener)
+		if ctx.Err() == nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("Error receiving logs over " + name)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.closed = true
+		close(h.lines)
+		close(h.events)
+	}()
+	return nil
+}
+
+func (h *httpInput) handleLines(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+	lines := strings.Split(string(body), "\n")
+	n := 0
+	for _, line := range lines {
+		if line = strings.TrimSuffix(line, "\r"); line != "" {
+			lines[n] = line
+			n++
+		}
+	}
+	lines = lines[:n]
+	h.queue(w, len(lines), func() int { return cap(h.lines) - len(h.lines) }, func() {
+		for _, line := range lines {
+			h.lines <- tail.Line{Text: line}
+		}
+		metrics.Add("http_lines_received", int64(len(lines)))
+	})
+}
+
+func (h *httpInput) handleEvents(w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+	var data []map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		http.Error(w, fmt.Sprintf("expected a JSON array of events: %s", err), http.StatusBadRequest)
+		return
+	}
+	events := make([]event.Event, 0, len(data))
+	for _, d := range data {
+		if d == nil {
+			continue
+		}
+		events = append(events, event.Event{
+			Timestamp: httime.GetTimestamp(d, h.opts.TimeFieldName, h.opts.TimeFieldFormat),
+			Data:      d,
+		})
+	}
+	h.queue(w, len(events), func() int { return cap(h.events) - len(h.events) }, func() {
+		for _, ev := range events {
+			h.events <- ev
+		}
+		metrics.Add("http_events_received", int64(len(events)))
+	})
+}
+
+// readBody checks the request and reads its body, uncompressing it if need
+// be. If anything's wrong with it, it responds and returns false.
+func (h *httpInput) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if h.opts.AuthToken != "" {
+		expected := "Bearer " + h.opts.AuthToken
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong bearer token", http.StatusUnauthorized)
+			return nil, false
+		}
+	}
+	maxBytes := int64(h.opts.MaxBodyBytes)
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, maxBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("can't uncompress the body: %s", err), http.StatusBadRequest)
+			return nil, false
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	// a compressed body is held to the limit once it's uncompressed, too
+	body, err := ioutil.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil || int64(len(body)) > maxBytes {
+		if err == nil || strings.Contains(err.Error(), "too large") {
+			http.Error(w, fmt.Sprintf("the body is bigger than %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, fmt.Sprintf("can't read the body: %s", err), http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+// queue calls send to queue n lines or events if room says there's space for
+// them all, and responds to say whether there was. While the lock is held, the
+// space only ever goes up, as nothing else is queued.
+func (h *httpInput) queue(w http.ResponseWriter, n int, room func() int, send func()) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	switch {
+	case h.closed:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	case n > cap(h.lines):
+		http.Error(w, fmt.Sprintf("more than %d lines or events in one request", cap(h.lines)), http.StatusRequestEntityTooLarge)
+	case n > room():
+		metrics.Increment("http_requests_throttled")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many lines or events waiting to be sent, try again later", http.StatusTooManyRequests)
+	default:
+		send()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,127 @@
+package inputs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func post(h http.HandlerFunc, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestHTTPLines(t *testing.T) {
+	h := newHTTPInput(HTTPOptions{MaxBodyBytes: 100, QueueSize: 4})
+	if w := post(h.handleLines, "one\r\ntwo\n\nthree\n", nil); w.Code != http.StatusAccepted {
+		t.Fatalf("expected the lines to be accepted, got %d: %s", w.Code, w.Body)
+	}
+	var lines []string
+	for len(h.lines) > 0 {
+		lines = append(lines, (<-h.lines).Text)
+	}
+	if !reflect.DeepEqual(lines, []string{"one", "two", "three"}) {
+		t.Errorf("expected the lines without the blank one, got %q", lines)
+	}
+
+	// gzipped bodies are uncompressed
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte("a\nb\nc\n"))
+	gz.Close()
+	if w := post(h.handleLines, buf.String(), map[string]string{"Content-Encoding": "gzip"}); w.Code != http.StatusAccepted {
+		t.Fatalf("expected gzipped lines to be accepted, got %d: %s", w.Code, w.Body)
+	}
+	// there's only room for one more, so none of these are taken
+	if w := post(h.handleLines, "d\ne\n", nil); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a full queue to give a 429, got %d", w.Code)
+	}
+	if len(h.lines) != 3 {
+		t.Errorf("expected only the gzipped lines to be queued, got %d", len(h.lines))
+	}
+	if w := post(h.handleLines, "1\n2\n3\n4\n5\n", nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected more lines than fit in the queue to give a 413, got %d", w.Code)
+	}
+	if w := post(h.handleLines, strings.Repeat("x", 101), nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a big body to give a 413, got %d", w.Code)
+	}
+	// the limit goes for the uncompressed body
+	buf.Reset()
+	gz = gzip.NewWriter(buf)
+	gz.Write([]byte(strings.Repeat("x", 1000)))
+	gz.Close()
+	if w := post(h.handleLines, buf.String(), map[string]string{"Content-Encoding": "gzip"}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a big uncompressed body to give a 413, got %d", w.Code)
+	}
+}
+
+func TestHTTPEvents(t *testing.T) {
+	h := newHTTPInput(HTTPOptions{MaxBodyBytes: 1000, QueueSize: 10, AuthToken: "secret"})
+	body := `[{"time": "2017-10-16T09:00:00Z", "a": 1}, {"b": "two"}]`
+	if w := post(h.handleEvents, body, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a request without the token to give a 401, got %d", w.Code)
+	}
+	if w := post(h.handleEvents, body, map[string]string{"Authorization": "Bearer wrong"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a request with the wrong token to give a 401, got %d", w.Code)
+	}
+	auth := map[string]string{"Authorization": "Bearer secret"}
+	if w := post(h.handleEvents, `{"a": 1}`, auth); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an object rather than an array to give a 400, got %d", w.Code)
+	}
+	if w := post(h.handleEvents, body, auth); w.Code != http.StatusAccepted {
+		t.Fatalf("expected the events to be accepted, got %d: %s", w.Code, w.Body)
+	}
+	ev := <-h.events
+	if !ev.Timestamp.Equal(time.Date(2017, 10, 16, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the time from the event, got %s", ev.Timestamp)
+	}
+	if !reflect.DeepEqual(ev.Data, map[string]interface{}{"a": float64(1)}) {
+		t.Errorf("expected the fields other than the time, got %v", ev.Data)
+	}
+	if ev := <-h.events; ev.Data["b"] != "two" {
+		t.Errorf("expected the second event, got %v", ev.Data)
+	}
+}
+
+func TestHTTPShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source, events, err := HTTP(ctx, HTTPOptions{Listen: addr, MaxBodyBytes: 100, QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post("http://"+addr+"/lines", "text/plain", strings.NewReader("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("expected the line to be accepted, got %d", resp.StatusCode)
+	}
+	if line := <-source.Lines; line.Text != "hello" {
+		t.Errorf("expected the line sent, got %q", line.Text)
+	}
+	cancel()
+	for range source.Lines {
+	}
+	for range events {
+	}
+}
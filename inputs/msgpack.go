@@ -0,0 +1,266 @@
+package inputs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// msgpackMaxDepth is how deeply arrays and maps can be nested in a message
+const msgpackMaxDepth = 100
+
+var errMsgpackTooBig = errors.New("msgpack message is too big")
+
+// msgpackExt is a msgpack extension value, like a Fluentd EventTime
+type msgpackExt struct {
+	typ  int8
+	data []byte
+}
+
+type msgpackReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// msgpackDecoder reads msgpack values. Integers come out as int64, or uint64
+// if they're too big for one, strings as string, binary as []byte, arrays as
+// []interface{} and maps as map[string]interface{}, with keys that aren't
+// strings printed as strings.
+type msgpackDecoder struct {
+	r msgpackReader
+	// left is how many more bytes can be read before the message is too big
+	left int
+}
+
+func newMsgpackDecoder(r msgpackReader) *msgpackDecoder {
+	return &msgpackDecoder{r: r}
+}
+
+// decode reads a value, which can be no bigger than maxBytes
+func (d *msgpackDecoder) decode(maxBytes int) (interface{}, error) {
+	d.left = maxBytes
+	return d.value(0)
+}
+
+func (d *msgpackDecoder) byte() (byte, error) {
+	if d.left < 1 {
+		return 0, errMsgpackTooBig
+	}
+	d.left--
+	return d.r.ReadByte()
+}
+
+func (d *msgpackDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(d.left) {
+		return nil, errMsgpackTooBig
+	}
+	d.left -= int(n)
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	return b, err
+}
+
+// uint reads an n byte big-endian unsigned integer
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.bytes(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack message is nested too deeply")
+	}
+	c, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.mapValue(uint64(c&0x0f), depth)
+	case c >= 0x90 && c <= 0x9f:
+		return d.array(uint64(c&0x0f), depth)
+	case c >= 0xa0 && c <= 0xbf:
+		b, err := d.bytes(uint64(c & 0x1f))
+		return string(b), err
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.bytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(n)
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (c - 0xcc))
+		if u > math.MaxInt64 {
+			return u, err
+		}
+		return int64(u), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := uint(1) << (c - 0xd0)
+		u, err := d.uint(int(size))
+		// sign extend from the size it was sent as
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.bytes(n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(n, depth)
+	}
+	return nil, fmt.Errorf("unknown msgpack type 0x%x", c)
+}
+
+func (d *msgpackDecoder) ext(n uint64) (interface{}, error) {
+	typ, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.bytes(n)
+	return msgpackExt{typ: int8(typ), data: data}, err
+}
+
+func (d *msgpackDecoder) array(n uint64, depth int) (interface{}, error) {
+	// every element takes at least a byte, so this stops a bogus length
+	// making a huge slice
+	if n > uint64(d.left) {
+		return nil, errMsgpackTooBig
+	}
+	values := make([]interface{}, n)
+	for i := range values {
+		var err error
+		if values[i], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (d *msgpackDecoder) mapValue(n uint64, depth int) (interface{}, error) {
+	if n > uint64(d.left) {
+		return nil, errMsgpackTooBig
+	}
+	values := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		values[msgpackString(key)] = value
+	}
+	return values, nil
+}
+
+// msgpackString returns v as a string, as Fluentd has binary where it means
+// strings
+func msgpackString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// appendMsgpack appends v to b in msgpack. It's only for the few types the
+// replies to Forward clients need.
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case string:
+		b = appendMsgpackLength(b, len(v), 0xa0, 0xda, 0xdb)
+		return append(b, v...)
+	case []byte:
+		b = appendMsgpackLength(b, len(v), 0, 0xc5, 0xc6)
+		return append(b, v...)
+	case []interface{}:
+		b = appendMsgpackLength(b, len(v), 0x90, 0xdc, 0xdd)
+		for _, inner := range v {
+			b = appendMsgpack(b, inner)
+		}
+		return b
+	case map[string]interface{}:
+		b = appendMsgpackLength(b, len(v), 0x80, 0xde, 0xdf)
+		for key, inner := range v {
+			b = appendMsgpack(b, key)
+			b = appendMsgpack(b, inner)
+		}
+		return b
+	}
+	panic(fmt.Sprintf("can't encode %T as msgpack", v))
+}
+
+// appendMsgpackLength appends the type and length of a string, binary, array
+// or map of length n. fix is the type with the length in it for short ones,
+// or 0 if there isn't one, and the other two take 16 and 32 bit lengths.
+func appendMsgpackLength(b []byte, n int, fix, type16, type32 byte) []byte {
+	switch {
+	case fix != 0 && n < 16 || fix == 0xa0 && n < 32:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, type16, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+		return b
+	}
+	b = append(b, type32, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(n))
+	return b
+}
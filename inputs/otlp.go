@@ -0,0 +1,502 @@
+package inputs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+type OTLPOptions struct {
+	Listen          string `long:"listen" description:"Address to receive OpenTelemetry logs over OTLP/HTTP on, like :4318. Logs are POSTed to /v1/logs, in protobuf or JSON"`
+	AuthToken       string `long:"auth_token" description:"If set, requests need an 'Authorization: Bearer <token>' header with this token"`
+	MaxBodyBytes    uint   `long:"max_body_bytes" description:"Maximum size of a request body, once it's uncompressed" default:"10485760"`
+	QueueSize       uint   `long:"queue_size" description:"How many log records can be waiting to be sent. Requests that don't fit get a 429 response" default:"10000"`
+	ResourcePrefix  string `long:"resource_prefix" description:"Prefix for the fields made from resource attributes" default:"resource."`
+	AttributePrefix string `long:"attribute_prefix" description:"Prefix for the fields made from log record attributes" default:"attributes."`
+}
+
+// otlpLog is a log record, with the resource and scope it came from
+type otlpLog struct {
+	resource       map[string]interface{}
+	scopeName      string
+	scopeVersion   string
+	time           uint64
+	observedTime   uint64
+	severityNumber int64
+	severityText   string
+	body           interface{}
+	attributes     map[string]interface{}
+	traceID        []byte
+	spanID         []byte
+}
+
+// OTLP starts receiving OpenTelemetry logs over OTLP/HTTP, as set in opts.
+// Each log record is passed on as an event by the channel returned, until ctx
+// is cancelled.
+func OTLP(ctx context.Context, opts OTLPOptions) (chan event.Event, error) {
+	h := newHTTPInput(HTTPOptions{
+		Listen:       opts.Listen,
+		AuthToken:    opts.AuthToken,
+		MaxBodyBytes: opts.MaxBodyBytes,
+		QueueSize:    opts.QueueSize,
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/logs", func(w http.ResponseWriter, r *http.Request) {
+		handleOTLP(h, opts, w, r)
+	})
+	if err := h.serve(ctx, mux, "OTLP/HTTP"); err != nil {
+		return nil, err
+	}
+	return h.events, nil
+}
+
+func handleOTLP(h *httpInput, opts OTLPOptions, w http.ResponseWriter, r *http.Request) {
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var decode func([]byte) ([]otlpLog, error)
+	switch contentType {
+	case "application/x-protobuf":
+		decode = decodeOTLPProto
+	case "application/json":
+		decode = decodeOTLPJSON
+	default:
+		http.Error(w, "the content type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	logs, err := decode(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("can't read the logs: %s", err), http.StatusBadRequest)
+		return
+	}
+	events := make([]event.Event, len(logs))
+	for i, log := range logs {
+		events[i] = log.event(opts)
+	}
+	h.queue(&otlpResponse{ResponseWriter: w, contentType: contentType}, len(events), func() int { return cap(h.events) - len(h.events) }, func() {
+		for _, ev := range events {
+			h.events <- ev
+		}
+		metrics.Add("otlp_log_records_received", int64(len(events)))
+	})
+}
+
+// otlpResponse writes an empty ExportLogsServiceResponse, in the same encoding
+// as the request, when the logs are accepted. OTLP expects a 200 for that.
+type otlpResponse struct {
+	http.ResponseWriter
+	contentType string
+}
+
+func (w *otlpResponse) WriteHeader(status int) {
+	if status != http.StatusAccepted {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", w.contentType)
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	if w.contentType == "application/json" {
+		w.Write([]byte("{}"))
+	}
+}
+
+// event makes the log record into an event. Attributes are flattened into
+// fields of their own, and the record's own fields win over them.
+func (l *otlpLog) event(opts OTLPOptions) event.Event {
+	data := make(map[string]interface{})
+	flattenAttributes(data, opts.ResourcePrefix, l.resource)
+	flattenAttributes(data, opts.AttributePrefix, l.attributes)
+	if l.scopeName != "" {
+		data["scope_name"] = l.scopeName
+	}
+	if l.scopeVersion != "" {
+		data["scope_version"] = l.scopeVersion
+	}
+	if l.severityNumber != 0 {
+		data["severity_number"] = l.severityNumber
+	}
+	if l.severityText != "" {
+		data["severity_text"] = l.severityText
+	}
+	switch body := l.body.(type) {
+	case nil:
+	case map[string]interface{}, []interface{}:
+		data["body"] = jsonString(body)
+	default:
+		data["body"] = body
+	}
+	if len(l.traceID) > 0 {
+		data["trace_id"] = hex.EncodeToString(l.traceID)
+	}
+	if len(l.spanID) > 0 {
+		data["span_id"] = hex.EncodeToString(l.spanID)
+	}
+	// the time the record was seen is the best there is if it doesn't say
+	// when it happened
+	timestamp := time.Now().UTC()
+	if l.time != 0 {
+		timestamp = time.Unix(0, int64(l.time)).UTC()
+	} else if l.observedTime != 0 {
+		timestamp = time.Unix(0, int64(l.observedTime)).UTC()
+	}
+	return event.Event{Timestamp: timestamp, Data: data}
+}
+
+// flattenAttributes adds attrs to data with prefix in front of their names.
+// Attributes whose values are lists of attributes of their own are flattened
+// too, with their names joined by dots, and arrays are kept as JSON.
+func flattenAttributes(data map[string]interface{}, prefix string, attrs map[string]interface{}) {
+	for key, value := range attrs {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenAttributes(data, prefix+key+".", value)
+		case []interface{}:
+			data[prefix+key] = jsonString(value)
+		default:
+			data[prefix+key] = value
+		}
+	}
+}
+
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// decodeOTLPProto reads the log records from a protobuf
+// ExportLogsServiceRequest
+func decodeOTLPProto(b []byte) ([]otlpLog, error) {
+	var logs []otlpLog
+	err := eachProtoField(b, func(f protoField) error {
+		if f.number == 1 && f.wireType == wireBytes {
+			return decodeResourceLogs(f.bytes, &logs)
+		}
+		return nil
+	})
+	return logs, err
+}
+
+func decodeResourceLogs(b []byte, logs *[]otlpLog) error {
+	var resource map[string]interface{}
+	var scopes [][]byte
+	err := eachProtoField(b, func(f protoField) error {
+		if f.wireType != wireBytes {
+			return nil
+		}
+		switch f.number {
+		case 1:
+			return eachProtoField(f.bytes, func(f protoField) error {
+				if f.number == 1 && f.wireType == wireBytes {
+					return decodeKeyValue(f.bytes, &resource)
+				}
+				return nil
+			})
+		case 2, 1000:
+			// 1000 was instrumentation_library_logs, before they were scopes
+			scopes = append(scopes, f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the resource can come after the scopes, so they're read once it's known
+	for _, scope := range scopes {
+		if err := decodeScopeLogs(scope, resource, logs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeScopeLogs(b []byte, resource map[string]interface{}, logs *[]otlpLog) error {
+	var name, version string
+	var records [][]byte
+	err := eachProtoField(b, func(f protoField) error {
+		if f.wireType != wireBytes {
+			return nil
+		}
+		switch f.number {
+		case 1:
+			return eachProtoField(f.bytes, func(f protoField) error {
+				if f.wireType == wireBytes && f.number == 1 {
+					name = string(f.bytes)
+				} else if f.wireType == wireBytes && f.number == 2 {
+					version = string(f.bytes)
+				}
+				return nil
+			})
+		case 2:
+			records = append(records, f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		log := otlpLog{resource: resource, scopeName: name, scopeVersion: version}
+		if err := decodeLogRecord(record, &log); err != nil {
+			return err
+		}
+		*logs = append(*logs, log)
+	}
+	return nil
+}
+
+func decodeLogRecord(b []byte, log *otlpLog) error {
+	return eachProtoField(b, func(f protoField) error {
+		switch {
+		case f.number == 1 && f.wireType == wireFixed64:
+			log.time = f.num
+		case f.number == 11 && f.wireType == wireFixed64:
+			log.observedTime = f.num
+		case f.number == 2 && f.wireType == wireVarint:
+			log.severityNumber = int64(f.num)
+		case f.number == 3 && f.wireType == wireBytes:
+			log.severityText = string(f.bytes)
+		case f.number == 5 && f.wireType == wireBytes:
+			body, err := decodeAnyValue(f.bytes)
+			if err != nil {
+				return err
+			}
+			log.body = body
+		case f.number == 6 && f.wireType == wireBytes:
+			return decodeKeyValue(f.bytes, &log.attributes)
+		case f.number == 9 && f.wireType == wireBytes:
+			log.traceID = f.bytes
+		case f.number == 10 && f.wireType == wireBytes:
+			log.spanID = f.bytes
+		}
+		return nil
+	})
+}
+
+// decodeKeyValue reads a KeyValue into attrs, making the map if need be
+func decodeKeyValue(b []byte, attrs *map[string]interface{}) error {
+	var key string
+	var value interface{}
+	err := eachProtoField(b, func(f protoField) error {
+		if f.wireType != wireBytes {
+			return nil
+		}
+		switch f.number {
+		case 1:
+			key = string(f.bytes)
+		case 2:
+			var err error
+			value, err = decodeAnyValue(f.bytes)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if *attrs == nil {
+		*attrs = make(map[string]interface{})
+	}
+	(*attrs)[key] = value
+	return nil
+}
+
+// decodeAnyValue reads an AnyValue. Arrays become []interface{}, lists of
+// attributes map[string]interface{} and bytes base64, the way OTLP/JSON has
+// them.
+func decodeAnyValue(b []byte) (interface{}, error) {
+	var value interface{}
+	err := eachProtoField(b, func(f protoField) error {
+		switch {
+		case f.number == 1 && f.wireType == wireBytes:
+			value = string(f.bytes)
+		case f.number == 2 && f.wireType == wireVarint:
+			value = f.num != 0
+		case f.number == 3 && f.wireType == wireVarint:
+			value = int64(f.num)
+		case f.number == 4 && f.wireType == wireFixed64:
+			value = math.Float64frombits(f.num)
+		case f.number == 5 && f.wireType == wireBytes:
+			values := []interface{}{}
+			err := eachProtoField(f.bytes, func(f protoField) error {
+				if f.number == 1 && f.wireType == wireBytes {
+					v, err := decodeAnyValue(f.bytes)
+					values = append(values, v)
+					return err
+				}
+				return nil
+			})
+			value = values
+			return err
+		case f.number == 6 && f.wireType == wireBytes:
+			values := map[string]interface{}{}
+			err := eachProtoField(f.bytes, func(f protoField) error {
+				if f.number == 1 && f.wireType == wireBytes {
+					return decodeKeyValue(f.bytes, &values)
+				}
+				return nil
+			})
+			value = values
+			return err
+		case f.number == 7 && f.wireType == wireBytes:
+			value = base64.StdEncoding.EncodeToString(f.bytes)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// The OTLP/JSON encoding of an ExportLogsServiceRequest. 64 bit integers can
+// be strings or numbers, and IDs are hex rather than base64.
+type otlpJSONRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"scope"`
+			LogRecords []struct {
+				TimeUnixNano         otlpJSONInt        `json:"timeUnixNano"`
+				ObservedTimeUnixNano otlpJSONInt        `json:"observedTimeUnixNano"`
+				SeverityNumber       int64              `json:"severityNumber"`
+				SeverityText         string             `json:"severityText"`
+				Body                 *otlpJSONAnyValue  `json:"body"`
+				Attributes           []otlpJSONKeyValue `json:"attributes"`
+				TraceID              string             `json:"traceId"`
+				SpanID               string             `json:"spanId"`
+			} `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+type otlpJSONAnyValue struct {
+	StringValue *string      `json:"stringValue"`
+	BoolValue   *bool        `json:"boolValue"`
+	IntValue    *otlpJSONInt `json:"intValue"`
+	DoubleValue *float64     `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []otlpJSONAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJSONKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+	// encoding/json takes base64 for []byte, as OTLP/JSON does
+	BytesValue []byte `json:"bytesValue"`
+}
+
+// otlpJSONInt is a 64 bit integer that can be a string or a number
+type otlpJSONInt int64
+
+func (i *otlpJSONInt) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// times in nanoseconds can be too big for an int64 only in theory
+		u, uerr := strconv.ParseUint(s, 10, 64)
+		if uerr != nil {
+			return fmt.Errorf("expected an integer, got %s", b)
+		}
+		n = int64(u)
+	}
+	*i = otlpJSONInt(n)
+	return nil
+}
+
+func (v *otlpJSONAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, len(v.ArrayValue.Values))
+		for i := range v.ArrayValue.Values {
+			values[i] = v.ArrayValue.Values[i].value()
+		}
+		return values
+	case v.KvlistValue != nil:
+		return otlpJSONAttributes(v.KvlistValue.Values)
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+	return nil
+}
+
+func otlpJSONAttributes(kvs []otlpJSONKeyValue) map[string]interface{} {
+	if len(kvs) == 0 {
+		return nil
+	}
+	attrs := make(map[string]interface{}, len(kvs))
+	for i := range kvs {
+		attrs[kvs[i].Key] = kvs[i].Value.value()
+	}
+	return attrs
+}
+
+// decodeOTLPJSON reads the log records from an ExportLogsServiceRequest in
+// OTLP/JSON
+func decodeOTLPJSON(b []byte) ([]otlpLog, error) {
+	var request otlpJSONRequest
+	if err := json.Unmarshal(b, &request); err != nil {
+		return nil, err
+	}
+	var logs []otlpLog
+	for _, resourceLogs := range request.ResourceLogs {
+		resource := otlpJSONAttributes(resourceLogs.Resource.Attributes)
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, record := range scopeLogs.LogRecords {
+				log := otlpLog{
+					resource:       resource,
+					scopeName:      scopeLogs.Scope.Name,
+					scopeVersion:   scopeLogs.Scope.Version,
+					time:           uint64(record.TimeUnixNano),
+					observedTime:   uint64(record.ObservedTimeUnixNano),
+					severityNumber: record.SeverityNumber,
+					severityText:   record.SeverityText,
+					attributes:     otlpJSONAttributes(record.Attributes),
+				}
+				if record.Body != nil {
+					log.body = record.Body.value()
+				}
+				var err error
+				if log.traceID, err = hex.DecodeString(record.TraceID); err != nil {
+					return nil, fmt.Errorf("bad trace ID %q", record.TraceID)
+				}
+				if log.spanID, err = hex.DecodeString(record.SpanID); err != nil {
+					return nil, fmt.Errorf("bad span ID %q", record.SpanID)
+				}
+				logs = append(logs, log)
+			}
+		}
+	}
+	return logs, nil
+}
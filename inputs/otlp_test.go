@@ -0,0 +1,178 @@
+package inputs
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// appendVarint and the functions after it build protobuf messages for the tests
+func appendVarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func protoBytes(number int, fields ...[]byte) []byte {
+	var msg []byte
+	for _, f := range fields {
+		msg = append(msg, f...)
+	}
+	b := appendVarint(nil, uint64(number<<3|wireBytes))
+	b = appendVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+func protoString(number int, s string) []byte {
+	return protoBytes(number, []byte(s))
+}
+
+func protoVarint(number int, v uint64) []byte {
+	b := appendVarint(nil, uint64(number<<3|wireVarint))
+	return appendVarint(b, v)
+}
+
+func protoFixed64(number int, v uint64) []byte {
+	b := appendVarint(nil, uint64(number<<3|wireFixed64))
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return append(b, buf...)
+}
+
+func protoKeyValue(number int, key string, value []byte) []byte {
+	return protoBytes(number, protoString(1, key), protoBytes(2, value))
+}
+
+var otlpTime = time.Date(2017, 10, 16, 9, 0, 0, 0, time.UTC)
+
+var otlpExpected = map[string]interface{}{
+	"resource.service.name":  "checkout",
+	"resource.host.cpus":     int64(4),
+	"attributes.http.status": int64(500),
+	"attributes.retry":       true,
+	"attributes.ratio":       0.5,
+	"attributes.tags":        `["a","b"]`,
+	"attributes.user.id":     "u1",
+	"attributes.user.admin":  false,
+	"attributes.raw":         "AQI=",
+	"scope_name":             "checkout-logger",
+	"scope_version":          "1.2",
+	"severity_number":        int64(17),
+	"severity_text":          "ERROR",
+	"body":                   "payment failed",
+	"trace_id":               "5b8efff798038103d269b633813fc60c",
+	"span_id":                "eee19b7ec3c1b174",
+}
+
+func TestDecodeOTLPProto(t *testing.T) {
+	traceID := []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c}
+	spanID := []byte{0xee, 0xe1, 0x9b, 0x7e, 0xc3, 0xc1, 0xb1, 0x74}
+	record := protoBytes(2,
+		protoFixed64(1, uint64(otlpTime.UnixNano())),
+		protoVarint(2, 17),
+		protoString(3, "ERROR"),
+		protoBytes(5, protoString(1, "payment failed")),
+		protoKeyValue(6, "http.status", protoVarint(3, 500)),
+		protoKeyValue(6, "retry", protoVarint(2, 1)),
+		protoKeyValue(6, "ratio", protoFixed64(4, math.Float64bits(0.5))),
+		protoKeyValue(6, "tags", protoBytes(5, protoBytes(1, protoString(1, "a")), protoBytes(1, protoString(1, "b")))),
+		protoKeyValue(6, "user", protoBytes(6,
+			protoKeyValue(1, "id", protoString(1, "u1")),
+			protoKeyValue(1, "admin", protoVarint(2, 0)))),
+		protoKeyValue(6, "raw", protoBytes(7, []byte{1, 2})),
+		protoBytes(9, traceID),
+		protoBytes(10, spanID),
+		// fields it doesn't know about are skipped
+		protoVarint(99, 1),
+	)
+	// the scope comes before the resource, which is allowed
+	request := protoBytes(1,
+		protoBytes(2, protoBytes(1, protoString(1, "checkout-logger"), protoString(2, "1.2")), record),
+		protoBytes(1,
+			protoKeyValue(1, "service.name", protoString(1, "checkout")),
+			protoKeyValue(1, "host.cpus", protoVarint(3, 4))),
+	)
+	logs, err := decodeOTLPProto(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("expected one log record, got %d", len(logs))
+	}
+	ev := logs[0].event(OTLPOptions{ResourcePrefix: "resource.", AttributePrefix: "attributes."})
+	if !ev.Timestamp.Equal(otlpTime) {
+		t.Errorf("expected the record's time, got %s", ev.Timestamp)
+	}
+	if !reflect.DeepEqual(ev.Data, otlpExpected) {
+		t.Errorf("expected %v, got %v", otlpExpected, ev.Data)
+	}
+
+	if _, err := decodeOTLPProto(request[:len(request)-3]); err == nil {
+		t.Error("expected an error for a truncated message")
+	}
+}
+
+const otlpJSON = `{"resourceLogs": [{
+	"resource": {"attributes": [
+		{"key": "service.name", "value": {"stringValue": "checkout"}},
+		{"key": "host.cpus", "value": {"intValue": "4"}}
+	]},
+	"scopeLogs": [{
+		"scope": {"name": "checkout-logger", "version": "1.2"},
+		"logRecords": [{
+			"timeUnixNano": "1508144400000000000",
+			"severityNumber": 17,
+			"severityText": "ERROR",
+			"body": {"stringValue": "payment failed"},
+			"attributes": [
+				{"key": "http.status", "value": {"intValue": 500}},
+				{"key": "retry", "value": {"boolValue": true}},
+				{"key": "ratio", "value": {"doubleValue": 0.5}},
+				{"key": "tags", "value": {"arrayValue": {"values": [{"stringValue": "a"}, {"stringValue": "b"}]}}},
+				{"key": "user", "value": {"kvlistValue": {"values": [
+					{"key": "id", "value": {"stringValue": "u1"}},
+					{"key": "admin", "value": {"boolValue": false}}
+				]}}},
+				{"key": "raw", "value": {"bytesValue": "AQI="}}
+			],
+			"traceId": "5b8efff798038103d269b633813fc60c",
+			"spanId": "eee19b7ec3c1b174"
+		}, {
+			"observedTimeUnixNano": 1508144401000000000,
+			"body": {"kvlistValue": {"values": [{"key": "a", "value": {"intValue": 1}}]}}
+		}]
+	}]
+}]}`
+
+func TestOTLPHandler(t *testing.T) {
+	opts := OTLPOptions{MaxBodyBytes: 10000, QueueSize: 10, ResourcePrefix: "resource.", AttributePrefix: "attributes."}
+	h := newHTTPInput(HTTPOptions{MaxBodyBytes: opts.MaxBodyBytes, QueueSize: opts.QueueSize})
+	handler := func(w http.ResponseWriter, r *http.Request) { handleOTLP(h, opts, w, r) }
+
+	if w := post(handler, otlpJSON, map[string]string{"Content-Type": "text/plain"}); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected an unknown content type to give a 415, got %d", w.Code)
+	}
+	if w := post(handler, `{"resourceLogs": [{"scopeLogs": [{"logRecords": [{"traceId": "xyz"}]}]}]}`, map[string]string{"Content-Type": "application/json"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad trace ID to give a 400, got %d", w.Code)
+	}
+	w := post(handler, otlpJSON, map[string]string{"Content-Type": "application/json; charset=utf-8"})
+	if w.Code != http.StatusOK || w.Body.String() != "{}" {
+		t.Fatalf("expected an empty JSON response, got %d: %s", w.Code, w.Body)
+	}
+	ev := <-h.events
+	if !ev.Timestamp.Equal(otlpTime) {
+		t.Errorf("expected the record's time, got %s", ev.Timestamp)
+	}
+	if !reflect.DeepEqual(ev.Data, otlpExpected) {
+		t.Errorf("expected %v, got %v", otlpExpected, ev.Data)
+	}
+	ev = <-h.events
+	if !ev.Timestamp.Equal(otlpTime.Add(time.Second)) {
+		t.Errorf("expected the observed time when there's no time, got %s", ev.Timestamp)
+	}
+	if ev.Data["body"] != `{"a":1}` || ev.Data["resource.service.name"] != "checkout" {
+		t.Errorf("expected a structured body to be kept as JSON, with the same resource, got %v", ev.Data)
+	}
+}
@@ -0,0 +1,72 @@
+package inputs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// protoField is one field read from a protobuf message. Varints and fixed
+// size values are in num, and strings, bytes and embedded messages in bytes.
+type protoField struct {
+	number   int
+	wireType int
+	num      uint64
+	bytes    []byte
+}
+
+// eachProtoField calls fn with each field in the protobuf message b, in the
+// order they're in. It's enough to read messages without generated code,
+// so long as they don't use groups, which were deprecated long ago.
+func eachProtoField(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		f := protoField{number: int(key >> 3), wireType: int(key & 7)}
+		switch f.wireType {
+		case wireVarint:
+			if f.num, n = binary.Uvarint(b); n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			f.num = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return errTruncated
+			}
+			f.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			f.num = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", f.wireType)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+// Package inputs has the ways other than tailing files that clicktail can be
+// sent logs.
+package inputs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/metrics"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+type SyslogOptions struct {
+	Listen          []string `long:"listen" description:"Address to receive syslog messages on, like udp://:514, tcp://:514 or unix:///dev/log for a unix datagram socket. Messages can be RFC 3164 or RFC 5424, and over TCP, newline or octet-counted. The message is passed to the parser, and the fields in the header are added to the event. May be specified multiple times"`
+	MaxMessageBytes uint     `long:"max_message_bytes" description:"Maximum size of a syslog message. Longer ones are cut short" default:"65536"`
+}
+
+// syslogFields are the fields taken from the header of a syslog message
+var syslogFields = tail.NewHeader("facility", "severity", "hostname", "app_name", "procid", "msgid", "structured_data")
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Syslog starts receiving syslog messages on the addresses in opts. They're
+// passed on as the lines of the Source returned, which is closed once ctx is
+// cancelled.
+func Syslog(ctx context.Context, opts SyslogOptions) (tail.Source, error) {
+	lines := make(chan tail.Line)
+	source := tail.Source{
+		Path:   "syslog",
+		Lines:  lines,
+		Header: syslogFields.Regex(),
+	}
+	maxBytes := int(opts.MaxMessageBytes)
+	if maxBytes <= 0 {
+		maxBytes = 65536
+	}
+	var closers []io.Closer
+	var receivers []func()
+	for _, addr := range opts.Listen {
+		u, err := url.Parse(addr)
+		if err != nil {
+			closeAll(closers)
+			return source, fmt.Errorf("can't parse the syslog address %s: %s", addr, err)
+		}
+		switch u.Scheme {
+		case "udp":
+			conn, err := net.ListenPacket("udp", u.Host)
+			if err != nil {
+				closeAll(closers)
+				return source, err
+			}
+			closers = append(closers, conn)
+			receivers = append(receivers, func() { receivePackets(ctx, conn, maxBytes, lines) })
+		case "unix", "unixgram":
+			if u.Path == "" {
+				closeAll(closers)
+				return source, fmt.Errorf("the syslog address %s needs a full path, like unix:///dev/log", addr)
+			}
+			conn, err := listenUnixgram(u.Path)
+			if err != nil {
+				closeAll(closers)
+				return source, err
+			}
+			closers = append(closers, conn)
+			receivers = append(receivers, func() {
+				receivePackets(ctx, conn, maxBytes, lines)
+				os.Remove(u.Path)
+			})
+		case "tcp":
+			listener, err := net.Listen("tcp", u.Host)
+			if err != nil {
+				closeAll(closers)
+				return source, err
+			}
+			closers = append(closers, listener)
+			receivers = append(receivers, func() { acceptSyslog(ctx, listener, maxBytes, lines) })
+		default:
+			closeAll(closers)
+			return source, fmt.Errorf("can't receive syslog messages on %s; use udp://, tcp:// or unix://", addr)
+		}
+		logrus.WithFields(logrus.Fields{"address": addr}).Info("Receiving syslog messages")
+	}
+
+	wg := sync.WaitGroup{}
+	for _, receive := range receivers {
+		wg.Add(1)
+		go func(receive func()) {
+			defer wg.Done()
+			receive()
+		}(receive)
+	}
+	go func() {
+		<-ctx.Done()
+		closeAll(closers)
+	}()
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+	return source, nil
+}
+
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+// listenUnixgram listens on a unix datagram socket at path, taking the place
+// of a stale socket left there, but not of one that's in use
+func listenUnixgram(path string) (net.PacketConn, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unixgram", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("something is already receiving messages on %s", path)
+		}
+		os.Remove(path)
+	}
+	return net.ListenPacket("unixgram", path)
+}
+
+// receivePackets passes on a message for each packet until conn is closed
+func receivePackets(ctx context.Context, conn net.PacketConn, maxBytes int, lines chan tail.Line) {
+	buf := make([]byte, maxBytes)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Error("Error receiving syslog messages")
+			}
+			return
+		}
+		if !sendSyslog(ctx, string(buf[:n]), lines) {
+			return
+		}
+	}
+}
+
+// acceptSyslog reads messages from each connection made to listener until it's
+// closed
+func acceptSyslog(ctx context.Context, listener net.Listener, maxBytes int, lines chan tail.Line) {
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Error("Error accepting syslog connections")
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			readStream(ctx, conn, maxBytes, lines)
+			conn.Close()
+		}()
+	}
+}
+
+// readStream passes on the messages sent over a stream. Each is either
+// octet-counted, starting with its length and a space, or ends at a newline.
+func readStream(ctx context.Context, conn io.Reader, maxBytes int, lines chan tail.Line) {
+	reader := bufio.NewReader(conn)
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		var msg string
+		if first[0] >= '0' && first[0] <= '9' {
+			msg, err = readCounted(reader, maxBytes)
+		} else {
+			msg, err = readLine(reader, maxBytes)
+		}
+		if len(msg) > 0 && !sendSyslog(ctx, msg, lines) {
+			return
+		}
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Error("Error reading syslog messages")
+			}
+			return
+		}
+	}
+}
+
+// readCounted reads an octet-counted message
+func readCounted(reader *bufio.Reader, maxBytes int) (string, error) {
+	length := 0
+	for digits := 0; ; digits++ {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == ' ' && digits > 0 {
+			break
+		}
+		if c < '0' || c > '9' || digits >= 9 {
+			return "", errors.New("bad length for an octet-counted syslog message")
+		}
+		length = length*10 + int(c-'0')
+	}
+	keep := length
+	if keep > maxBytes {
+		keep = maxBytes
+		metrics.Increment("syslog_messages_truncated")
+	}
+	msg := make([]byte, keep)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return "", err
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, int64(length-keep)); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+// readLine reads a message that ends at a newline
+func readLine(reader *bufio.Reader, maxBytes int) (string, error) {
+	var msg []byte
+	for {
+		part, err := reader.ReadSlice('\n')
+		if len(msg) < maxBytes {
+			keep := maxBytes - len(msg)
+			if keep > len(part) {
+				keep = len(part)
+			} else if keep < len(part) {
+				metrics.Increment("syslog_messages_truncated")
+			}
+			msg = append(msg, part[:keep]...)
+		}
+		if err != bufio.ErrBufferFull {
+			return string(msg), err
+		}
+	}
+}
+
+// sendSyslog passes on msg, with the fields from its header. It returns false
+// if ctx was cancelled first.
+func sendSyslog(ctx context.Context, msg string, lines chan tail.Line) bool {
+	msg = strings.TrimRight(msg, "\r\n\x00")
+	if msg == "" {
+		return true
+	}
+	metrics.Increment("syslog_messages")
+	m := parseSyslog(msg)
+	line := syslogFields.Add([]string{m.facility, m.severity, m.hostname, m.appName, m.procID, m.msgID, m.structuredData}, m.body)
+	select {
+	case lines <- tail.Line{Text: line}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// syslogMessage is a syslog message taken apart
+type syslogMessage struct {
+	facility       string
+	severity       string
+	hostname       string
+	appName        string
+	procID         string
+	msgID          string
+	structuredData string
+	body           string
+}
+
+// parseSyslog takes apart an RFC 5424 or RFC 3164 message. Whatever can't be
+// made sense of is left in the body.
+func parseSyslog(msg string) syslogMessage {
+	m := syslogMessage{body: msg}
+	if !strings.HasPrefix(msg, "<") {
+		return m
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return m
+	}
+	pri, err := strconv.Atoi(msg[1:end])
+	if err != nil || pri < 0 || pri >= len(syslogFacilities)*8 {
+		return m
+	}
+	m.facility = syslogFacilities[pri/8]
+	m.severity = syslogSeverities[pri%8]
+	rest := msg[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		parseRFC5424(rest[2:], &m)
+	} else {
+		parseRFC3164(rest, &m)
+	}
+	return m
+}
+
+// parseRFC5424 takes apart what's after the version in an RFC 5424 message:
+// the timestamp, hostname, app name, process ID, message ID, structured data
+// and message, with "-" for those that aren't given
+func parseRFC5424(rest string, m *syslogMessage) {
+	var fields [5]string
+	for i := range fields {
+		space := strings.IndexByte(rest, ' ')
+		if space < 0 {
+			return
+		}
+		if value := rest[:space]; value != "-" {
+			fields[i] = value
+		}
+		rest = rest[space+1:]
+	}
+	// the timestamp is left to the parser, which finds its own in the message
+	m.hostname, m.appName, m.procID, m.msgID = fields[1], fields[2], fields[3], fields[4]
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else if strings.HasPrefix(rest, "[") {
+		data, n, ok := parseStructuredData(rest)
+		if ok {
+			m.structuredData = data
+			rest = rest[n:]
+		}
+	}
+	rest = strings.TrimPrefix(rest, " ")
+	// the message can start with a byte order mark to say it's UTF-8
+	m.body = strings.TrimPrefix(rest, "\xef\xbb\xbf")
+}
+
+// parseStructuredData takes apart the structured data elements at the start
+// of s, like [id name="value"]. It returns them as JSON, with how much of s
+// they took up.
+func parseStructuredData(s string) (string, int, bool) {
+	elements := make(map[string]map[string]string)
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		i++
+		start := i
+		for i < len(s) && s[i] != ' ' && s[i] != ']' {
+			i++
+		}
+		if i >= len(s) {
+			return "", 0, false
+		}
+		params := make(map[string]string)
+		elements[s[start:i]] = params
+		for i < len(s) && s[i] == ' ' {
+			i++
+			start = i
+			for i < len(s) && s[i] != '=' {
+				i++
+			}
+			if i+1 >= len(s) || s[i+1] != '"' {
+				return "", 0, false
+			}
+			name := s[start:i]
+			i += 2
+			var value []byte
+			for i < len(s) && s[i] != '"' {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']') {
+					i++
+				}
+				value = append(value, s[i])
+				i++
+			}
+			if i >= len(s) {
+				return "", 0, false
+			}
+			params[name] = string(value)
+			i++
+		}
+		if i >= len(s) || s[i] != ']' {
+			return "", 0, false
+		}
+		i++
+	}
+	data, err := json.Marshal(elements)
+	if err != nil {
+		return "", 0, false
+	}
+	return string(data), i, true
+}
+
+// parseRFC3164 takes apart what's after the priority in a BSD syslog message:
+// the timestamp, the hostname, which local messages leave out, and a tag
+// like app[pid]:
+func parseRFC3164(rest string, m *syslogMessage) {
+	if len(rest) > len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil && rest[len(time.Stamp)] == ' ' {
+			rest = rest[len(time.Stamp)+1:]
+		}
+	}
+	if space := strings.IndexByte(rest, ' '); space > 0 {
+		// some senders use RFC 3339 timestamps instead
+		if _, err := time.Parse(time.RFC3339Nano, rest[:space]); err == nil {
+			rest = rest[space+1:]
+		}
+	}
+	tokens := strings.SplitN(rest, " ", 3)
+	switch {
+	case len(tokens) >= 1 && isSyslogTag(tokens[0]):
+		rest = strings.TrimPrefix(rest, tokens[0])
+		setSyslogTag(tokens[0], m)
+	case len(tokens) >= 2 && isSyslogTag(tokens[1]):
+		m.hostname = tokens[0]
+		rest = strings.TrimPrefix(rest, tokens[0]+" "+tokens[1])
+		setSyslogTag(tokens[1], m)
+	}
+	m.body = strings.TrimPrefix(rest, " ")
+}
+
+// isSyslogTag reports whether s is a tag, like app: or app[pid]:
+func isSyslogTag(s string) bool {
+	return len(s) > 1 && strings.HasSuffix(s, ":")
+}
+
+func setSyslogTag(tag string, m *syslogMessage) {
+	tag = strings.TrimSuffix(tag, ":")
+	if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+		m.procID = tag[open+1 : len(tag)-1]
+		tag = tag[:open]
+	}
+	m.appName = tag
+}
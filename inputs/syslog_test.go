@@ -0,0 +1,184 @@
+package inputs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		msg      string
+		expected syslogMessage
+	}{
+		{
+			msg: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"][meta x="a \"quoted\" \] value"] ` + "\xef\xbb\xbf" + `An application event`,
+			expected: syslogMessage{
+				facility:       "local4",
+				severity:       "notice",
+				hostname:       "mymachine.example.com",
+				appName:        "evntslog",
+				msgID:          "ID47",
+				structuredData: `{"exampleSDID@32473":{"eventSource":"Application","iut":"3"},"meta":{"x":"a \"quoted\" ] value"}}`,
+				body:           "An application event",
+			},
+		},
+		{
+			msg: `<34>1 2003-10-11T22:14:15.003Z - su 1234 - -`,
+			expected: syslogMessage{
+				facility: "auth",
+				severity: "crit",
+				appName:  "su",
+				procID:   "1234",
+			},
+		},
+		{
+			msg: `<190>Oct 16 09:00:00 web1 nginx: 10.0.0.1 - - "GET / HTTP/1.1" 200`,
+			expected: syslogMessage{
+				facility: "local7",
+				severity: "info",
+				hostname: "web1",
+				appName:  "nginx",
+				body:     `10.0.0.1 - - "GET / HTTP/1.1" 200`,
+			},
+		},
+		{
+			// local messages leave out the hostname
+			msg: `<30>Oct  6 19:04:01 cron[123]: job done`,
+			expected: syslogMessage{
+				facility: "daemon",
+				severity: "info",
+				appName:  "cron",
+				procID:   "123",
+				body:     "job done",
+			},
+		},
+		{
+			msg: `<13>2017-10-16T09:00:00+02:00 host app: message`,
+			expected: syslogMessage{
+				facility: "user",
+				severity: "notice",
+				hostname: "host",
+				appName:  "app",
+				body:     "message",
+			},
+		},
+		{
+			msg:      `not syslog at all`,
+			expected: syslogMessage{body: "not syslog at all"},
+		},
+		{
+			msg:      `<999>out of range`,
+			expected: syslogMessage{body: "<999>out of range"},
+		},
+	}
+	for _, test := range tests {
+		if m := parseSyslog(test.msg); !reflect.DeepEqual(m, test.expected) {
+			t.Errorf("parsing %q: expected %+v, got %+v", test.msg, test.expected, m)
+		}
+	}
+}
+
+// checkHeaderLine checks that line has the header h puts on it for the
+// fields, which the header's regex takes apart again, and then body
+func checkHeaderLine(t *testing.T, h *tail.Header, line string, fields map[string]string, body string) {
+	regex := &parsers.ExtRegexp{Regexp: regexp.MustCompile(h.Regex())}
+	prefix, got := regex.FindStringSubmatchMap(line)
+	if prefix == "" {
+		t.Errorf("expected a header on %q", line)
+		return
+	}
+	for name, value := range fields {
+		if got[name] != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, got[name])
+		}
+	}
+	if rest := strings.TrimPrefix(line, prefix); rest != body {
+		t.Errorf("expected the message %q, got %q", body, rest)
+	}
+}
+
+func receiveLine(t *testing.T, lines chan tail.Line) string {
+	select {
+	case line := <-lines:
+		return line.Text
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a syslog message")
+	}
+	return ""
+}
+
+func TestSyslogReceive(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	// find ports that are free
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := []string{"tcp://" + listener.Addr().String(), "udp://" + packets.LocalAddr().String()}
+	listener.Close()
+	packets.Close()
+	socket := tmpdir + "/log"
+	addrs = append(addrs, "unix://"+socket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source, err := Syslog(ctx, SyslogOptions{Listen: addrs, MaxMessageBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// newline framing and octet counting can be mixed on one connection, and
+	// long messages are cut short
+	conn, err := net.Dial("tcp", strings.TrimPrefix(addrs[0], "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := "<14>1 - host app - - - counted\nwith a newline"
+	long := "<14>host app: " + strings.Repeat("x", 150)
+	fmt.Fprintf(conn, "<14>host app: first\n%d %s%d %s", len(counted), counted, len(long), long)
+	conn.Close()
+	checkHeaderLine(t, syslogFields, receiveLine(t, source.Lines), map[string]string{"hostname": "host", "app_name": "app", "severity": "info"}, "first")
+	checkHeaderLine(t, syslogFields, receiveLine(t, source.Lines), map[string]string{"hostname": "host", "app_name": "app"}, "counted\nwith a newline")
+	checkHeaderLine(t, syslogFields, receiveLine(t, source.Lines), map[string]string{"app_name": "app"}, long[len("<14>host app: "):100])
+
+	for _, network := range []string{"udp", "unixgram"} {
+		var conn net.Conn
+		if network == "udp" {
+			conn, err = net.Dial("udp", strings.TrimPrefix(addrs[1], "udp://"))
+		} else {
+			conn, err = net.Dial("unixgram", socket)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "<11>app[42]: over %s", network)
+		conn.Close()
+		checkHeaderLine(t, syslogFields, receiveLine(t, source.Lines), map[string]string{"facility": "user", "severity": "err", "procid": "42"}, "over "+network)
+	}
+
+	// the lines are closed once it's cancelled
+	cancel()
+	for range source.Lines {
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Error("expected the unix socket to be removed")
+	}
+}
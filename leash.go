@@ -12,8 +12,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/dynsampler-go"
@@ -21,6 +23,8 @@ import (
 	"github.com/honeycombio/urlshaper"
 
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/inputs"
+	"github.com/honeycombio/honeytail/metrics"
 	"github.com/honeycombio/honeytail/parsers"
 	"github.com/honeycombio/honeytail/parsers/arangodb"
 	"github.com/honeycombio/honeytail/parsers/htjson"
@@ -30,19 +34,22 @@ import (
 	"github.com/honeycombio/honeytail/parsers/postgresql"
 	"github.com/honeycombio/honeytail/parsers/regex"
 	"github.com/honeycombio/honeytail/tail"
+	"github.com/honeycombio/honeytail/throttle"
 	"github.com/Altinity/clicktail/parsers/mysql"
     "github.com/Altinity/clicktail/parsers/mysqlaudit"
 )
 
 // actually go and be leashy
-func run(options GlobalOptions) {
+func run(ctx context.Context, options GlobalOptions) {
 	logrus.Info("Starting clicktail")
 
 	stats := newResponseStats()
 
 	sigs := make(chan os.Signal, 1)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
 
 	// spin up our transmission to send events to ClickHouse
 	libhConfig := libclick.Config{
@@ -76,45 +83,195 @@ func run(options GlobalOptions) {
 		prefixRegex = &parsers.ExtRegexp{regexp.MustCompile(options.PrefixRegex)}
 	}
 
-	// get our lines channel from which to read log lines
-	var linesChans []chan string
-	var err error
+	// get the channel from which we'll get a source of log lines for each file
+	// statefiles aren't written on the way out until everything read has been
+	// acknowledged
+	stateGate := tail.NewStateGate()
+	rotateStyle := tail.RotateStyleSyslog
+	if options.Tail.RotateStyle == "timestamp" {
+		rotateStyle = tail.RotateStyleTimestamp
+	}
 	tc := tail.Config{
-		Paths:   options.Reqs.LogFiles,
-		Type:    tail.RotateStyleSyslog,
-		Options: options.Tail,
+		Paths:     options.Reqs.LogFiles,
+		Dirs:      options.Reqs.Dirs,
+		Dir:       options.Dir,
+		Type:      rotateStyle,
+		Options:   options.Tail,
+		StateGate: stateGate,
+	}
+	if options.Tail.StateDB != "" {
+		db, err := tail.OpenStateDB(options.Tail.StateDB)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"state_db": options.Tail.StateDB,
+				"err":      err,
+			}).Fatal("Error opening the state database")
+		}
+		tc.StateDB = db
 	}
+	// takes container logs out of the runtime's wrapper before they're
+	// parsed, if asked to
+	unwrapper, err := tail.NewUnwrapper(options.Container)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Fatal(
+			"Error setting up the container log format")
+	}
+	// --tail.read_from=time: and --stop_at go by the times the parser finds
+	// in the lines. checkOptions has made sure the parser can.
+	if strings.HasPrefix(options.Tail.ReadFrom, "time:") || options.StopAt != "" {
+		if unwrapper != nil {
+			tc.LineTimestamp = unwrapper.LineTimestamp
+		} else {
+			tc.LineTimestamp, err = getLineTimestamp(options, prefixRegex)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Fatal(
+					"Error setting up finding the time of each line")
+			}
+		}
+		if options.StopAt != "" {
+			tc.StopAt, _ = tail.ParseTime(options.StopAt)
+		}
+	}
+	// joins the lines of records that take several into one before they're
+	// parsed, if asked to. checkOptions has made sure the flags are good.
+	joiner, _ := tail.NewJoiner(options.Multiline)
+	// the tail sample rate can be changed by reloading the config
+	var tailRate *tail.SampleRate
 	if options.TailSample {
-		linesChans, err = tail.GetSampledEntries(ctx, tc, options.SampleRate)
-	} else {
-		linesChans, err = tail.GetEntries(ctx, tc)
+		tailRate = tail.NewSampleRate(options.SampleRate)
 	}
+	sources, eventInputs, err := getSources(ctx, options, tc)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{"err": err}).Fatal(
 			"Error occurred while trying to tail logfile")
 	}
 
-	// set up our signal handler and support canceling
+	// two channels to handle backing off when rate limited and resending failed
+	// send attempts that are recoverable. They're shared by all the senders so
+	// any of them can pick up a retry.
+	toBeResent := make(chan event.Event, 2*options.NumSenders)
+	// time in milliseconds to delay the send
+	delaySending := make(chan int, 2*options.NumSenders)
+
+	// keeps track of events from the time they leave a parser until ClickHouse
+	// has responded for them, and blocks when there are too many
+	budget := throttle.NewBudget(int64(options.MaxBufferBytes))
+
+	// set up our signal handler and support canceling. Cancelling stops the
+	// tailers; everything already read is then flushed through the parsers and
+	// sent before clicktail exits, unless that takes longer than the shutdown
+	// timeout or there's a second signal.
+	var stage atomic.Value
+	stage.Store("sending")
+	finished := make(chan struct{})
+	// draining is only cancelled once the shutdown is cut short, so that
+	// retries keep backing off and the rate limits keep holding until then
+	draining, stopDraining := context.WithCancel(context.Background())
+	defer stopDraining()
 	go func() {
-		sig := <-sigs
-		fmt.Fprintf(os.Stderr, "Aborting! Caught signal \"%s\"\n", sig)
+		select {
+		case sig := <-sigs:
+			fmt.Fprintf(os.Stderr, "Aborting! Caught signal \"%s\"\n", sig)
+		case <-finished:
+			return
+		}
 		fmt.Fprintf(os.Stderr, "Cleaning up...\n")
 		cancel()
-		// and if they insist, catch a second CTRL-C or timeout on 10sec
+		var deadline <-chan time.Time
+		if options.ShutdownTimeout != 0 {
+			deadline = time.After(time.Duration(options.ShutdownTimeout) * time.Second)
+		}
 		select {
+		case <-finished:
+			return
 		case <-sigs:
 			fmt.Fprintf(os.Stderr, "Caught second signal... Aborting.\n")
-			os.Exit(1)
-		case <-time.After(10 * time.Second):
+		case <-deadline:
 			fmt.Fprintf(os.Stderr, "Taking too long... Aborting.\n")
-			os.Exit(1)
 		}
+		stopDraining()
+		logLostWork(stage.Load().(string), budget, toBeResent)
+		os.Exit(1)
 	}()
 
-	// for each channel we got back from tail.GetEntries, spin up a parser.
-	parsersWG := sync.WaitGroup{}
+	// start a goroutine that reads from responses and logs.
+	go logStats(stats, options.StatusInterval)
+	// when backfilling, keep track of how far through the files we are
+	var progress *progressReporter
+	if options.Tail.Stop {
+		progress = newProgressReporter(ctx)
+		go progress.logEvery(options.StatusInterval, finished)
+	}
 	responsesWG := sync.WaitGroup{}
-	for _, lines := range linesChans {
+	startResponseHandler := func() {
+		responses := libclick.Responses()
+		responsesWG.Add(1)
+		go func() {
+			handleResponses(responses, stats, toBeResent, delaySending, budget, options)
+			responsesWG.Done()
+		}()
+	}
+	startResponseHandler()
+
+	// output throttling shared by every file
+	globalLimiter := throttle.New(options.RateLimit, options.RateLimitBytes)
+
+	// keeps track of the stages that can be rebuilt when the config is reloaded
+	reloads := &reloader{
+		options:  options,
+		load:     reloadOptions,
+		tailRate: tailRate,
+	}
+
+	go reloads.watch(ctx, options.ConfigFile)
+
+	// sendEvents sets up the transforms and a sender for the events from a
+	// parser, or from an input that makes events itself, in which case parser
+	// is nil. The channel returned is closed once events is closed and all of
+	// them have been handed to libclick.
+	sendEvents := func(parser parsers.Parser, events chan event.Event) chan struct{} {
+		// apply any filters to the events before they get sent
+		transforms, err := reloads.add(parser)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal(
+				"Error setting up event transforms")
+		}
+		modifiedToBeSent := modifyEventContents(events, transforms, options.NumSenders)
+
+		// start up the sender. all sources are either sampled when tailing or in-
+		// parser, so always tell libclick events are pre-sampled
+		limiters := []*throttle.Limiter{
+			throttle.New(options.PipelineRateLimit, options.PipelineRateLimitBytes),
+			globalLimiter,
+		}
+		doneSending := make(chan bool)
+		go sendToLibhoney(draining, modifiedToBeSent, toBeResent, delaySending, doneSending, limiters, budget)
+		sent := make(chan struct{})
+		go func() {
+			<-doneSending
+			reloads.remove(transforms)
+			close(sent)
+		}()
+		return sent
+	}
+
+	parsersWG := sync.WaitGroup{}
+	// events from inputs that make them themselves skip the parser
+	for _, events := range eventInputs {
+		if tailRate != nil {
+			events = sampleEvents(events, tailRate)
+		}
+		sent := sendEvents(nil, events)
+		parsersWG.Add(1)
+		go func() {
+			<-sent
+			parsersWG.Done()
+		}()
+	}
+
+	// for each file tail finds, spin up a parser. More files may turn up while
+	// we're running.
+	for source := range sources {
 		// get our parser
 		parser, opts := getParserAndOptions(options)
 		if parser == nil {
@@ -127,71 +284,279 @@ func run(options GlobalOptions) {
 			logrus.Fatalf(
 				"Error initializing %s parser module: %v", options.Reqs.ParserName, err)
 		}
+		// parsers that group lines into events keep the statefile at the start
+		// of an event. This has to be set up before any lines are read.
+		reporter, multiLine := parser.(parsers.EventBoundaryReporter)
+		sourceProgress := progress.add(source, !multiLine)
+		source.Lines = sourceProgress.countLines(source.Lines)
+		source = unwrapper.Unwrap(source)
+		if multiLine && source.Checkpoint != nil {
+			source.Checkpoint.Track()
+			reporter.ReportEventBoundaries(source.Checkpoint.Commit)
+		}
+		source = joiner.Join(source)
+		lines := source.Lines
+		if tailRate != nil {
+			lines = tail.SampleSourceLines(source, tailRate)
+		}
+		lines = sourceProgress.countParsed(lines)
 
 		// create a channel for sending events into libclick
 		toBeSent := make(chan event.Event, options.NumSenders)
-		doneSending := make(chan bool)
-
-		// two channels to handle backing off when rate limited and resending failed
-		// send attempts that are recoverable
-		toBeResent := make(chan event.Event, 2*options.NumSenders)
-		// time in milliseconds to delay the send
-		delaySending := make(chan int, 2*options.NumSenders)
-
-		// apply any filters to the events before they get sent
-		modifiedToBeSent := modifyEventContents(toBeSent, options)
-
-		realToBeSent := make(chan event.Event, 10*options.NumSenders)
-		go func() {
-			wg := sync.WaitGroup{}
-			for i := uint(0); i < options.NumSenders; i++ {
-				wg.Add(1)
-				go func() {
-					for ev := range modifiedToBeSent {
-						realToBeSent <- ev
-					}
-					wg.Done()
-				}()
-			}
-			wg.Wait()
-			close(realToBeSent)
-		}()
-
-		// start up the sender. all sources are either sampled when tailing or in-
-		// parser, so always tell libclick events are pre-sampled
-		go sendToLibhoney(ctx, realToBeSent, toBeResent, delaySending, doneSending)
-
-		// start a goroutine that reads from responses and logs.
-		responses := libclick.Responses()
-		responsesWG.Add(1)
-		go func() {
-			handleResponses(responses, stats, toBeResent, delaySending, options)
-			responsesWG.Done()
-		}()
+		sent := sendEvents(parser, sourceProgress.countEvents(toBeSent))
 
+		sourcePrefix := sourcePrefixRegex(source, prefixRegex)
 		parsersWG.Add(1)
-		go func(plines chan string) {
+		go func(plines chan tail.Line) {
 			// ProcessLines won't return until lines is closed
-			parser.ProcessLines(plines, toBeSent, prefixRegex)
+			processLines(parser, plines, toBeSent, sourcePrefix, options.SourceFields)
 			// trigger the sending goroutine to finish up
 			close(toBeSent)
 			// wait for all the events in toBeSent to be handed to libclick
-			<-doneSending
+			<-sent
 			parsersWG.Done()
 		}(lines)
 	}
 	parsersWG.Wait()
-	// tell libclick to finish up sending events
-	libclick.Close()
+	// tell libclick to finish up sending events, holding on to any that come
+	// back to be retried
+	stage.Store("waiting for acknowledgements")
+	retries, delay := closeLibclick(&responsesWG, toBeResent, delaySending)
+	for len(retries) > 0 {
+		// the senders are gone, so start libclick back up to send the retries
+		stage.Store("retrying")
+		logrus.WithFields(logrus.Fields{
+			"events": len(retries),
+		}).Info("Retrying events before shutting down")
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+		if err := libclick.Init(libhConfig); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error(
+				"Error occured while restarting Transmission, dropping retries")
+			metrics.Add("send_failures", int64(len(retries)))
+			break
+		}
+		startResponseHandler()
+		for _, ev := range retries {
+			if !sendEvent(ev) {
+				budget.Release(ev.Size())
+			}
+		}
+		retries, delay = closeLibclick(&responsesWG, toBeResent, delaySending)
+	}
 	// print out what we've done one last time
-	responsesWG.Wait()
 	stats.log()
 	stats.logFinal()
 
+	// now that everything's been sent, save where we got to
+	stage.Store("writing statefiles")
+	stateGate.Open()
+	if err := progress.writeSummary(os.Stdout, stats.totalsByStatus(), metrics.Get("send_failures")); err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Error("Error writing the backfill summary")
+	}
+	close(finished)
+
 	// Nothing bad happened, yay
 	logrus.Info("Clicktail is all done, goodbye!")
 }
 
+// getSources starts tailing the files and receiving logs from the other
+// inputs set in options. The channel returned gets a Source for each file and
+// each of the other inputs, and is closed once there won't be any more. Inputs
+// that make events without a parser have a channel of events each.
+func getSources(ctx context.Context, options GlobalOptions, tc tail.Config) (chan tail.Source, []chan event.Event, error) {
+	var others []tail.Source
+	var events []chan event.Event
+	if len(options.Syslog.Listen) > 0 {
+		source, err := inputs.Syslog(ctx, options.Syslog)
+		if err != nil {
+			return nil, nil, err
+		}
+		others = append(others, source)
+	}
+	if options.HTTP.Listen != "" {
+		source, received, err := inputs.HTTP(ctx, options.HTTP)
+		if err != nil {
+			return nil, nil, err
+		}
+		others = append(others, source)
+		events = append(events, received)
+	}
+	if options.OTLP.Listen != "" {
+		received, err := inputs.OTLP(ctx, options.OTLP)
+		if err != nil {
+			return nil, nil, err
+		}
+		events = append(events, received)
+	}
+	if options.Forward.Listen != "" {
+		received, err := inputs.Forward(ctx, options.Forward)
+		if err != nil {
+			return nil, nil, err
+		}
+		events = append(events, received)
+	}
+	if len(options.Exec.Command) > 0 {
+		others = append(others, inputs.Exec(ctx, options.Exec))
+	}
+	files := make(chan tail.Source)
+	if len(tc.Paths) > 0 || len(tc.Dirs) > 0 {
+		var err error
+		if files, err = tail.WatchEntries(ctx, tc); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		close(files)
+	}
+	sources := make(chan tail.Source)
+	go func() {
+		defer close(sources)
+		for _, source := range others {
+			sources <- source
+		}
+		for source := range files {
+			sources <- source
+		}
+	}()
+	return sources, events, nil
+}
+
+// sampleEvents drops events at the tail sample rate, the way lines are
+// dropped for the inputs that have them parsed
+func sampleEvents(events chan event.Event, sampleRate *tail.SampleRate) chan event.Event {
+	sampled := make(chan event.Event, cap(events))
+	go func() {
+		defer close(sampled)
+		for ev := range events {
+			if rate := sampleRate.Get(); rate > 1 && rand.Intn(int(rate)) != 0 {
+				continue
+			}
+			sampled <- ev
+		}
+	}()
+	return sampled
+}
+
+// sourcePrefixRegex returns the prefix regex for the lines from source. For
+// inputs that put a header on each line, it starts with the header, and the
+// --log_prefix regex is left to match after it if it can.
+func sourcePrefixRegex(source tail.Source, prefixRegex *parsers.ExtRegexp) *parsers.ExtRegexp {
+	if source.Header == "" {
+		return prefixRegex
+	}
+	pattern := source.Header
+	if prefixRegex != nil {
+		pattern += "(?:" + strings.TrimPrefix(prefixRegex.String(), "^") + ")?"
+	}
+	return &parsers.ExtRegexp{Regexp: regexp.MustCompile(pattern)}
+}
+
+// processLines hands lines to parser. With sourceFields set, each goes along
+// with the fields saying where it was read from, for the parser to add to the
+// event it starts.
+func processLines(parser parsers.Parser, lines chan tail.Line, send chan<- event.Event,
+	prefixRegex *parsers.ExtRegexp, sourceFields bool) {
+	processor, ok := parser.(parsers.RecordProcessor)
+	if !sourceFields || !ok {
+		parser.ProcessLines(tail.Texts(lines), send, prefixRegex)
+		return
+	}
+	records := make(chan parsers.Record)
+	go func() {
+		defer close(records)
+		for line := range lines {
+			records <- parsers.Record{Text: line.Text, Fields: lineSourceFields(line)}
+		}
+	}()
+	processor.ProcessRecords(records, send, prefixRegex)
+}
+
+// lineSourceFields returns the _source_file, _source_inode, _source_offset
+// and _line_number fields for line. Those that aren't known, like all of them
+// for inputs other than files, are left out.
+func lineSourceFields(line tail.Line) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if line.Path != "" {
+		fields["_source_file"] = line.Path
+		fields["_source_offset"] = line.Offset
+	}
+	if line.Inode != 0 {
+		fields["_source_inode"] = line.Inode
+	}
+	if line.Number != 0 {
+		fields["_line_number"] = line.Number
+	}
+	return fields
+}
+
+// closeLibclick flushes and closes libclick and waits for the last responses
+// to be handled. Events that come back to be retried in the meantime are
+// collected and returned, along with the longest back off asked for.
+func closeLibclick(responsesWG *sync.WaitGroup, toBeResent chan event.Event,
+	delaySending chan int) ([]event.Event, int) {
+	done := make(chan struct{})
+	go func() {
+		libclick.Close()
+		responsesWG.Wait()
+		close(done)
+	}()
+	var retries []event.Event
+	delay := 0
+	for {
+		select {
+		case ev := <-toBeResent:
+			retries = append(retries, ev)
+		case d := <-delaySending:
+			if d > delay {
+				delay = d
+			}
+		case <-done:
+			// pick up anything queued before the last response was handled
+			for {
+				select {
+				case ev := <-toBeResent:
+					retries = append(retries, ev)
+				case d := <-delaySending:
+					if d > delay {
+						delay = d
+					}
+				default:
+					return retries, delay
+				}
+			}
+		}
+	}
+}
+
+// logLostWork reports what's left behind when shutdown is cut short
+func logLostWork(stage string, budget *throttle.Budget, toBeResent chan event.Event) {
+	events, bytes := budget.InFlight()
+	logrus.WithFields(logrus.Fields{
+		"stage":            stage,
+		"events_in_flight": events,
+		"bytes_in_flight":  bytes,
+		"retries_pending":  len(toBeResent),
+	}).Error("Shutdown did not finish in time; unsent events were lost")
+}
+
+// getLineTimestamp returns a func that finds the time of the event a line
+// starts, using a parser of its own
+func getLineTimestamp(options GlobalOptions, prefixRegex *parsers.ExtRegexp) (func(line string) (time.Time, bool), error) {
+	parser, opts := getParserAndOptions(options)
+	finder, ok := parser.(parsers.TimestampFinder)
+	if !ok {
+		return nil, fmt.Errorf("the %s parser can't find the time of each event", options.Reqs.ParserName)
+	}
+	if err := parser.Init(opts); err != nil {
+		return nil, fmt.Errorf("error initializing %s parser module: %v", options.Reqs.ParserName, err)
+	}
+	return func(line string) (time.Time, bool) {
+		if prefixRegex != nil {
+			line = strings.TrimPrefix(line, prefixRegex.FindString(line))
+		}
+		return finder.LineTimestamp(line)
+	}, nil
+}
+
 // getParserOptions takes a parser name and the global options struct
 // it returns the options group for the specified parser
 func getParserAndOptions(options GlobalOptions) (parsers.Parser, interface{}) {
@@ -242,96 +607,229 @@ func getParserAndOptions(options GlobalOptions) (parsers.Parser, interface{}) {
 // modifyEventContents takes a channel from which it will read events. It
 // returns a channel on which it will send the munged events. It is responsible
 // for hashing or dropping or adding fields to the events and doing the dynamic
-// sampling, if enabled
-func modifyEventContents(toBeSent chan event.Event, options GlobalOptions) chan event.Event {
+// sampling, if enabled. The transforms in live may be swapped out at any time;
+// each event is handled entirely by whichever set was current when it arrived.
+func modifyEventContents(toBeSent chan event.Event, live *liveTransforms, numSenders uint) chan event.Event {
+	// ok, we need to munge events. Sing up enough goroutines to handle this
+	newSent := make(chan event.Event, numSenders)
+	go func() {
+		wg := sync.WaitGroup{}
+		for i := uint(0); i < numSenders; i++ {
+			wg.Add(1)
+			go func() {
+				for ev := range toBeSent {
+					if live.load().transform(&ev) {
+						newSent <- ev
+					}
+				}
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+		close(newSent)
+	}()
+	return newSent
+}
+
+// liveTransforms holds the transformer used by one pipeline. Reloading the
+// config swaps in a new one while events keep flowing.
+type liveTransforms struct {
+	current atomic.Value
+}
+
+// newLiveTransforms builds a transformer from options to start out with
+func newLiveTransforms(options GlobalOptions) (*liveTransforms, error) {
+	t, err := newTransformer(options, nil)
+	if err != nil {
+		return nil, err
+	}
+	live := &liveTransforms{}
+	live.store(t)
+	return live, nil
+}
+
+func (l *liveTransforms) load() *transformer {
+	return l.current.Load().(*transformer)
+}
+
+func (l *liveTransforms) store(t *transformer) {
+	l.current.Store(t)
+}
+
+// transformer holds the options used to munge events, along with everything
+// that can be worked out from them ahead of time
+type transformer struct {
+	options   GlobalOptions
+	addFields map[string]string
+	shaper    *requestShaper
+	sampler   dynsampler.Sampler
+	hostname  string
+}
+
+// newTransformer prepares the transforms described by options. If previous is
+// set and the dynamic sampling settings haven't changed, its sampler is kept so
+// it doesn't lose what it has learned about the traffic.
+func newTransformer(options GlobalOptions, previous *transformer) (*transformer, error) {
+	t := &transformer{
+		options:   options,
+		addFields: map[string]string{},
+		shaper:    &requestShaper{},
+	}
+	if options.SourceFields {
+		t.hostname, _ = os.Hostname()
+	}
 	// parse the addField bit once instead of for every event
-	parsedAddFields := map[string]string{}
 	for _, addField := range options.AddFields {
 		splitField := strings.SplitN(addField, "=", 2)
 		if len(splitField) != 2 {
-			logrus.WithFields(logrus.Fields{
-				"add_field": addField,
-			}).Fatal("unable to separate provided field into a key=val pair")
+			return nil, fmt.Errorf("unable to separate provided field %q into a key=val pair", addField)
 		}
-		parsedAddFields[splitField[0]] = splitField[1]
+		t.addFields[splitField[0]] = splitField[1]
 	}
 	// do all the advance work for request shaping
-	shaper := &requestShaper{}
 	if len(options.RequestShape) != 0 {
-		shaper.pr = &urlshaper.Parser{}
+		t.shaper.pr = &urlshaper.Parser{}
 		if options.ShapePrefix != "" {
-			shaper.prefix = options.ShapePrefix + "_"
+			t.shaper.prefix = options.ShapePrefix + "_"
 		}
 		for _, rpat := range options.RequestPattern {
 			pat := urlshaper.Pattern{Pat: rpat}
 			if err := pat.Compile(); err != nil {
-				logrus.WithField("request_pattern", rpat).WithError(err).Fatal(
-					"Failed to compile provided pattern.")
+				return nil, fmt.Errorf("failed to compile request pattern %q: %s", rpat, err)
 			}
-			shaper.pr.Patterns = append(shaper.pr.Patterns, &pat)
+			t.shaper.pr.Patterns = append(t.shaper.pr.Patterns, &pat)
 		}
 	}
 	// initialize the dynamic sampler
-	var sampler dynsampler.Sampler
 	if len(options.DynSample) != 0 {
-		sampler = &dynsampler.AvgSampleWithMin{
-			GoalSampleRate:    options.GoalSampleRate,
-			ClearFrequencySec: options.DynWindowSec,
-			MinEventsPerSec:   options.MinSampleRate,
+		if previous != nil && previous.sampler != nil && sameDynsampleSettings(previous.options, options) {
+			t.sampler = previous.sampler
+		} else {
+			t.sampler = &dynsampler.AvgSampleWithMin{
+				GoalSampleRate:    options.GoalSampleRate,
+				ClearFrequencySec: options.DynWindowSec,
+				MinEventsPerSec:   options.MinSampleRate,
+			}
+			if err := t.sampler.Start(); err != nil {
+				return nil, fmt.Errorf("dynsampler failed to start: %s", err)
+			}
 		}
-		if err := sampler.Start(); err != nil {
-			logrus.WithField("error", err).Fatal("dynsampler failed to start")
+	}
+	return t, nil
+}
+
+// addSourceFields adds the fields saying where ev came from that aren't
+// about the line it was parsed from
+func addSourceFields(ev *event.Event, hostname string) {
+	ev.Data["_hostname"] = hostname
+	ev.Data["_ingest_time"] = time.Now().UTC()
+}
+
+// sameDynsampleSettings returns true if a and b would set up identical
+// dynamic samplers
+func sameDynsampleSettings(a, b GlobalOptions) bool {
+	return strings.Join(a.DynSample, "\x00") == strings.Join(b.DynSample, "\x00") &&
+		a.GoalSampleRate == b.GoalSampleRate &&
+		a.DynWindowSec == b.DynWindowSec &&
+		a.MinSampleRate == b.MinSampleRate
+}
+
+// transform munges a single event in place. It returns false if the event
+// should be thrown away instead of sent.
+func (t *transformer) transform(ev *event.Event) bool {
+	options := t.options
+	// container logs use the time the runtime gave the line
+	if options.Container.Format != "" {
+		if value, ok := ev.Data[tail.ContainerTimeField].(string); ok {
+			if timestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				ev.Timestamp = timestamp
+			}
+			delete(ev.Data, tail.ContainerTimeField)
 		}
 	}
-	// ok, we need to munge events. Sing up enough goroutines to handle this
-	newSent := make(chan event.Event, options.NumSenders)
-	go func() {
-		wg := sync.WaitGroup{}
-		for i := uint(0); i < options.NumSenders; i++ {
-			wg.Add(1)
-			go func() {
-				for ev := range toBeSent {
-					// do dropping
-					for _, field := range options.DropFields {
-						delete(ev.Data, field)
-					}
-					// do scrubbing
-					for _, field := range options.ScrubFields {
-						if val, ok := ev.Data[field]; ok {
-							// generate a sha256 hash and use the base16 for the content
-							newVal := sha256.Sum256([]byte(fmt.Sprintf("%v", val)))
-							ev.Data[field] = fmt.Sprintf("%x", newVal)
-						}
-					}
-					// do adding
-					for k, v := range parsedAddFields {
-						ev.Data[k] = v
-					}
-					// do request shaping
-					for _, field := range options.RequestShape {
-						shaper.requestShape(field, &ev, options)
-					}
-					// do dynsampling last so it can use request shaped fields
-					if sampler == nil {
-						ev.SampleRate = int(options.SampleRate)
-					} else {
-						key := makeDynsampleKey(&ev, options)
-						sr := sampler.GetSampleRate(key)
-						if rand.Intn(sr) != 0 {
-							ev.SampleRate = -1
-						} else {
-							ev.SampleRate = sr
-						}
-					}
-					newSent <- ev
-				}
-				wg.Done()
-			}()
+	if options.SourceFields {
+		addSourceFields(ev, t.hostname)
+	}
+	// do dropping
+	for _, field := range options.DropFields {
+		delete(ev.Data, field)
+	}
+	// do scrubbing
+	for _, field := range options.ScrubFields {
+		if val, ok := ev.Data[field]; ok {
+			// generate a sha256 hash and use the base16 for the content
+			newVal := sha256.Sum256([]byte(fmt.Sprintf("%v", val)))
+			ev.Data[field] = fmt.Sprintf("%x", newVal)
 		}
-		wg.Wait()
-		close(newSent)
-	}()
-	return newSent
+	}
+	// do adding
+	for k, v := range t.addFields {
+		ev.Data[k] = v
+	}
+	// do request shaping
+	for _, field := range options.RequestShape {
+		t.shaper.requestShape(field, ev, options)
+	}
+	// keep oversized fields and events from eating up memory
+	if !limitEventSize(ev, options) {
+		return false
+	}
+	// do dynsampling last so it can use request shaped fields
+	if t.sampler == nil {
+		ev.SampleRate = int(options.SampleRate)
+	} else {
+		key := makeDynsampleKey(ev, options)
+		sr := t.sampler.GetSampleRate(key)
+		if rand.Intn(sr) != 0 {
+			ev.SampleRate = -1
+		} else {
+			ev.SampleRate = sr
+		}
+	}
+	return true
+}
+
+// limitEventSize applies --max_field_bytes and --max_event_bytes to an event,
+// truncating or dropping long string fields. It returns false if the event is
+// still too big to send.
+func limitEventSize(ev *event.Event, options GlobalOptions) bool {
+	if options.MaxFieldBytes > 0 {
+		maxBytes := int(options.MaxFieldBytes)
+		for k, v := range ev.Data {
+			val, ok := v.(string)
+			if !ok || len(val) <= maxBytes {
+				continue
+			}
+			if options.OversizeField == "drop" {
+				delete(ev.Data, k)
+				metrics.Increment("oversize_fields_dropped")
+			} else {
+				ev.Data[k] = truncateString(val, maxBytes)
+				metrics.Increment("oversize_fields_truncated")
+			}
+		}
+	}
+	if options.MaxEventBytes > 0 && ev.Size() > int(options.MaxEventBytes) {
+		metrics.Increment("oversize_events_dropped")
+		logrus.WithFields(logrus.Fields{
+			"size":      ev.Size(),
+			"timestamp": ev.Timestamp,
+		}).Debug("dropped event bigger than max_event_bytes")
+		return false
+	}
+	return true
+}
+
+// truncateString cuts s down to at most n bytes without splitting a UTF-8
+// character in half
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
 }
 
 // makeDynsampleKey pulls in all the values necessary from the event to create a
@@ -427,51 +925,116 @@ func whitelistKey(whiteKeys []string, key string) bool {
 }
 
 // sendToLibhoney reads from the toBeSent channel and shoves the events into
-// libclick events, sending them on their way.
+// libclick events, sending them on their way. It blocks until there is work to
+// do; pending back off delays are honored first, then events waiting to be
+// retransmitted, then new events. Each new event takes its share of the budget
+// and every event waits for room in all the limiters before it goes out, which
+// holds up everything upstream of it. Cancelling ctx cuts short any back off or
+// throttling, which is only done once the shutdown has run out of time, but
+// the loop keeps going until toBeSent is closed so nothing already parsed is
+// left behind.
 func sendToLibhoney(ctx context.Context, toBeSent chan event.Event, toBeResent chan event.Event,
-	delaySending chan int, doneSending chan bool) {
+	delaySending chan int, doneSending chan bool, limiters []*throttle.Limiter, budget *throttle.Budget) {
 	for {
 		// check and see if we need to back off the API because of rate limiting
 		select {
 		case delay := <-delaySending:
-			time.Sleep(time.Duration(delay) * time.Millisecond)
+			backOff(ctx, delay)
+			continue
 		default:
 		}
 		// if we have events to retransmit, send those first
 		select {
 		case ev := <-toBeResent:
-			// retransmitted events have already been sampled; always use
-			// SendPresampled() for these
-			sendEvent(ev)
+			// retransmitted events have already been sampled and still hold
+			// their share of the budget
+			resendEvent(ctx, ev, limiters, budget)
 			continue
 		default:
 		}
-		// otherwise pick something up off the regular queue and send it
+		// otherwise wait for whichever shows up next
 		select {
+		case delay := <-delaySending:
+			backOff(ctx, delay)
+		case ev := <-toBeResent:
+			resendEvent(ctx, ev, limiters, budget)
 		case ev, ok := <-toBeSent:
 			if !ok {
-				// channel is closed
-				// NOTE: any unrtransmitted retransmittable events will be dropped
+				// channel is closed. any events still waiting to be
+				// retransmitted are picked up by closeLibclick
 				doneSending <- true
 				return
 			}
-			sendEvent(ev)
-			continue
-		default:
+			if ev.SampleRate == -1 {
+				// about to be dropped, so it doesn't need any budget
+				sendEvent(ev)
+				continue
+			}
+			acquireBudget(ctx, ev.Size(), toBeResent, delaySending, limiters, budget)
+			resendEvent(ctx, ev, limiters, budget)
+		}
+	}
+}
+
+// acquireBudget waits for room in the budget for a new event. Meanwhile it
+// keeps backing off and sending retries, as it's their responses that free up
+// the budget, and handleResponses can't take any more of them until they're
+// picked up.
+func acquireBudget(ctx context.Context, size int, toBeResent chan event.Event, delaySending chan int,
+	limiters []*throttle.Limiter, budget *throttle.Budget) {
+	for {
+		freed := budget.TryAcquire(size)
+		if freed == nil {
+			return
+		}
+		select {
+		case <-freed:
+		case delay := <-delaySending:
+			backOff(ctx, delay)
+		case ev := <-toBeResent:
+			resendEvent(ctx, ev, limiters, budget)
+		}
+	}
+}
+
+// resendEvent sends an event that already holds its share of the budget,
+// giving the share back if libclick doesn't take the event.
+func resendEvent(ctx context.Context, ev event.Event, limiters []*throttle.Limiter, budget *throttle.Budget) {
+	waitForLimiters(ctx, ev, limiters)
+	if !sendEvent(ev) {
+		budget.Release(ev.Size())
+	}
+}
+
+// waitForLimiters blocks until every limiter has room for the event
+func waitForLimiters(ctx context.Context, ev event.Event, limiters []*throttle.Limiter) {
+	size := ev.Size()
+	for _, limiter := range limiters {
+		if err := limiter.Wait(ctx, size); err != nil {
+			return
 		}
-		// no events at all? chill for a sec until we get the next one
-		time.Sleep(100 * time.Millisecond)
 	}
 }
 
-// sendEvent does the actual handoff to libclick
-func sendEvent(ev event.Event) {
+// backOff waits for delay milliseconds, or until ctx is cancelled
+func backOff(ctx context.Context, delay int) {
+	timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// sendEvent does the actual handoff to libclick. It returns true if libclick
+// took the event, in which case a response will come back for it.
+func sendEvent(ev event.Event) bool {
 	if ev.SampleRate == -1 {
 		// drop the event!
 		logrus.WithFields(logrus.Fields{
 			"event": ev,
 		}).Debug("droppped event due to sampling")
-		return
+		return false
 	}
 	libhEv := libclick.NewEvent()
 	libhEv.Metadata = ev
@@ -488,16 +1051,16 @@ func sendEvent(ev event.Event) {
 			"event": ev,
 			"error": err,
 		}).Error("Unexpected error event to libclick send")
+		return false
 	}
+	return true
 }
 
 // handleResponses reads from the response queue, logging a summary and debug
 // re-enqueues any events that failed to send in a retryable way
 func handleResponses(responses chan libclick.Response, stats *responseStats,
-	toBeResent chan event.Event, delaySending chan int,
+	toBeResent chan event.Event, delaySending chan int, budget *throttle.Budget,
 	options GlobalOptions) {
-	go logStats(stats, options.StatusInterval)
-
 	for rsp := range responses {
 		stats.update(rsp)
 		logfields := logrus.Fields{
@@ -514,6 +1077,12 @@ func handleResponses(responses chan libclick.Response, stats *responseStats,
 			toBeResent <- rsp.Metadata.(event.Event)       // then retry sending the event
 		} else {
 			logfields["retry_send"] = false
+			if rsp.Err != nil || rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+				metrics.Increment("send_failures")
+			}
+			// the event is done with, give back its share of the budget
+			ev := rsp.Metadata.(event.Event)
+			budget.Release(ev.Size())
 		}
 		logrus.WithFields(logfields).Debug("event send record received")
 	}
@@ -14,16 +14,23 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/Altinity/libclick-go"
 	"github.com/Sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/sys/unix"
 
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/metrics"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/htjson"
 	"github.com/honeycombio/honeytail/tail"
+	"github.com/honeycombio/honeytail/throttle"
 )
 
 var tailOptions = tail.TailOptions{
@@ -41,7 +48,6 @@ var defaultOptions = GlobalOptions{
 	Reqs: RequiredOptions{
 		// using the json parser for everything because we're not testing parsers here.
 		ParserName: "json",
-		WriteKey:   "abcabc123123",
 		// each test will specify its own logfile
 		// LogFiles:   []string{tmpdir + ""},
 		Dataset: "pika",
@@ -129,7 +135,6 @@ func TestMultiLineMultiFile(t *testing.T) {
 		NumSenders: 1,
 		Reqs: RequiredOptions{
 			ParserName: "mysql",
-			WriteKey:   "----",
 			Dataset:    "---",
 		},
 		Tail: tailOptions,
@@ -361,7 +366,9 @@ func TestRequestShapeRaw(t *testing.T) {
 	// test whitelisting keys foo, baz, and bend but not bar
 	opts.RequestQueryKeys = []string{"foo", "baz", "bend"}
 	tbs := make(chan event.Event)
-	output := modifyEventContents(tbs, opts)
+	live, err := newLiveTransforms(opts)
+	assert.Nil(t, err)
+	output := modifyEventContents(tbs, live, opts.NumSenders)
 	for input, expectedResult := range urlsWhitelistQuery {
 		ev := event.Event{
 			Data: map[string]interface{}{
@@ -382,7 +389,9 @@ func TestRequestShapeRaw(t *testing.T) {
 	// included
 	opts.RequestParseQuery = "all"
 	tbs = make(chan event.Event)
-	output = modifyEventContents(tbs, opts)
+	live, err = newLiveTransforms(opts)
+	assert.Nil(t, err)
+	output = modifyEventContents(tbs, live, opts.NumSenders)
 	for input, expectedResult := range urlsAllQuery {
 		ev := event.Event{
 			Data: map[string]interface{}{
@@ -400,6 +409,242 @@ func TestRequestShapeRaw(t *testing.T) {
 	close(tbs)
 }
 
+func TestReload(t *testing.T) {
+	opts := defaultOptions
+	opts.AddFields = []string{"env=staging"}
+	opts.TailSample = true
+	r := &reloader{
+		options:  opts,
+		tailRate: tail.NewSampleRate(opts.SampleRate),
+	}
+	live, err := r.add(&htjson.Parser{})
+	assert.Nil(t, err)
+
+	newOpts := opts
+	newOpts.AddFields = []string{"env=prod"}
+	newOpts.DropFields = []string{"secret"}
+	newOpts.SampleRate = 5
+	assert.Nil(t, r.reload(newOpts))
+	ev := event.Event{Data: map[string]interface{}{"secret": "shh"}}
+	assert.True(t, live.load().transform(&ev))
+	assert.Equal(t, map[string]interface{}{"env": "prod"}, ev.Data)
+	assert.Equal(t, 5, ev.SampleRate)
+	assert.Equal(t, uint(5), r.tailRate.Get())
+
+	// a config that doesn't work leaves the old one in place
+	badOpts := newOpts
+	badOpts.AddFields = []string{"no_equals_sign"}
+	assert.NotNil(t, r.reload(badOpts))
+	ev = event.Event{Data: map[string]interface{}{}}
+	live.load().transform(&ev)
+	assert.Equal(t, "prod", ev.Data["env"])
+
+	// switching between tail and dynamic sampling needs a restart
+	dynOpts := newOpts
+	dynOpts.TailSample = false
+	assert.NotNil(t, r.reload(dynOpts))
+
+	// pipelines started after a reload get the new config
+	later, err := r.add(&htjson.Parser{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"secret"}, later.load().options.DropFields)
+	r.remove(live)
+	r.remove(later)
+	assert.Equal(t, 0, len(r.transforms))
+}
+
+func TestLimitEventSize(t *testing.T) {
+	opts := defaultOptions
+	opts.MaxFieldBytes = 5
+	opts.OversizeField = "truncate"
+	ev := event.Event{
+		Data: map[string]interface{}{
+			"short": "abc",
+			"long":  "abcdefghij",
+			"utf8":  "abcdé",
+			"num":   1234567890,
+		},
+	}
+	before := metrics.Get("oversize_fields_truncated")
+	assert.True(t, limitEventSize(&ev, opts))
+	assert.Equal(t, "abc", ev.Data["short"])
+	assert.Equal(t, "abcde", ev.Data["long"])
+	// é is two bytes, so cutting at 5 would split it
+	assert.Equal(t, "abcd", ev.Data["utf8"])
+	assert.Equal(t, 1234567890, ev.Data["num"])
+	assert.Equal(t, before+2, metrics.Get("oversize_fields_truncated"))
+
+	opts.OversizeField = "drop"
+	ev.Data["long"] = "abcdefghij"
+	assert.True(t, limitEventSize(&ev, opts))
+	_, ok := ev.Data["long"]
+	assert.False(t, ok)
+
+	opts.MaxFieldBytes = 0
+	opts.MaxEventBytes = 10
+	ev.Data["long"] = "abcdefghij"
+	before = metrics.Get("oversize_events_dropped")
+	assert.False(t, limitEventSize(&ev, opts))
+	assert.Equal(t, before+1, metrics.Get("oversize_events_dropped"))
+}
+
+func TestProgressSummary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	progress := newProgressReporter(ctx)
+
+	// a file read in two chunks by a parser that makes an event out of each
+	// line, one of which doesn't parse
+	chunks := [][]string{{"a", "bb"}, {"ccc", "x"}}
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		source := tail.Source{Path: "/chunked.log", Lines: make(chan tail.Line)}
+		if i == 0 {
+			source.Size = 11
+		}
+		p := progress.add(source, true)
+		lines := p.countParsed(p.countLines(source.Lines))
+		events := make(chan event.Event)
+		sent := p.countEvents(events)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range sent {
+			}
+		}()
+		go func(chunk []string, read chan tail.Line) {
+			for _, line := range chunk {
+				read <- tail.Line{Text: line}
+			}
+			close(read)
+		}(chunk, source.Lines)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range lines {
+				if line.Text != "x" {
+					events <- event.Event{}
+				}
+			}
+			close(events)
+		}()
+	}
+	wg.Wait()
+
+	summary := progress.summary(map[int]int{200: 3}, 0)
+	assert.True(t, summary.Complete)
+	assert.False(t, summary.Interrupted)
+	assert.Equal(t, []fileSummary{{
+		Path:          "/chunked.log",
+		Complete:      true,
+		BytesRead:     11,
+		BytesTotal:    11,
+		Lines:         4,
+		Events:        3,
+		ParseFailures: 1,
+		Seconds:       summary.Files[0].Seconds,
+	}}, summary.Files)
+
+	// a file that isn't read to the end, and events that weren't sent, make
+	// the whole thing incomplete
+	source := tail.Source{Path: "/stopped.log", Lines: make(chan tail.Line), Size: 100}
+	p := progress.add(source, false)
+	lines := p.countLines(source.Lines)
+	source.Lines <- tail.Line{Text: "line"}
+	<-lines
+	cancel()
+	close(source.Lines)
+	for range lines {
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, progress.writeSummary(buf, map[int]int{200: 3, 500: 1}, 1))
+	var written map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &written))
+	assert.Equal(t, false, written["complete"])
+	assert.Equal(t, true, written["interrupted"])
+	assert.Equal(t, float64(1), written["send_failures"])
+	assert.Equal(t, map[string]interface{}{"200": float64(3), "500": float64(1)}, written["responses_by_status"])
+	files := written["files"].([]interface{})
+	assert.Len(t, files, 2)
+	assert.Equal(t, false, files[1].(map[string]interface{})["complete"])
+	assert.Equal(t, float64(5), files[1].(map[string]interface{})["bytes_read"])
+}
+
+func TestSourcePrefixRegex(t *testing.T) {
+	prefixRegex := &parsers.ExtRegexp{Regexp: regexp.MustCompile(`^(?P<level>[A-Z]+) `)}
+	file := tail.Source{Path: "/var/log/app.log"}
+	assert.Equal(t, prefixRegex, sourcePrefixRegex(file, prefixRegex))
+
+	// the header comes first, and the --log_prefix regex matches after it
+	// if it can
+	received := tail.Source{Path: "syslog", Header: "^<(?P<host>[^>]*)>"}
+	regex := sourcePrefixRegex(received, prefixRegex)
+	prefix, fields := regex.FindStringSubmatchMap("<web1>INFO hello")
+	assert.Equal(t, "<web1>INFO ", prefix)
+	assert.Equal(t, map[string]string{"host": "web1", "level": "INFO"}, fields)
+	prefix, fields = regex.FindStringSubmatchMap("<web1>hello")
+	assert.Equal(t, "<web1>", prefix)
+	assert.Equal(t, "web1", fields["host"])
+	assert.Nil(t, sourcePrefixRegex(file, nil))
+	assert.Equal(t, received.Header, sourcePrefixRegex(received, nil).String())
+}
+
+func TestSourceFields(t *testing.T) {
+	opts := defaultOptions
+	opts.SourceFields = true
+	tr, err := newTransformer(opts, nil)
+	assert.Nil(t, err)
+	hostname, _ := os.Hostname()
+
+	// every event gets the host and time
+	ev := event.Event{Data: map[string]interface{}{}}
+	before := time.Now()
+	assert.True(t, tr.transform(&ev))
+	assert.Len(t, ev.Data, 2)
+	assert.Equal(t, hostname, ev.Data["_hostname"])
+	assert.False(t, ev.Data["_ingest_time"].(time.Time).Before(before.UTC().Truncate(time.Second)))
+
+	// the parser adds the position of a file's line to its event, and
+	// leaves --log_prefix to do what it always has
+	opts.Reqs.ParserName = "json"
+	parser, parserOpts := getParserAndOptions(opts)
+	assert.Nil(t, parser.Init(parserOpts))
+	lines := make(chan tail.Line, 2)
+	lines <- tail.Line{Text: `[web1] {"a": 1}`, Path: "/var/log/app.log", Inode: 42, Offset: 1024}
+	lines <- tail.Line{Text: `[web1] {"a": 2}`}
+	close(lines)
+	send := make(chan event.Event, 2)
+	prefix := &parsers.ExtRegexp{Regexp: regexp.MustCompile(`^\[(?P<host>\w+)\] `)}
+	processLines(parser, lines, send, prefix, true)
+	close(send)
+	var events []event.Event
+	for ev := range send {
+		events = append(events, ev)
+	}
+	sort.Slice(events, func(i, j int) bool { return len(events[i].Data) > len(events[j].Data) })
+	assert.Equal(t, map[string]interface{}{
+		"a": float64(1), "host": "web1",
+		"_source_file": "/var/log/app.log", "_source_inode": uint64(42), "_source_offset": int64(1024),
+	}, events[0].Data)
+	// lines from other inputs don't have a position
+	assert.Equal(t, map[string]interface{}{"a": float64(2), "host": "web1"}, events[1].Data)
+}
+
+func TestContainerTime(t *testing.T) {
+	opts := defaultOptions
+	opts.Container.Format = "cri"
+	tr, err := newTransformer(opts, nil)
+	assert.Nil(t, err)
+	ev := event.Event{
+		Timestamp: time.Now(),
+		Data:      map[string]interface{}{tail.ContainerTimeField: "2017-10-16T09:00:00.123456789Z", "msg": "hi"},
+	}
+	assert.True(t, tr.transform(&ev))
+	assert.Equal(t, time.Date(2017, 10, 16, 9, 0, 0, 123456789, time.UTC), ev.Timestamp)
+	assert.Equal(t, map[string]interface{}{"msg": "hi"}, ev.Data)
+}
+
 func TestSampleRate(t *testing.T) {
 	opts := defaultOptions
 	ts := &testSetup{}
@@ -524,6 +769,155 @@ func TestLogRotation(t *testing.T) {
 	}
 }
 
+// BenchmarkSendToLibhoney measures how quickly the sender hands events to
+// libclick when they trickle in one at a time, which is where polling for work
+// used to add its latency.
+func BenchmarkSendToLibhoney(b *testing.B) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(b, &opts)
+	defer ts.close()
+	if err := libclick.Init(libclick.Config{
+		Dataset:              opts.Reqs.Dataset,
+		APIHost:              opts.APIHost,
+		MaxConcurrentBatches: opts.NumSenders,
+		SendFrequency:        time.Duration(opts.BatchFrequencyMs) * time.Millisecond,
+		MaxBatchSize:         opts.BatchSize,
+		BlockOnSend:          true,
+		BlockOnResponse:      true,
+	}); err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		for range libclick.Responses() {
+		}
+	}()
+
+	toBeSent := make(chan event.Event)
+	toBeResent := make(chan event.Event)
+	delaySending := make(chan int)
+	doneSending := make(chan bool)
+	ev := event.Event{
+		Timestamp:  time.Now(),
+		SampleRate: 1,
+		Data:       map[string]interface{}{"format": "json"},
+	}
+
+	b.ResetTimer()
+	go sendToLibhoney(context.Background(), toBeSent, toBeResent, delaySending, doneSending, nil, throttle.NewBudget(0))
+	for i := 0; i < b.N; i++ {
+		toBeSent <- ev
+	}
+	close(toBeSent)
+	<-doneSending
+	b.StopTimer()
+	libclick.Close()
+}
+
+// TestRetriesWithBudgetSpent makes sure rejected events keep getting retried
+// while the sender is waiting on the budget, rather than the two blocking
+// each other once the retry queues fill up.
+func TestRetriesWithBudgetSpent(t *testing.T) {
+	opts := defaultOptions
+	opts.BackOff = true
+	// so each back off is only a millisecond
+	opts.NumSenders = 1000
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	if err := libclick.Init(libclick.Config{
+		APIHost:         opts.APIHost,
+		BlockOnSend:     true,
+		BlockOnResponse: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sent := libclick.Responses()
+	drained := make(chan struct{})
+	go func() {
+		for range sent {
+		}
+		close(drained)
+	}()
+
+	// a budget that only lets one event at a time through, and retry queues
+	// the size run makes them for one sender
+	budget := throttle.NewBudget(1)
+	toBeSent := make(chan event.Event)
+	toBeResent := make(chan event.Event, 2)
+	delaySending := make(chan int, 2)
+	doneSending := make(chan bool)
+	responses := make(chan libclick.Response)
+	go sendToLibhoney(context.Background(), toBeSent, toBeResent, delaySending, doneSending, nil, budget)
+	go handleResponses(responses, newResponseStats(), toBeResent, delaySending, budget, opts)
+
+	first := event.Event{SampleRate: 1, Data: map[string]interface{}{"n": 1}}
+	second := event.Event{SampleRate: 1, Data: map[string]interface{}{"n": 2}}
+	toBeSent <- first
+	// the second event waits for the first one's share of the budget
+	toBeSent <- second
+	respond := func(code int) {
+		select {
+		case responses <- libclick.Response{StatusCode: code, Metadata: first}:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("response handler stuck with the budget spent and %d retries", len(toBeResent))
+		}
+	}
+	// more rejections than the retry queues hold
+	for i := 0; i < 5; i++ {
+		respond(429)
+	}
+	respond(200)
+	close(toBeSent)
+	select {
+	case <-doneSending:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender never got the budget for the second event")
+	}
+	events, bytes := budget.InFlight()
+	assert.Equal(t, int64(1), events)
+	assert.Equal(t, int64(second.Size()), bytes)
+	close(responses)
+	libclick.Close()
+	<-drained
+}
+
+// TestCloseLibclickCollectsRetries makes sure events that come back to be
+// retried while libclick is shutting down are handed back instead of dropped.
+func TestCloseLibclickCollectsRetries(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	if err := libclick.Init(libclick.Config{
+		APIHost:         opts.APIHost,
+		BlockOnSend:     true,
+		BlockOnResponse: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// unbuffered, so the response handler can only finish if they're drained
+	toBeResent := make(chan event.Event)
+	delaySending := make(chan int)
+	responsesWG := sync.WaitGroup{}
+	responsesWG.Add(1)
+	responses := libclick.Responses()
+	go func() {
+		for range responses {
+		}
+		for i := 0; i < 3; i++ {
+			delaySending <- 100 * (i + 1)
+			toBeResent <- event.Event{Data: map[string]interface{}{"retry": i}}
+		}
+		responsesWG.Done()
+	}()
+
+	retries, delay := closeLibclick(&responsesWG, toBeResent, delaySending)
+	assert.Equal(t, 3, len(retries))
+	assert.Equal(t, 300, delay)
+}
+
 // boilerplate to spin up a httptest server, create tmpdir, etc.
 // to create an environment in which to run these tests
 type testSetup struct {
@@ -532,7 +926,7 @@ type testSetup struct {
 	tmpdir string
 }
 
-func (t *testSetup) start(tst *testing.T, opts *GlobalOptions) {
+func (t *testSetup) start(tst testing.TB, opts *GlobalOptions) {
 	logrus.SetOutput(ioutil.Discard)
 	t.rsp = &responder{}
 	t.server = httptest.NewServer(http.HandlerFunc(t.rsp.serveResponse))
@@ -595,7 +989,7 @@ func (r *responder) serveResponse(w http.ResponseWriter, req *http.Request) {
 	}
 	r.reqBody = string(body)
 	w.WriteHeader(r.responseCode)
-	fmt.Fprintf(w, r.responseBody)
+	fmt.Fprint(w, r.responseBody)
 }
 func (r *responder) reset() {
 	r.reqCounter = 0
@@ -613,3 +1007,20 @@ func expectWithTimeout(condition func() bool, timeout time.Duration) bool {
 	return false
 
 }
+
+func TestGetLineTimestamp(t *testing.T) {
+	opts := defaultOptions
+	lineTimestamp, err := getLineTimestamp(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, ok := lineTimestamp(`{"time":"2017-10-16T12:00:00Z","a":1}`)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2017, 10, 16, 12, 0, 0, 0, time.UTC), found.UTC())
+
+	// the nginx parser can't find the time of a line on its own
+	opts.Reqs.ParserName = "nginx"
+	if _, err := getLineTimestamp(opts, nil); err == nil {
+		t.Error("expected an error for a parser that can't find timestamps")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
@@ -14,6 +16,8 @@ import (
 	flag "github.com/jessevdk/go-flags"
 
 	"github.com/honeycombio/honeytail/httime"
+	"github.com/honeycombio/honeytail/inputs"
+	"github.com/honeycombio/honeytail/parsers"
 	"github.com/honeycombio/honeytail/parsers/arangodb"
 	"github.com/honeycombio/honeytail/parsers/htjson"
 	"github.com/honeycombio/honeytail/parsers/keyval"
@@ -70,16 +74,40 @@ type GlobalOptions struct {
 	RequestParseQuery string   `long:"request_parse_query" description:"How to parse the request query parameters. 'whitelist' means only extract listed query keys. 'all' means to extract all query parameters as individual columns" default:"whitelist"`
 	RequestQueryKeys  []string `long:"request_query_keys" description:"Request query parameter key names to extract, when request_parse_query is 'whitelist'. May be specified multiple times."`
 	BackOff           bool     `long:"backoff" description:"When rate limited by the API, back off and retry sending failed events. Otherwise failed events are dropped. When --backfill is set, it will override this option=true"`
+	SourceFields      bool     `long:"source_fields" description:"Add fields saying where each event came from: _source_file, _source_inode, _source_offset and _line_number for the first line of the event, _hostname for this host and _ingest_time for when it was read. The line number is left out if reading didn't start at the beginning of the file"`
 	PrefixRegex       string   `long:"log_prefix" description:"pass a regex to this flag to strip the matching prefix from the line before handing to the parser. Useful when log aggregation prepends a line header. Use named groups to extract fields into the event."`
 	DynSample         []string `long:"dynsampling" description:"enable dynamic sampling using the field listed in this option. May be specified multiple times; fields will be concatenated to form the dynsample key. WARNING increases CPU utilization dramatically over normal sampling"`
 	DynWindowSec      int      `long:"dynsample_window" description:"measurement window size for the dynsampler, in seconds" default:"30"`
 	GoalSampleRate    int      `hidden:"true" description:"used to hold the desired sample rate and set tailing sample rate to 1"`
 	MinSampleRate     int      `long:"dynsample_minimum" description:"if the rate of traffic falls below this, dynsampler won't sample" default:"1"`
 
+	RateLimit              uint `long:"rate_limit" description:"Maximum number of events per second to send to ClickHouse, across all files. Reading slows down rather than dropping events when the limit is reached. 0 means no limit"`
+	RateLimitBytes         uint `long:"rate_limit_bytes" description:"Maximum estimated number of bytes per second to send to ClickHouse, across all files. 0 means no limit"`
+	PipelineRateLimit      uint `long:"pipeline_rate_limit" description:"Maximum number of events per second to send from each file. 0 means no limit"`
+	PipelineRateLimitBytes uint `long:"pipeline_rate_limit_bytes" description:"Maximum estimated number of bytes per second to send from each file. 0 means no limit"`
+
+	MaxBufferBytes uint   `long:"max_buffer_bytes" description:"Maximum estimated number of bytes held by events that have been parsed but not yet accepted by ClickHouse. Reading pauses while it's reached. 0 means no limit"`
+	MaxFieldBytes  uint   `long:"max_field_bytes" description:"Maximum size of a single string field in an event. What happens to longer fields is set by --oversize_field. 0 means no limit"`
+	OversizeField  string `long:"oversize_field" description:"What to do with string fields longer than --max_field_bytes. Values: truncate, drop" default:"truncate"`
+	MaxEventBytes  uint   `long:"max_event_bytes" description:"Maximum estimated size of a single event, after --max_field_bytes is applied. Larger events are dropped. 0 means no limit"`
+
+	StopAt string `long:"stop_at" description:"Stop reading each file at the first event after this time, like 2017-10-16T17:00:00Z, going by the times the parser finds in the file. Needs --tail.stop or --backfill"`
+
+	ShutdownTimeout uint `long:"shutdown_timeout" description:"How long, in seconds, to keep flushing and sending what's already been read after being told to stop. Whatever is still unsent after that is dropped. 0 waits until everything is sent" default:"10"`
+
 	Reqs  RequiredOptions `group:"Required Options"`
 	Modes OtherModes      `group:"Other Modes"`
 
-	Tail tail.TailOptions `group:"Tail Options" namespace:"tail"`
+	Tail      tail.TailOptions      `group:"Tail Options" namespace:"tail"`
+	Multiline tail.MultilineOptions `group:"Multiline Options" namespace:"multiline"`
+	Container tail.ContainerOptions `group:"Container Log Options" namespace:"container"`
+	Dir       tail.DirOptions       `group:"Directory Options" namespace:"dir"`
+
+	Syslog  inputs.SyslogOptions  `group:"Syslog Input Options" namespace:"syslog"`
+	HTTP    inputs.HTTPOptions    `group:"HTTP Input Options" namespace:"http"`
+	OTLP    inputs.OTLPOptions    `group:"OTLP Input Options" namespace:"otlp"`
+	Forward inputs.ForwardOptions `group:"Forward Input Options" namespace:"forward"`
+	Exec    inputs.ExecOptions    `group:"Exec Input Options" namespace:"exec"`
 
 	ArangoDB   arangodb.Options   `group:"ArangoDB Parser Options" namespace:"arangodb"`
 	JSON       htjson.Options     `group:"JSON Parser Options" namespace:"json"`
@@ -96,6 +124,7 @@ type RequiredOptions struct {
 	ParserName string   `short:"p" long:"parser" description:"Parser module to use. Use --list to list available options."`
 	//WriteKey   string   `short:"k" long:"writekey" description:"Team write key"`
 	LogFiles   []string `short:"f" long:"file" description:"Log file(s) to parse. Use '-' for STDIN, use this flag multiple times to tail multiple files, or use a glob (/path/to/foo-*.log)"`
+	Dirs       []string `long:"dir" description:"Directory to parse the log files in, and in the directories under it. Files and directories created later are found on the next rescan, every --tail.rescan_interval seconds, not as they turn up. Use this flag multiple times for more than one. Which files are picked is set by --dir.include and --dir.exclude"`
 	Dataset    string   `short:"d" long:"dataset" description:"Name of the dataset"`
 }
 
@@ -142,12 +171,7 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	// Support flag alias: --backfill should cover --backoff --tail.read_from=beginning --tail.stop
-	if options.Backfill {
-		options.BackOff = true
-		options.Tail.ReadFrom = "beginning"
-		options.Tail.Stop = true
-	}
+	applyBackfillOptions(&options)
 
 	// set time zone info
 	if options.Localtime {
@@ -178,7 +202,7 @@ func main() {
 	}
 
 
-	run(options)
+	run(context.Background(), options)
 }
 
 // setVersion sets the internal version ID and updates libclick's user-agent
@@ -250,40 +274,95 @@ func addParserDefaultOptions(options *GlobalOptions) {
 	}
 }
 
+// applyBackfillOptions supports the flag alias: --backfill should cover
+// --backoff --tail.read_from=beginning --tail.stop. A time to read from is
+// kept, so a backfill can start partway through.
+func applyBackfillOptions(options *GlobalOptions) {
+	if options.Backfill {
+		options.BackOff = true
+		if !strings.HasPrefix(options.Tail.ReadFrom, "time:") {
+			options.Tail.ReadFrom = "beginning"
+		}
+		options.Tail.Stop = true
+	}
+}
+
 func sanityCheckOptions(options *GlobalOptions) {
-	switch {
-	case options.Reqs.ParserName == "":
-		fmt.Println("Parser required to be specified with the --parser flag.")
+	if err := checkOptions(options); err != nil {
+		fmt.Println(err)
 		usage()
 		os.Exit(1)
+	}
+}
+
+// receivingLogs says whether any of the inputs other than files are set up
+func receivingLogs(options *GlobalOptions) bool {
+	return len(options.Syslog.Listen) > 0 || options.HTTP.Listen != "" ||
+		options.OTLP.Listen != "" || options.Forward.Listen != "" ||
+		len(options.Exec.Command) > 0
+}
+
+// checkOptions returns an error describing the first problem it finds with
+// options. It also anchors the prefix regex.
+func checkOptions(options *GlobalOptions) error {
+	switch {
+	case options.Reqs.ParserName == "":
+		return errors.New("Parser required to be specified with the --parser flag.")
 	/*case options.Reqs.WriteKey == "" || options.Reqs.WriteKey == "NULL":
-		fmt.Println("Write key required to be specified with the --writekey flag.")
-		usage()
-		os.Exit(1)*/
-	case len(options.Reqs.LogFiles) == 0:
-		fmt.Println("Log file name or '-' required to be specified with the --file flag.")
-		usage()
-		os.Exit(1)
+		return errors.New("Write key required to be specified with the --writekey flag.")*/
+	case len(options.Reqs.LogFiles) == 0 && len(options.Reqs.Dirs) == 0 && !receivingLogs(options):
+		return errors.New("Log file name or '-' required to be specified with the --file flag, or a directory with --dir, unless receiving logs with --syslog.listen, --http.listen, --otlp.listen or --forward.listen, or running commands with --exec.command.")
 	case options.Reqs.Dataset == "":
-		fmt.Println("Dataset name required with the --dataset flag.")
-		usage()
-		os.Exit(1)
+		return errors.New("Dataset name required with the --dataset flag.")
 	case options.SampleRate == 0:
-		fmt.Println("Sample rate must be an integer >= 1")
-		usage()
-		os.Exit(1)
+		return errors.New("Sample rate must be an integer >= 1")
 	case options.Tail.ReadFrom == "end" && options.Tail.Stop:
-		fmt.Println("Reading from the end and stopping when we get there. Zero lines to process. Ok, all done! ;)")
-		usage()
-		os.Exit(1)
+		return errors.New("Reading from the end and stopping when we get there. Zero lines to process. Ok, all done! ;)")
 	case options.RequestParseQuery != "whitelist" && options.RequestParseQuery != "all":
-		fmt.Println("request_parse_query flag must be either 'whitelist' or 'all'.")
-		usage()
-		os.Exit(1)
+		return errors.New("request_parse_query flag must be either 'whitelist' or 'all'.")
 	case len(options.DynSample) != 0 && options.SampleRate <= 1 && options.GoalSampleRate <= 1:
-		fmt.Println("sample rate flag must be set >= 2 when dynamic sampling is enabled")
-		usage()
-		os.Exit(1)
+		return errors.New("sample rate flag must be set >= 2 when dynamic sampling is enabled")
+	case options.OversizeField != "truncate" && options.OversizeField != "drop":
+		return errors.New("oversize_field flag must be either 'truncate' or 'drop'.")
+	case options.Tail.RotateStyle != "syslog" && options.Tail.RotateStyle != "timestamp":
+		return errors.New("tail.rotate_style flag must be either 'syslog' or 'timestamp'.")
+	case options.Tail.CompressedOrder != "mtime" && options.Tail.CompressedOrder != "name":
+		return errors.New("tail.compressed_order flag must be either 'mtime' or 'name'.")
+	case options.Tail.Framing != "newline" && options.Tail.Framing != "crlf" && options.Tail.Framing != "nul" && options.Tail.Framing != "length":
+		return errors.New("tail.framing flag must be one of 'newline', 'crlf', 'nul' or 'length'.")
+	case options.Tail.OversizeRecord != "truncate" && options.Tail.OversizeRecord != "skip":
+		return errors.New("tail.oversize_record flag must be either 'truncate' or 'skip'.")
+	case (options.Tail.Framing == "nul" || options.Tail.Framing == "length") && options.Tail.RotateStyle == "timestamp":
+		return errors.New("tail.framing flag must be either 'newline' or 'crlf' with --tail.rotate_style=timestamp.")
+	case options.Tail.Framing == "length" && (options.Tail.BackfillReaders > 1 || strings.HasPrefix(options.Tail.ReadFrom, "time:")):
+		// there's no telling where a record starts from the middle of the file
+		return errors.New("tail.framing=length can't be used with --tail.backfill_readers or --tail.read_from=time:.")
+	case len(options.Reqs.Dirs) != 0 && options.Tail.RotateStyle == "timestamp":
+		return errors.New("dir flag can't be used with --tail.rotate_style=timestamp; use a glob with --file instead.")
+	}
+
+	if err := checkTimeOptions(options); err != nil {
+		return err
+	}
+	if options.Tail.BackfillReaders > 1 {
+		// lines from different parts of a file are parsed separately, so
+		// parsers that group lines into events would split some of them
+		parser, _ := getParserAndOptions(*options)
+		if _, ok := parser.(parsers.EventBoundaryReporter); ok {
+			return fmt.Errorf("tail.backfill_readers flag can't be used with the %s parser, which builds events out of several lines.", options.Reqs.ParserName)
+		}
+	}
+	if _, err := tail.NewUnwrapper(options.Container); err != nil {
+		return err
+	}
+	if _, err := tail.NewDecoder(options.Tail); err != nil {
+		return err
+	}
+	if _, err := tail.NewDirFilter(options.Dir); err != nil {
+		return err
+	}
+	if err := checkMultilineOptions(options); err != nil {
+		return err
 	}
 
 	// check the prefix regex for validity
@@ -295,27 +374,106 @@ func sanityCheckOptions(options *GlobalOptions) {
 		// make sure it's valid
 		_, err := regexp.Compile(options.PrefixRegex)
 		if err != nil {
-			fmt.Printf("Prefix regex %s doesn't compile: error %s\n", options.PrefixRegex, err)
-			usage()
-			os.Exit(1)
+			return fmt.Errorf("Prefix regex %s doesn't compile: error %s", options.PrefixRegex, err)
 		}
 	}
 
 	// Make sure input files exist
-	shouldExit := false
+	var missing []string
 	for _, f := range options.Reqs.LogFiles {
 		if f == "-" {
 			continue
 		}
 		if files, err := filepath.Glob(f); err != nil || files == nil {
-			fmt.Printf("Log file specified by --file=%s not found!\n", f)
-			shouldExit = true
+			missing = append(missing, fmt.Sprintf("Log file specified by --file=%s not found!", f))
 		}
 	}
-	if shouldExit {
-		usage()
-		os.Exit(1)
+	for _, d := range options.Reqs.Dirs {
+		if info, err := os.Stat(d); err != nil || !info.IsDir() {
+			missing = append(missing, fmt.Sprintf("Directory specified by --dir=%s not found!", d))
+		}
+	}
+	if len(missing) != 0 {
+		return errors.New(strings.Join(missing, "\n"))
+	}
+	return nil
+}
+
+// checkTimeOptions checks --tail.read_from=time: and --stop_at, which need a
+// parser that can find the time of each event
+func checkTimeOptions(options *GlobalOptions) error {
+	var names []string
+	if strings.HasPrefix(options.Tail.ReadFrom, "time:") {
+		if _, err := tail.ParseTime(strings.TrimPrefix(options.Tail.ReadFrom, "time:")); err != nil {
+			return fmt.Errorf("tail.read_from flag: %s", err)
+		}
+		names = append(names, "--tail.read_from=time:")
+	}
+	if options.StopAt != "" {
+		if _, err := tail.ParseTime(options.StopAt); err != nil {
+			return fmt.Errorf("stop_at flag: %s", err)
+		}
+		if !options.Tail.Stop {
+			return errors.New("stop_at flag needs --tail.stop or --backfill.")
+		}
+		names = append(names, "--stop_at")
+	}
+	if len(names) == 0 {
+		return nil
 	}
+	what := strings.Join(names, " and ")
+	if options.Tail.RotateStyle == "timestamp" {
+		return fmt.Errorf("%s can't be used with --tail.rotate_style=timestamp.", what)
+	}
+	// container logs have the time of each line in the runtime's wrapper
+	if options.Container.Format != "" {
+		return nil
+	}
+	parser, _ := getParserAndOptions(*options)
+	if _, ok := parser.(parsers.TimestampFinder); !ok {
+		return fmt.Errorf("%s can't be used with the %s parser, as it can't find the time of each event.", what, options.Reqs.ParserName)
+	}
+	return nil
+}
+
+// checkMultilineOptions checks the --multiline flags, which join lines into
+// records before they're parsed
+func checkMultilineOptions(options *GlobalOptions) error {
+	joiner, err := tail.NewJoiner(options.Multiline)
+	if err != nil {
+		return err
+	}
+	if joiner == nil {
+		return nil
+	}
+	parser, _ := getParserAndOptions(*options)
+	if _, ok := parser.(parsers.EventBoundaryReporter); ok {
+		return fmt.Errorf("multiline flags can't be used with the %s parser, which builds events out of several lines itself.", options.Reqs.ParserName)
+	}
+	if options.Tail.BackfillReaders > 1 {
+		return errors.New("multiline flags can't be used with --tail.backfill_readers, as records could be split between chunks.")
+	}
+	return nil
+}
+
+// reloadOptions parses the command line and config file again, the same way
+// main does, and checks the result
+func reloadOptions() (GlobalOptions, error) {
+	var options GlobalOptions
+	flagParser := flag.NewParser(&options, flag.None)
+	if _, err := flagParser.Parse(); err != nil {
+		return options, err
+	}
+	if options.ConfigFile != "" {
+		ini := flag.NewIniParser(flagParser)
+		ini.ParseAsDefaults = true
+		if err := ini.ParseFile(options.ConfigFile); err != nil {
+			return options, fmt.Errorf("failed to parse the config file %s: %s", options.ConfigFile, err)
+		}
+	}
+	applyBackfillOptions(&options)
+	addParserDefaultOptions(&options)
+	return options, checkOptions(&options)
 }
 
 func usage() {
@@ -0,0 +1,41 @@
+// Package metrics keeps process-wide counters for things that happen to lines
+// and events on their way through clicktail, like fields that had to be
+// truncated. They're reported alongside the periodic summary of sent events.
+package metrics
+
+import "sync"
+
+var (
+	lock     sync.Mutex
+	counters = make(map[string]int64)
+)
+
+// Increment adds one to the named counter
+func Increment(name string) {
+	Add(name, 1)
+}
+
+// Add adds delta to the named counter
+func Add(name string, delta int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	counters[name] += delta
+}
+
+// Get returns the current value of the named counter
+func Get(name string) int64 {
+	lock.Lock()
+	defer lock.Unlock()
+	return counters[name]
+}
+
+// Snapshot returns a copy of all the counters that have been touched
+func Snapshot() map[string]int64 {
+	lock.Lock()
+	defer lock.Unlock()
+	snap := make(map[string]int64, len(counters))
+	for k, v := range counters {
+		snap[k] = v
+	}
+	return snap
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	// the counters are global, so only what this run adds is checked
+	before := Snapshot()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			Increment("test_counter")
+			Add("test_other", 5)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if got := Get("test_counter") - before["test_counter"]; got != 10 {
+		t.Errorf("expected test_counter to go up by 10, got %d", got)
+	}
+	snap := Snapshot()
+	if got := snap["test_other"] - before["test_other"]; got != 50 {
+		t.Errorf("expected test_other to go up by 50 in the snapshot, got %d", got)
+	}
+	// the snapshot is a copy
+	snap["test_counter"] = 0
+	if got := Get("test_counter") - before["test_counter"]; got != 10 {
+		t.Errorf("changing the snapshot shouldn't change the counter, got %d", got)
+	}
+}
@@ -168,12 +168,18 @@ func (p *Parser) Init(options interface{}) error {
 
 // ProcessLines method for Parser.
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	p.ProcessRecords(parsers.Records(lines), send, prefixRegex)
+}
+
+// ProcessRecords parses records like ProcessLines does lines, and adds each
+// record's fields to its event
+func (p *Parser) ProcessRecords(records <-chan parsers.Record, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
 	wg := sync.WaitGroup{}
 	for i := 0; i < numParsers; i++ {
 		wg.Add(1)
 		go func() {
-			for line := range lines {
-				line = strings.TrimSpace(line)
+			for record := range records {
+				line := strings.TrimSpace(record.Text)
 				// take care of any headers on the line
 				var prefixFields map[string]string
 				if prefixRegex != nil {
@@ -195,6 +201,9 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 					for k, v := range prefixFields {
 						values[k] = v
 					}
+					for k, v := range record.Fields {
+						values[k] = v
+					}
 
 					logrus.WithFields(logrus.Fields{
 						"line":   line,
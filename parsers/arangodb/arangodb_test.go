@@ -80,33 +80,51 @@ func TestProcessLines(t *testing.T) {
 		}
 		close(lines)
 	}()
-	// spin up the processor to process our test lines
-	go m.ProcessLines(lines, send, nil)
+	// spin up the processor to process our test lines. The lines are parsed
+	// in parallel, so the events can come out in any order; wait for all of
+	// them before checking.
+	go func() {
+		m.ProcessLines(lines, send, nil)
+		close(send)
+	}()
+	var events []event.Event
+	for ev := range send {
+		events = append(events, ev)
+	}
+	if len(events) != len(tlm) {
+		t.Fatalf("expected %d events, got %d: %+v", len(tlm), len(events), events)
+	}
 	for _, pair := range tlm {
-		ev := <-send
-
-		if ev.Timestamp.UnixNano() != pair.expected.time.UnixNano() {
-			t.Errorf("Parsed timestamp didn't match up for %s.\n  Expected: %+v\n  Actual: %+v",
-				pair.line, pair.expected.time, ev.Timestamp)
-		}
-
-		var missing []string
-		for k := range pair.expected.includeData {
-			if _, ok := ev.Data[k]; !ok {
-				missing = append(missing, k)
-			} else if !reflect.DeepEqual(ev.Data[k], pair.expected.includeData[k]) {
-				t.Errorf("  Parsed data value %s didn't match up for %s.\n  Expected: %+v\n  Actual: %+v",
-					k, pair.line, pair.expected.includeData[k], ev.Data[k])
+		found := -1
+		for i, ev := range events {
+			if matchesProcessed(ev, pair.expected) {
+				found = i
+				break
 			}
 		}
-		if missing != nil {
-			t.Errorf("  Parsed data was missing keys for line: %s\n  Missing: %+v\n  Parsed data: %+v",
-				pair.line, missing, ev.Data)
+		if found == -1 {
+			t.Errorf("No event matched line: %s\n  Expected: %+v\n  Events: %+v",
+				pair.line, pair.expected, events)
+			continue
 		}
-		for _, k := range pair.expected.excludeKeys {
-			if _, ok := ev.Data[k]; ok {
-				t.Errorf("  Parsed data included unexpected key %s for line: %s", k, pair.line)
-			}
+		events = append(events[:found], events[found+1:]...)
+	}
+}
+
+// matchesProcessed reports whether ev has the time and data expected
+func matchesProcessed(ev event.Event, expected processed) bool {
+	if ev.Timestamp.UnixNano() != expected.time.UnixNano() {
+		return false
+	}
+	for k, v := range expected.includeData {
+		if !reflect.DeepEqual(ev.Data[k], v) {
+			return false
+		}
+	}
+	for _, k := range expected.excludeKeys {
+		if _, ok := ev.Data[k]; ok {
+			return false
 		}
 	}
+	return true
 }
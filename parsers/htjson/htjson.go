@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 
@@ -47,7 +48,22 @@ func (j *JSONLineParser) ParseLine(line string) (map[string]interface{}, error)
 	return parsed, err
 }
 
+// LineTimestamp returns the time in the json blob on line, if it has one
+func (p *Parser) LineTimestamp(line string) (time.Time, bool) {
+	parsedLine, err := p.lineParser.ParseLine(strings.TrimSpace(line))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return httime.FindTimestamp(parsedLine, p.conf.TimeFieldName, p.conf.TimeFieldFormat)
+}
+
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	p.ProcessRecords(parsers.Records(lines), send, prefixRegex)
+}
+
+// ProcessRecords parses records like ProcessLines does lines, and adds each
+// record's fields to its event
+func (p *Parser) ProcessRecords(records <-chan parsers.Record, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
 	wg := sync.WaitGroup{}
 	numParsers := 1
 	if p.conf.NumParsers > 0 {
@@ -56,8 +72,8 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 	for i := 0; i < numParsers; i++ {
 		wg.Add(1)
 		go func() {
-			for line := range lines {
-				line = strings.TrimSpace(line)
+			for record := range records {
+				line := strings.TrimSpace(record.Text)
 				logrus.WithFields(logrus.Fields{
 					"line": line,
 				}).Debug("Attempting to process json log line")
@@ -85,6 +101,9 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 				for k, v := range prefixFields {
 					parsedLine[k] = v
 				}
+				for k, v := range record.Fields {
+					parsedLine[k] = v
+				}
 
 				// send an event to Transmission
 				e := event.Event{
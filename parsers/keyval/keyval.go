@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/kr/logfmt"
@@ -72,7 +73,27 @@ func (j *KeyValLineParser) ParseLine(line string) (map[string]interface{}, error
 	return parsed, err
 }
 
+// LineTimestamp returns the time on line, if it has one and isn't filtered
+// out by --keyval.filter_regex
+func (p *Parser) LineTimestamp(line string) (time.Time, bool) {
+	line = strings.TrimSpace(line)
+	if p.filterRegex != nil && p.filterRegex.MatchString(line) == p.conf.InvertFilter {
+		return time.Time{}, false
+	}
+	parsedLine, err := p.lineParser.ParseLine(line)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return httime.FindTimestamp(parsedLine, p.conf.TimeFieldName, p.conf.TimeFieldFormat)
+}
+
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	p.ProcessRecords(parsers.Records(lines), send, prefixRegex)
+}
+
+// ProcessRecords parses records like ProcessLines does lines, and adds each
+// record's fields to its event
+func (p *Parser) ProcessRecords(records <-chan parsers.Record, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
 	wg := sync.WaitGroup{}
 	numParsers := 1
 	if p.conf.NumParsers > 0 {
@@ -81,8 +102,8 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 	for i := 0; i < numParsers; i++ {
 		wg.Add(1)
 		go func() {
-			for line := range lines {
-				line = strings.TrimSpace(line)
+			for record := range records {
+				line := strings.TrimSpace(record.Text)
 				logrus.WithFields(logrus.Fields{
 					"line": line,
 				}).Debug("Attempting to process keyval log line")
@@ -138,6 +159,9 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 				for k, v := range prefixFields {
 					parsedLine[k] = v
 				}
+				for k, v := range record.Fields {
+					parsedLine[k] = v
+				}
 
 				// look for the timestamp in any of the prefix fields or regular content
 				timestamp := httime.GetTimestamp(parsedLine, p.conf.TimeFieldName, p.conf.TimeFieldFormat)
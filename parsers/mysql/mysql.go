@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -149,6 +150,10 @@ type Options struct {
 }
 
 type Parser struct {
+	// liveSampleRate is set by SetSampleRate and takes over from SampleRate.
+	// It's first in the struct so it's aligned for atomic access.
+	liveSampleRate int64
+
 	// set SampleRate to cause the MySQL parser to drop events after before
 	// they're parsed to save CPU
 	SampleRate int
@@ -159,6 +164,44 @@ type Parser struct {
 	readOnly   *bool
 	replicaLag *int64
 	role       *string
+	// commit is called with the number of lines grouped into complete events
+	commit func(lines int64)
+}
+
+// SetSampleRate changes the sample rate while lines are being processed
+func (p *Parser) SetSampleRate(rate int) {
+	atomic.StoreInt64(&p.liveSampleRate, int64(rate))
+}
+
+// ReportEventBoundaries sets a func to call with the number of lines read so
+// far each time they've all been grouped into complete events, which happens
+// at each `# Time:` or `# User@Host:` line that starts a new one
+func (p *Parser) ReportEventBoundaries(commit func(lines int64)) {
+	p.commit = commit
+}
+
+// LineTimestamp returns the time on a `# Time:` line. Older versions of mysql
+// only write one when the second has changed since the last event.
+func (p *Parser) LineTimestamp(line string) (time.Time, bool) {
+	var ts time.Time
+	var err error
+	if _, mg := reTime.FindStringSubmatchMap(line); mg != nil {
+		ts, err = httime.Parse(timeFormat, mg["time"])
+	} else if _, mg := reOldTime.FindStringSubmatchMap(line); mg != nil {
+		ts, err = httime.Parse(oldTimeFormat, mg["datetime"])
+	} else {
+		return time.Time{}, false
+	}
+	return ts, err == nil
+}
+
+// sampleRate returns the rate set by SetSampleRate, or SampleRate if it hasn't
+// been called
+func (p *Parser) sampleRate() int {
+	if rate := atomic.LoadInt64(&p.liveSampleRate); rate != 0 {
+		return int(rate)
+	}
+	return p.SampleRate
 }
 
 // the normalizer can't be shared by all threads.
@@ -324,9 +367,22 @@ func isMySQLHeaderLine(line string) bool {
 		(first == 'T' && reMySQLColumnHeaders.MatchString(line))
 }
 
+// lineGroup is the lines of one event, along with the fields of the record
+// its first line came in
+type lineGroup struct {
+	lines  []string
+	fields map[string]interface{}
+}
+
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	p.ProcessRecords(parsers.Records(lines), send, prefixRegex)
+}
+
+// ProcessRecords groups records into events like ProcessLines does lines, and
+// adds the fields of each event's first record to it
+func (p *Parser) ProcessRecords(records <-chan parsers.Record, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
 	// start up a goroutine to handle grouped sets of lines
-	rawEvents := make(chan []string)
+	rawEvents := make(chan lineGroup)
 	defer p.wg.Wait()
 	p.wg.Add(1)
 	go p.handleEvents(rawEvents, send)
@@ -334,8 +390,13 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 	// flag to indicate when we've got a complete event to send
 	var foundStatement bool
 	groupedLines := make([]string, 0, 5)
-	for line := range lines {
-		line = strings.TrimSpace(line)
+	// groupFields are the fields of the group's first record
+	var groupFields map[string]interface{}
+	// numLines counts the lines read, for reporting event boundaries
+	var numLines int64
+	for record := range records {
+		numLines++
+		line := strings.TrimSpace(record.Text)
 		// mysql parser does not support capturing fields in the line prefix - just
 		// strip it.
 		if prefixRegex != nil {
@@ -354,26 +415,39 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 				// we've started a new event. Send the previous one.
 				foundStatement = false
 				// if sampling is disabled or sampler says keep, pass along this group.
-				if p.SampleRate <= 1 || rand.Intn(p.SampleRate) == 0 {
-					rawEvents <- groupedLines
+				if sampleRate := p.sampleRate(); sampleRate <= 1 || rand.Intn(sampleRate) == 0 {
+					rawEvents <- lineGroup{lines: groupedLines, fields: groupFields}
 				}
 				groupedLines = make([]string, 0, 5)
+				// everything before this line is in complete events
+				if p.commit != nil {
+					p.commit(numLines - 1)
+				}
 			}
 		}
+		if len(groupedLines) == 0 {
+			groupFields = record.Fields
+		}
 		groupedLines = append(groupedLines, line)
 	}
 	// send the last event, if there was one collected
 	if foundStatement {
 		// if sampling is disabled or sampler says keep, pass along this group.
-		if p.SampleRate <= 1 || rand.Intn(p.SampleRate) == 0 {
-			rawEvents <- groupedLines
+		if sampleRate := p.sampleRate(); sampleRate <= 1 || rand.Intn(sampleRate) == 0 {
+			rawEvents <- lineGroup{lines: groupedLines, fields: groupFields}
 		}
+		groupedLines = nil
+	}
+	// the comments of an event that never got to its statement are read
+	// again, so it isn't sent without them
+	if p.commit != nil {
+		p.commit(numLines - int64(len(groupedLines)))
 	}
 	logrus.Debug("lines channel is closed, ending mysql processor")
 	close(rawEvents)
 }
 
-func (p *Parser) handleEvents(rawEvents <-chan []string, send chan<- event.Event) {
+func (p *Parser) handleEvents(rawEvents <-chan lineGroup, send chan<- event.Event) {
 	defer p.wg.Done()
 	wg := sync.WaitGroup{}
 	numParsers := 1
@@ -386,8 +460,8 @@ func (p *Parser) handleEvents(rawEvents <-chan []string, send chan<- event.Event
 		}
 		wg.Add(1)
 		go func() {
-			for rawE := range rawEvents {
-				sq, timestamp := p.handleEvent(&ptp, rawE)
+			for group := range rawEvents {
+				sq, timestamp := p.handleEvent(&ptp, group.lines)
 				if len(sq) == 0 {
 					continue
 				}
@@ -395,6 +469,9 @@ func (p *Parser) handleEvents(rawEvents <-chan []string, send chan<- event.Event
 					// skip events with no query field
 					continue
 				}
+				for k, v := range group.fields {
+					sq[k] = v
+				}
 				if p.hostedOn != "" {
 					sq[hostedOnKey] = p.hostedOn
 				}
@@ -409,7 +486,7 @@ func (p *Parser) handleEvents(rawEvents <-chan []string, send chan<- event.Event
 				}
 				send <- event.Event{
 					Timestamp:  timestamp,
-					SampleRate: p.SampleRate,
+					SampleRate: p.sampleRate(),
 					Data:       sq,
 				}
 			}
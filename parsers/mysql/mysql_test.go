@@ -907,3 +907,67 @@ func TestProcessLines(t *testing.T) {
 		t.Errorf("With sampling enabled, only expected 5 events, got %d", numEvents)
 	}
 }
+
+func TestReportEventBoundaries(t *testing.T) {
+	first := []string{
+		"# Time: 151008  0:31:04",
+		"# User@Host: rails[rails] @  [10.252.9.33]",
+		"# Query_time: 0.030974  Lock_time: 0.000019 Rows_sent: 0  Rows_examined: 30259",
+		"SET timestamp=1444264264;",
+		"SELECT `metadata`.* FROM `metadata` WHERE (`metadata`.app_id = 993089);",
+	}
+	second := []string{
+		"# Time: 151008  0:31:05",
+		"# User@Host: rails[rails] @  [10.252.9.33]",
+		"# Query_time: 0.002280  Lock_time: 0.000023 Rows_sent: 0  Rows_examined: 921",
+	}
+	tsts := []struct {
+		in       []string
+		expected []int64
+	}{
+		// the first event is complete once the second one starts, and
+		// everything is once the lines run out
+		{append(append(append([]string{}, first...), second...), "SELECT 1;"), []int64{5, 9}},
+		// an event that's cut off before its statement isn't complete, so
+		// its comments aren't committed
+		{append(append([]string{}, first...), second...), []int64{5, 5}},
+		{second[:2], []int64{0}},
+	}
+	for _, tt := range tsts {
+		p := &Parser{}
+		var commits []int64
+		p.ReportEventBoundaries(func(lines int64) {
+			commits = append(commits, lines)
+		})
+		lines := make(chan string, len(tt.in))
+		for _, line := range tt.in {
+			lines <- line
+		}
+		close(lines)
+		send := make(chan event.Event, 2)
+		p.ProcessLines(lines, send, nil)
+		if !reflect.DeepEqual(commits, tt.expected) {
+			t.Errorf("expected commits at %v, got %v", tt.expected, commits)
+		}
+	}
+}
+
+func TestLineTimestamp(t *testing.T) {
+	p := &Parser{}
+	tsts := []struct {
+		line     string
+		expected time.Time
+		found    bool
+	}{
+		{"# Time: 2016-04-01T00:31:09.817887Z", time.Date(2016, 4, 1, 0, 31, 9, 817887000, time.UTC), true},
+		{"# Time: 100815 00:31:04", time.Date(2015, 10, 8, 0, 31, 4, 0, time.UTC), true},
+		{"# User@Host: root[root] @ localhost []  Id:   233", time.Time{}, false},
+		{"SET timestamp=1459470669;", time.Time{}, false},
+	}
+	for _, tt := range tsts {
+		ts, found := p.LineTimestamp(tt.line)
+		if found != tt.found || !ts.Equal(tt.expected) {
+			t.Errorf("for %q, expected %s, %v, got %s, %v", tt.line, tt.expected, tt.found, ts, found)
+		}
+	}
+}
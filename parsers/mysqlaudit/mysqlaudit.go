@@ -68,6 +68,12 @@ func (j *AuditLineParser) ParseLine(line string) (map[string]interface{}, error)
 }
 
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	p.ProcessRecords(parsers.Records(lines), send, prefixRegex)
+}
+
+// ProcessRecords parses records like ProcessLines does lines, and adds each
+// record's fields to its event
+func (p *Parser) ProcessRecords(records <-chan parsers.Record, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
 	wg := sync.WaitGroup{}
 	numParsers := 1
 	if p.conf.NumParsers > 0 {
@@ -76,8 +82,8 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 	for i := 0; i < numParsers; i++ {
 		wg.Add(1)
 		go func() {
-			for line := range lines {
-				line = strings.TrimSpace(line)
+			for record := range records {
+				line := strings.TrimSpace(record.Text)
 				logrus.WithFields(logrus.Fields{
 					"line": line,
 				}).Debug("Attempting to process keyval log line")
@@ -133,6 +139,9 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 				for k, v := range prefixFields {
 					parsedLine[k] = v
 				}
+				for k, v := range record.Fields {
+					parsedLine[k] = v
+				}
 
 				// look for the timestamp in any of the prefix fields or regular content
 				//timestamp := httime.GetTimestamp(parsedLine, "timestamp", p.conf.TimeFieldFormat)
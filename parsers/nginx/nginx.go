@@ -79,13 +79,19 @@ func (g *GonxLineParser) ParseLine(line string) (map[string]interface{}, error)
 }
 
 func (n *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	n.ProcessRecords(parsers.Records(lines), send, prefixRegex)
+}
+
+// ProcessRecords parses records like ProcessLines does lines, and adds each
+// record's fields to its event
+func (n *Parser) ProcessRecords(records <-chan parsers.Record, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
 	// parse lines one by one
 	wg := sync.WaitGroup{}
 	for i := 0; i < n.conf.NumParsers; i++ {
 		wg.Add(1)
 		go func() {
-			for line := range lines {
-				line = strings.TrimSpace(line)
+			for record := range records {
+				line := strings.TrimSpace(record.Text)
 				logrus.WithFields(logrus.Fields{
 					"line": line,
 				}).Debug("Attempting to process nginx log line")
@@ -107,6 +113,9 @@ func (n *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 				for k, v := range prefixFields {
 					parsedLine[k] = v
 				}
+				for k, v := range record.Fields {
+					parsedLine[k] = v
+				}
 				timestamp := n.getTimestamp(parsedLine)
 
 				e := event.Event{
@@ -149,6 +158,27 @@ func typeifyParsedLine(pl map[string]string) map[string]interface{} {
 	return msi
 }
 
+// LineTimestamp returns the time of the request logged on line, if it has one
+func (n *Parser) LineTimestamp(line string) (time.Time, bool) {
+	parsedLine, err := n.lineParser.ParseLine(strings.TrimSpace(line))
+	if err != nil {
+		return time.Time{}, false
+	}
+	if n.conf.TimeFieldFormat != "" || n.conf.TimeFieldName != "" {
+		if n.conf.TimeFieldFormat == "" || n.conf.TimeFieldName == "" {
+			return time.Time{}, false
+		}
+		return httime.FindTimestamp(parsedLine, n.conf.TimeFieldName, n.conf.TimeFieldFormat)
+	}
+	if _, ok := parsedLine["time_local"]; ok {
+		return httime.FindTimestamp(parsedLine, "time_local", commonLogFormatTimeLayout)
+	}
+	if _, ok := parsedLine["time_iso8601"]; ok {
+		return httime.FindTimestamp(parsedLine, "time_iso8601", iso8601TimeLayout)
+	}
+	return httime.FindTimestamp(parsedLine, "", "")
+}
+
 // tries to extract a timestamp from the log line
 func (n *Parser) getTimestamp(evMap map[string]interface{}) time.Time {
 	var (
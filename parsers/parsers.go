@@ -4,7 +4,11 @@
 // any necessary or relevant smarts for that style of logs.
 package parsers
 
-import "github.com/honeycombio/honeytail/event"
+import (
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
 
 type Parser interface {
 	// Init does any initialization necessary for the module
@@ -15,6 +19,54 @@ type Parser interface {
 	ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *ExtRegexp)
 }
 
+// Record is a line along with fields for the event it starts that aren't part
+// of its text, like where it was read from
+type Record struct {
+	Text   string
+	Fields map[string]interface{}
+}
+
+// RecordProcessor is implemented by parsers that can take Records instead of
+// bare lines
+type RecordProcessor interface {
+	// ProcessRecords is ProcessLines for records. Each event gets the fields
+	// of the record it starts with, along with any from prefixRegex.
+	ProcessRecords(records <-chan Record, send chan<- event.Event, prefixRegex *ExtRegexp)
+}
+
+// Records passes on lines as Records without any fields of their own, for a
+// parser's ProcessLines to hand to its ProcessRecords
+func Records(lines <-chan string) <-chan Record {
+	records := make(chan Record)
+	go func() {
+		defer close(records)
+		for line := range lines {
+			records <- Record{Text: line}
+		}
+	}()
+	return records
+}
+
+// EventBoundaryReporter is implemented by parsers that build each event out of
+// several lines, so that the position saved in the statefile can be kept at
+// the start of an event
+type EventBoundaryReporter interface {
+	// ReportEventBoundaries sets a func for the parser to call with the number
+	// of lines it has received so far whenever they've all been grouped into
+	// complete events
+	ReportEventBoundaries(commit func(lines int64))
+}
+
+// TimestampFinder is implemented by parsers that can tell the time of an event
+// from the line that starts it, without parsing the rest of the event. It's
+// used to find where to start reading with --tail.read_from=time:<timestamp>
+// and where to stop with --stop_at.
+type TimestampFinder interface {
+	// LineTimestamp returns the time of the event that line starts, and false
+	// if line doesn't start an event or the time can't be found in it
+	LineTimestamp(line string) (time.Time, bool)
+}
+
 type LineParser interface {
 	ParseLine(line string) (map[string]interface{}, error)
 }
@@ -110,6 +110,8 @@ type Options struct {
 type Parser struct {
 	// regex to match the log_line_prefix format specified by the user
 	pgPrefixRegex *parsers.ExtRegexp
+	// commit is called with the number of lines grouped into complete events
+	commit func(lines int64)
 }
 
 func (p *Parser) Init(options interface{}) (err error) {
@@ -124,13 +126,54 @@ func (p *Parser) Init(options interface{}) (err error) {
 	return err
 }
 
+// ReportEventBoundaries sets a func to call with the number of lines read so
+// far each time they've all been grouped into complete statements
+func (p *Parser) ReportEventBoundaries(commit func(lines int64)) {
+	p.commit = commit
+}
+
+// LineTimestamp returns the time in the prefix of a line that starts a log
+// statement, if log_line_prefix includes one
+func (p *Parser) LineTimestamp(line string) (time.Time, bool) {
+	if isContinuationLine(line) {
+		return time.Time{}, false
+	}
+	match, _, generalMeta := parsePrefix(p.pgPrefixRegex, line)
+	if !match {
+		return time.Time{}, false
+	}
+	ev := &event.Event{
+		Data: make(map[string]interface{}, 0),
+	}
+	addFieldsToEvent(generalMeta, ev)
+	return ev.Timestamp, !ev.Timestamp.IsZero()
+}
+
+// lineGroup is the lines of one log statement, along with the fields of the
+// record its first line came in
+type lineGroup struct {
+	lines  []string
+	fields map[string]interface{}
+}
+
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
-	rawEvents := make(chan []string)
+	p.ProcessRecords(parsers.Records(lines), send, prefixRegex)
+}
+
+// ProcessRecords groups records into log statements like ProcessLines does
+// lines, and adds the fields of each statement's first record to its event
+func (p *Parser) ProcessRecords(records <-chan parsers.Record, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	rawEvents := make(chan lineGroup)
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	go p.handleEvents(rawEvents, send, wg)
 	var groupedLines []string
-	for line := range lines {
+	var groupFields map[string]interface{}
+	// numLines counts the lines read, for reporting event boundaries
+	var numLines int64
+	for record := range records {
+		numLines++
+		line := record.Text
 		if prefixRegex != nil {
 			// This is the "global" prefix regex as specified by the
 			// --log_prefix option, for stripping prefixes added by syslog or
@@ -145,13 +188,25 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 		if !isContinuationLine(line) && len(groupedLines) > 0 {
 			// If the line we just parsed is the start of a new log statement,
 			// send off the previously accumulated group.
-			rawEvents <- groupedLines
+			rawEvents <- lineGroup{lines: groupedLines, fields: groupFields}
 			groupedLines = make([]string, 0, 1)
+			// everything before this line is in complete statements
+			if p.commit != nil {
+				p.commit(numLines - 1)
+			}
+		}
+		if len(groupedLines) == 0 {
+			groupFields = record.Fields
 		}
 		groupedLines = append(groupedLines, line)
 	}
 
-	rawEvents <- groupedLines
+	rawEvents <- lineGroup{lines: groupedLines, fields: groupFields}
+	// there's no telling whether the last statement has all its lines until
+	// the next one starts, so it's read again whole after a restart
+	if p.commit != nil {
+		p.commit(numLines - int64(len(groupedLines)))
+	}
 	close(rawEvents)
 	wg.Wait()
 }
@@ -159,12 +214,15 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 // handleEvents receives sets of grouped log lines, each representing a single
 // log statement. It attempts to parse them, and sends the events it constructs
 // down the send channel.
-func (p *Parser) handleEvents(rawEvents <-chan []string, send chan<- event.Event, wg *sync.WaitGroup) {
+func (p *Parser) handleEvents(rawEvents <-chan lineGroup, send chan<- event.Event, wg *sync.WaitGroup) {
 	defer wg.Done()
 	// TODO: spin up a group of goroutines to do this
 	for rawEvent := range rawEvents {
-		ev := p.handleEvent(rawEvent)
+		ev := p.handleEvent(rawEvent.lines)
 		if ev != nil {
+			for k, v := range rawEvent.fields {
+				ev.Data[k] = v
+			}
 			send <- *ev
 		}
 	}
@@ -1,12 +1,14 @@
 package postgresql
 
 import (
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -102,14 +104,14 @@ func TestSingleQueryParsing(t *testing.T) {
 
 	for _, tc := range testcases {
 		t.Run(tc.description, func(t *testing.T) {
-			in := make(chan []string)
+			in := make(chan lineGroup)
 			out := make(chan event.Event)
 			p := Parser{}
 			p.Init(&Options{LogLinePrefix: tc.prefixFormat})
 			wg := &sync.WaitGroup{}
 			wg.Add(1)
 			go p.handleEvents(in, out, wg)
-			in <- strings.Split(tc.in, "\n")
+			in <- lineGroup{lines: strings.Split(tc.in, "\n")}
 			close(in)
 			got := <-out
 			assert.Equal(t, got, tc.expected)
@@ -193,6 +195,34 @@ func TestMultipleQueryParsing(t *testing.T) {
 	}
 }
 
+// Test that the fields of the record a statement's first line came in are
+// added to its event, and that --log_prefix is still only stripped
+func TestRecordFields(t *testing.T) {
+	in := []parsers.Record{
+		{
+			Text:   "[host a] 2017-11-07 01:43:39 UTC [3542-7] postgres@test LOG:  duration: 15.577 ms  statement: SELECT * FROM test",
+			Fields: map[string]interface{}{"_line_number": int64(3)},
+		},
+		{
+			Text:   "[host a] \tWHERE id=1;",
+			Fields: map[string]interface{}{"_line_number": int64(4)},
+		},
+	}
+	parser := Parser{}
+	parser.Init(nil)
+	inChan := make(chan parsers.Record, len(in))
+	sendChan := make(chan event.Event, 1)
+	for _, record := range in {
+		inChan <- record
+	}
+	close(inChan)
+	parser.ProcessRecords(inChan, sendChan, &parsers.ExtRegexp{Regexp: regexp.MustCompile(`^\[host (?P<host>\w+)\] `)})
+	got := <-sendChan
+	assert.Equal(t, int64(3), got.Data["_line_number"])
+	assert.NotContains(t, got.Data, "host")
+	assert.Equal(t, "SELECT * FROM test WHERE id=1;", got.Data["query"])
+}
+
 // Test handling log statements that aren't slow query logs
 func TestSkipNonQueryLogLines(t *testing.T) {
 	parser := Parser{}
@@ -209,3 +239,41 @@ func TestSkipNonQueryLogLines(t *testing.T) {
 		assert.Nil(t, ev)
 	}
 }
+
+func TestReportEventBoundaries(t *testing.T) {
+	parser := Parser{}
+	parser.Init(nil)
+	var commits []int64
+	parser.ReportEventBoundaries(func(lines int64) {
+		commits = append(commits, lines)
+	})
+	in := []string{
+		"2017-11-07 01:43:39 UTC [3542-7] postgres@test LOG:  duration: 15.577 ms  statement: SELECT * FROM test",
+		"	WHERE id=1;",
+		"2017-11-07 01:43:42 UTC [3542-8] postgres@test LOG:  duration: 0.501 ms  statement: SELECT * FROM test",
+		"	WHERE id=2;",
+	}
+	inChan := make(chan string, len(in))
+	for _, line := range in {
+		inChan <- line
+	}
+	close(inChan)
+	sendChan := make(chan event.Event, 2)
+	parser.ProcessLines(inChan, sendChan, nil)
+	// the first statement is complete once the second one starts, but the
+	// last one might still have lines to come when they run out
+	assert.Equal(t, []int64{2, 2}, commits)
+	assert.Equal(t, 2, len(sendChan), "the last statement should still be sent")
+}
+
+func TestLineTimestamp(t *testing.T) {
+	parser := Parser{}
+	parser.Init(nil)
+	ts, found := parser.LineTimestamp("2017-11-07 01:43:39 UTC [3542-7] postgres@test LOG:  duration: 15.577 ms  statement: SELECT * FROM test")
+	assert.True(t, found)
+	assert.Equal(t, time.Date(2017, 11, 7, 1, 43, 39, 0, time.UTC), ts.UTC())
+	_, found = parser.LineTimestamp("	WHERE id=1;")
+	assert.False(t, found)
+	_, found = parser.LineTimestamp("not a postgres log line")
+	assert.False(t, found)
+}
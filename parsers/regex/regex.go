@@ -143,6 +143,12 @@ func (p *RegexLineParser) ParseLine(line string) (map[string]interface{}, error)
 }
 
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
+	p.ProcessRecords(parsers.Records(lines), send, prefixRegex)
+}
+
+// ProcessRecords parses records like ProcessLines does lines, and adds each
+// record's fields to its event
+func (p *Parser) ProcessRecords(records <-chan parsers.Record, send chan<- event.Event, prefixRegex *parsers.ExtRegexp) {
 	// parse lines one by one
 	wg := sync.WaitGroup{}
 	numParsers := 1
@@ -152,7 +158,8 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 	for i := 0; i < numParsers; i++ {
 		wg.Add(1)
 		go func() {
-			for line := range lines {
+			for record := range records {
+				line := record.Text
 				logrus.WithFields(logrus.Fields{
 					"line": line,
 				}).Debug("Attempting to process regex log line")
@@ -182,6 +189,11 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event, pref
 					continue
 				}
 
+				// the record's fields don't count as captures
+				for k, v := range record.Fields {
+					parsedLine[k] = v
+				}
+
 				// look for the timestamp in any of the prefix fields or regular content
 				timestamp := httime.GetTimestamp(parsedLine, p.conf.TimeFieldName, p.conf.TimeFieldFormat)
 
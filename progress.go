@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+// progressReporter keeps track of how far a --tail.stop run has got through
+// each of its files. It logs how they're getting on every --status_interval,
+// and once everything's been sent it writes a summary as JSON, so a script
+// can tell whether all of a file made it before deleting it.
+type progressReporter struct {
+	ctx   context.Context
+	began time.Time
+
+	lock   sync.Mutex
+	files  []*fileProgress
+	byPath map[string]*fileProgress
+}
+
+// fileProgress counts what's happened to the lines of one file. When a file
+// is read in chunks, all of its sources count towards the same one.
+type fileProgress struct {
+	// updated atomically, so kept at the start for alignment
+	bytesRead  int64
+	bytesTotal int64
+	lines      int64
+	parsed     int64
+	events     int64
+
+	reporter *progressReporter
+	path     string
+	// eachLine is set for parsers that make an event out of every line, for
+	// which lines that don't make one are parse failures
+	eachLine bool
+	began    time.Time
+
+	// guarded by the reporter's lock
+	sources  int
+	finished time.Time
+	complete bool
+}
+
+func newProgressReporter(ctx context.Context) *progressReporter {
+	return &progressReporter{
+		ctx:    ctx,
+		began:  time.Now(),
+		byPath: make(map[string]*fileProgress),
+	}
+}
+
+// add starts counting source. A nil reporter doesn't count anything, and
+// nor does the nil fileProgress it returns.
+func (r *progressReporter) add(source tail.Source, eachLine bool) *fileProgress {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p, ok := r.byPath[source.Path]
+	if !ok {
+		p = &fileProgress{
+			reporter: r,
+			path:     source.Path,
+			eachLine: eachLine,
+			began:    time.Now(),
+		}
+		r.byPath[source.Path] = p
+		r.files = append(r.files, p)
+	}
+	p.sources++
+	atomic.AddInt64(&p.bytesTotal, source.Size)
+	return p
+}
+
+// countLines passes on the lines read from the file, counting them and their
+// bytes. The file is finished with once all its sources' lines are.
+func (p *fileProgress) countLines(lines chan tail.Line) chan tail.Line {
+	if p == nil {
+		return lines
+	}
+	counted := make(chan tail.Line)
+	go func() {
+		for line := range lines {
+			atomic.AddInt64(&p.lines, 1)
+			atomic.AddInt64(&p.bytesRead, int64(len(line.Text))+1)
+			counted <- line
+		}
+		p.reporter.sourceDone(p)
+		close(counted)
+	}()
+	return counted
+}
+
+// countParsed passes on the lines left for the parser after sampling
+func (p *fileProgress) countParsed(lines chan tail.Line) chan tail.Line {
+	if p == nil || !p.eachLine {
+		return lines
+	}
+	counted := make(chan tail.Line)
+	go func() {
+		defer close(counted)
+		for line := range lines {
+			atomic.AddInt64(&p.parsed, 1)
+			counted <- line
+		}
+	}()
+	return counted
+}
+
+// countEvents passes on the events the parser made
+func (p *fileProgress) countEvents(events chan event.Event) chan event.Event {
+	if p == nil {
+		return events
+	}
+	counted := make(chan event.Event, cap(events))
+	go func() {
+		defer close(counted)
+		for ev := range events {
+			atomic.AddInt64(&p.events, 1)
+			counted <- ev
+		}
+	}()
+	return counted
+}
+
+// sourceDone records that one of p's sources has run out of lines. The file
+// was read to the end if that wasn't down to clicktail being stopped.
+func (r *progressReporter) sourceDone(p *fileProgress) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p.sources--
+	if p.sources > 0 {
+		return
+	}
+	p.finished = time.Now()
+	p.complete = r.ctx.Err() == nil
+	if p.complete {
+		logrus.WithFields(logrus.Fields{
+			"file":  p.path,
+			"bytes": atomic.LoadInt64(&p.bytesRead),
+			"lines": atomic.LoadInt64(&p.lines),
+			"took":  (p.finished.Sub(p.began) / time.Second * time.Second).String(),
+		}).Info("Finished reading file")
+	}
+}
+
+// logEvery logs the progress of the files still being read every interval
+// seconds, until done is closed
+func (r *progressReporter) logEvery(interval uint, done chan struct{}) {
+	if r == nil || interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second * time.Duration(interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.log()
+		case <-done:
+			return
+		}
+	}
+}
+
+// log logs how far each file still being read has got, with how long it's
+// likely to take to finish if its size is known
+func (r *progressReporter) log() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, p := range r.files {
+		if !p.finished.IsZero() {
+			continue
+		}
+		read := atomic.LoadInt64(&p.bytesRead)
+		total := atomic.LoadInt64(&p.bytesTotal)
+		lines := atomic.LoadInt64(&p.lines)
+		secs := time.Since(p.began).Seconds()
+		fields := logrus.Fields{
+			"file":          p.path,
+			"bytes_read":    read,
+			"lines":         lines,
+			"events":        atomic.LoadInt64(&p.events),
+			"lines_per_sec": int64(float64(lines) / secs),
+			"bytes_per_sec": int64(float64(read) / secs),
+		}
+		if p.eachLine {
+			fields["parse_failures"] = p.parseFailures()
+		}
+		if total > 0 {
+			fields["bytes_total"] = total
+			fields["percent"] = percent(read, total)
+			if read > 0 && read < total {
+				eta := time.Duration(float64(total-read) / (float64(read) / secs) * float64(time.Second))
+				fields["eta"] = (eta / time.Second * time.Second).String()
+			}
+		}
+		logrus.WithFields(fields).Info("Backfill progress")
+	}
+}
+
+// parseFailures is how many of the lines passed to the parser didn't make an
+// event. That includes any the parser filters out on purpose.
+func (p *fileProgress) parseFailures() int64 {
+	failures := atomic.LoadInt64(&p.parsed) - atomic.LoadInt64(&p.events)
+	if failures < 0 {
+		return 0
+	}
+	return failures
+}
+
+// percent is how much of total read is, up to 100. The last line of a file
+// may not end in a newline, so read can be a byte over.
+func percent(read, total int64) float64 {
+	if read >= total {
+		return 100
+	}
+	return float64(read*1000/total) / 10
+}
+
+// progressSummary is written once a --tail.stop run is over. It's only
+// complete if every file was read to the end and every event was sent.
+type progressSummary struct {
+	Complete      bool          `json:"complete"`
+	Interrupted   bool          `json:"interrupted"`
+	Seconds       float64       `json:"seconds"`
+	Lines         int64         `json:"lines"`
+	Events        int64         `json:"events"`
+	ParseFailures int64         `json:"parse_failures"`
+	SendFailures  int64         `json:"send_failures"`
+	Responses     map[int]int   `json:"responses_by_status"`
+	Files         []fileSummary `json:"files"`
+}
+
+type fileSummary struct {
+	Path          string  `json:"path"`
+	Complete      bool    `json:"complete"`
+	BytesRead     int64   `json:"bytes_read"`
+	BytesTotal    int64   `json:"bytes_total"`
+	Lines         int64   `json:"lines"`
+	Events        int64   `json:"events"`
+	ParseFailures int64   `json:"parse_failures"`
+	Seconds       float64 `json:"seconds"`
+}
+
+// summary totals up what happened to the files. responses counts the
+// responses for the events sent by status code, and sendFailures the events
+// that were given up on.
+func (r *progressReporter) summary(responses map[int]int, sendFailures int64) progressSummary {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s := progressSummary{
+		Interrupted:  r.ctx.Err() != nil,
+		Seconds:      time.Since(r.began).Seconds(),
+		SendFailures: sendFailures,
+		Responses:    responses,
+		Files:        []fileSummary{},
+	}
+	s.Complete = !s.Interrupted && sendFailures == 0
+	for _, p := range r.files {
+		f := fileSummary{
+			Path:       p.path,
+			Complete:   p.complete,
+			BytesRead:  atomic.LoadInt64(&p.bytesRead),
+			BytesTotal: atomic.LoadInt64(&p.bytesTotal),
+			Lines:      atomic.LoadInt64(&p.lines),
+			Events:     atomic.LoadInt64(&p.events),
+		}
+		if p.eachLine {
+			f.ParseFailures = p.parseFailures()
+		}
+		finished := p.finished
+		if finished.IsZero() {
+			finished = time.Now()
+		}
+		f.Seconds = finished.Sub(p.began).Seconds()
+		s.Complete = s.Complete && f.Complete
+		s.Lines += f.Lines
+		s.Events += f.Events
+		s.ParseFailures += f.ParseFailures
+		s.Files = append(s.Files, f)
+	}
+	return s
+}
+
+// writeSummary writes the summary to w as a line of JSON
+func (r *progressReporter) writeSummary(w io.Writer, responses map[int]int, sendFailures int64) error {
+	if r == nil {
+		return nil
+	}
+	return json.NewEncoder(w).Encode(r.summary(responses, sendFailures))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+// how long to wait for a config file to stop changing before reloading it
+const configSettleTime = time.Second
+
+// sampleRateSetter is implemented by parsers that sample lines themselves
+type sampleRateSetter interface {
+	SetSampleRate(rate int)
+}
+
+// reloader rebuilds the event transforms and sampling of the running
+// pipelines from a fresh copy of the options, leaving the tailers and the
+// connections to ClickHouse alone. Any other option that changes only takes
+// effect on restart.
+type reloader struct {
+	lock    sync.Mutex
+	options GlobalOptions
+	// load reads and validates the current command line and config file
+	load func() (GlobalOptions, error)
+	// tailRate is set when sampling happens while tailing
+	tailRate   *tail.SampleRate
+	parsers    []parsers.Parser
+	transforms []*liveTransforms
+}
+
+// add sets up the transforms for a new pipeline from the current options, and
+// registers them and the pipeline's parser to be updated on reload
+func (r *reloader) add(parser parsers.Parser) (*liveTransforms, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	transforms, err := newLiveTransforms(r.options)
+	if err != nil {
+		return nil, err
+	}
+	if setter, ok := parser.(sampleRateSetter); ok {
+		setter.SetSampleRate(int(r.options.SampleRate))
+	}
+	r.parsers = append(r.parsers, parser)
+	r.transforms = append(r.transforms, transforms)
+	return transforms, nil
+}
+
+// remove forgets about a pipeline that has finished
+func (r *reloader) remove(transforms *liveTransforms) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, t := range r.transforms {
+		if t == transforms {
+			r.parsers = append(r.parsers[:i], r.parsers[i+1:]...)
+			r.transforms = append(r.transforms[:i], r.transforms[i+1:]...)
+			return
+		}
+	}
+}
+
+// watch reloads the config on SIGHUP, and when the config file changes if
+// there is one, until ctx is done
+func (r *reloader) watch(ctx context.Context, configFile string) {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
+
+	var changes chan fsnotify.Event
+	var watchErrors chan error
+	if configFile != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			// watch the directory rather than the file, since editors and config
+			// management tools often replace the file instead of writing to it
+			err = watcher.Add(filepath.Dir(configFile))
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"config": configFile,
+				"err":    err,
+			}).Warn("Unable to watch the config file for changes. Send SIGHUP to reload it.")
+		} else {
+			defer watcher.Close()
+			changes = watcher.Events
+			watchErrors = watcher.Errors
+		}
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hups:
+			r.reloadAndLog("SIGHUP")
+		case change := <-changes:
+			if filepath.Clean(change.Name) == filepath.Clean(configFile) &&
+				change.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				// wait for the file to stop changing before reading it
+				settled = time.After(configSettleTime)
+			}
+		case err := <-watchErrors:
+			logrus.WithFields(logrus.Fields{"err": err}).Warn(
+				"Error watching the config file for changes")
+		case <-settled:
+			settled = nil
+			r.reloadAndLog("config file changed")
+		}
+	}
+}
+
+// reloadAndLog loads the options and applies them, logging the outcome
+func (r *reloader) reloadAndLog(trigger string) {
+	options, err := r.load()
+	if err == nil {
+		err = r.reload(options)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"trigger": trigger,
+			"err":     err,
+		}).Error("Rejected the new config, carrying on with the old one")
+		return
+	}
+	logrus.WithFields(logrus.Fields{"trigger": trigger}).Info("Reloaded config")
+}
+
+// reload applies the reloadable parts of newOptions, which must already have
+// been validated. Nothing changes if any of the new transforms fail to build.
+func (r *reloader) reload(newOptions GlobalOptions) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if newOptions.TailSample != r.options.TailSample {
+		return errors.New("turning dynamic sampling on or off requires a restart")
+	}
+	options := r.options
+	copyReloadableOptions(&options, newOptions)
+	if !reflect.DeepEqual(options, newOptions) {
+		logrus.Warn("Some of the changed options only take effect on restart")
+	}
+
+	transformers := make([]*transformer, len(r.transforms))
+	for i, live := range r.transforms {
+		t, err := newTransformer(options, live.load())
+		if err != nil {
+			return err
+		}
+		transformers[i] = t
+	}
+	for i, live := range r.transforms {
+		live.store(transformers[i])
+	}
+	if r.tailRate != nil {
+		r.tailRate.Set(options.SampleRate)
+	}
+	for _, parser := range r.parsers {
+		if setter, ok := parser.(sampleRateSetter); ok {
+			setter.SetSampleRate(int(options.SampleRate))
+		}
+	}
+	r.options = options
+	return nil
+}
+
+// copyReloadableOptions copies the options that can be changed without a
+// restart from src to dst
+func copyReloadableOptions(dst *GlobalOptions, src GlobalOptions) {
+	dst.SampleRate = src.SampleRate
+	dst.ScrubFields = src.ScrubFields
+	dst.DropFields = src.DropFields
+	dst.AddFields = src.AddFields
+	dst.RequestShape = src.RequestShape
+	dst.ShapePrefix = src.ShapePrefix
+	dst.RequestPattern = src.RequestPattern
+	dst.RequestParseQuery = src.RequestParseQuery
+	dst.RequestQueryKeys = src.RequestQueryKeys
+	dst.DynSample = src.DynSample
+	dst.DynWindowSec = src.DynWindowSec
+	dst.GoalSampleRate = src.GoalSampleRate
+	dst.MinSampleRate = src.MinSampleRate
+	dst.MaxFieldBytes = src.MaxFieldBytes
+	dst.OversizeField = src.OversizeField
+	dst.MaxEventBytes = src.MaxEventBytes
+}
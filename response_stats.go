@@ -7,6 +7,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/metrics"
 	"github.com/Altinity/libclick-go"
 )
 
@@ -82,7 +83,7 @@ func (r *responseStats) log() {
 	} else {
 		avg = 0
 	}
-	logrus.WithFields(logrus.Fields{
+	fields := logrus.Fields{
 		"count":            r.count,
 		"lifetime_count":   r.totalCount + r.count,
 		"slowest":          r.maxDuration,
@@ -91,7 +92,12 @@ func (r *responseStats) log() {
 		"count_per_status": r.statusCodes,
 		"response_bodies":  r.bodies,
 		"errors":           r.errors,
-	}).Info("Summary of sent events")
+	}
+	// include any counters kept along the way, eg for truncated fields
+	if counters := metrics.Snapshot(); len(counters) != 0 {
+		fields["counters"] = counters
+	}
+	logrus.WithFields(fields).Info("Summary of sent events")
 	if r.event != nil {
 		fields := make(map[string]interface{})
 		fields["event"] = r.event.Data
@@ -114,6 +120,18 @@ func (r *responseStats) logFinal() {
 	}).Info("Total number of events sent")
 }
 
+// totalsByStatus returns the number of responses there have been for each
+// status code, up to the last logFinal
+func (r *responseStats) totalsByStatus() map[int]int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	totals := make(map[int]int, len(r.totalStatusCodes))
+	for code, count := range r.totalStatusCodes {
+		totals[code] = count
+	}
+	return totals
+}
+
 // reset the counters to zero.
 // NOT thread safe
 func (r *responseStats) reset() {
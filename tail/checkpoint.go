@@ -0,0 +1,174 @@
+package tail
+
+import "sync"
+
+// Checkpoint keeps track of where the statefile should pick up from in a
+// file. Normally that's just past the last line passed on, but a parser that
+// builds each event out of several lines can Track the checkpoint and Commit
+// lines once they've made it into complete events, so that a restart doesn't
+// start in the middle of an event.
+type Checkpoint struct {
+	lock     sync.Mutex
+	tracking bool
+	// offset is where to pick up from
+	offset int64
+	// pending has the lines passed on since offset
+	pending []pendingLine
+	// sampled counts the pending lines that have been through the sampler
+	sampled int
+	// committed counts the lines committed so far
+	committed int64
+	// parent is set for a checkpoint from nest, which moves parent along
+	// rather than keeping an offset of its own
+	parent *Checkpoint
+	// parentLines counts the parent's lines that have been committed
+	parentLines int64
+}
+
+// pendingLine is a line that's been passed on but not committed yet
+type pendingLine struct {
+	end int64
+	// dropped is set when the line was sampled out, so the parser never saw
+	// it and it doesn't count towards its lines
+	dropped bool
+	// lines is how many of the parent's lines a nested checkpoint's line was
+	// made out of
+	lines int64
+}
+
+func newCheckpoint(offset int64) *Checkpoint {
+	return &Checkpoint{offset: offset}
+}
+
+// Track switches to only moving the checkpoint along when lines are
+// committed. It has to be called before any lines are read.
+func (c *Checkpoint) Track() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tracking = true
+}
+
+// Commit records that the first lines lines read are all part of complete
+// events. Lines dropped by sampling don't count.
+func (c *Checkpoint) Commit(lines int64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := lines - c.committed
+	i := 0
+	for ; i < len(c.pending) && n > 0; i++ {
+		if !c.pending[i].dropped {
+			n--
+			c.committed++
+		}
+	}
+	if i == 0 {
+		return
+	}
+	c.offset = c.pending[i-1].end
+	c.commitParent(c.pending[:i])
+	c.pending = c.pending[i:]
+	c.sampled -= i
+	if c.sampled < 0 {
+		c.sampled = 0
+	}
+}
+
+// nest is for a stage that makes each line it passes on out of one or more of
+// c's lines. It tracks c and returns a checkpoint for the stage's lines, which
+// commits the lines of c they were made out of as they're committed, or as
+// they're passed on if it isn't tracked itself. The stage calls sendingLines
+// and sent around each line it passes on.
+func (c *Checkpoint) nest() *Checkpoint {
+	if c == nil {
+		return nil
+	}
+	c.Track()
+	return &Checkpoint{parent: c}
+}
+
+// sendingLines records that a line made out of lines of the parent's is about
+// to be passed on
+func (c *Checkpoint) sendingLines(lines int64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending = append(c.pending, pendingLine{lines: lines})
+}
+
+// commitParent commits the parent's lines that the lines in done were made
+// out of. It's called with the lock held.
+func (c *Checkpoint) commitParent(done []pendingLine) {
+	if c.parent == nil {
+		return
+	}
+	for _, line := range done {
+		c.parentLines += line.lines
+	}
+	c.parent.Commit(c.parentLines)
+}
+
+// sending records that a line ending at end is about to be passed on. It's
+// recorded before the line is sent so it can't be committed first.
+func (c *Checkpoint) sending(end int64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending = append(c.pending, pendingLine{end: end})
+}
+
+// sent records that the line from the last call to sending was passed on
+func (c *Checkpoint) sent() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.tracking {
+		c.offset = c.pending[0].end
+		c.commitParent(c.pending[:1])
+		c.pending = c.pending[1:]
+	}
+}
+
+// sample records whether the next line through the sampler was kept. It's
+// only needed while tracking, as that's when lines are counted.
+func (c *Checkpoint) sample(kept bool) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.tracking || c.sampled >= len(c.pending) {
+		return
+	}
+	c.pending[c.sampled].dropped = !kept
+	c.sampled++
+}
+
+// get returns the offset to pick up from
+func (c *Checkpoint) get() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.offset
+}
+
+// passed returns the offset just past the last line passed on, whether it's
+// been committed or not
+func (c *Checkpoint) passed() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.pending) > 0 {
+		return c.pending[len(c.pending)-1].end
+	}
+	return c.offset
+}
@@ -0,0 +1,102 @@
+package tail
+
+import "testing"
+
+func TestCheckpoint(t *testing.T) {
+	// without tracking, it follows the lines passed on
+	c := newCheckpoint(10)
+	c.sending(15)
+	if got := c.get(); got != 10 {
+		t.Errorf("expected a line that hasn't been passed on yet not to count, got %d", got)
+	}
+	c.sent()
+	if got := c.get(); got != 15 {
+		t.Errorf("expected the end of the line passed on, got %d", got)
+	}
+
+	// with tracking, only committed lines count
+	c = newCheckpoint(10)
+	c.Track()
+	for _, end := range []int64{15, 20, 25} {
+		c.sending(end)
+		c.sent()
+	}
+	if got := c.get(); got != 10 {
+		t.Errorf("expected uncommitted lines not to count, got %d", got)
+	}
+	c.Commit(2)
+	if got := c.get(); got != 20 {
+		t.Errorf("expected the end of the second line, got %d", got)
+	}
+	// committing the same lines again changes nothing
+	c.Commit(2)
+	if got := c.get(); got != 20 {
+		t.Errorf("expected the end of the second line, got %d", got)
+	}
+	c.Commit(3)
+	if got := c.get(); got != 25 {
+		t.Errorf("expected the end of the third line, got %d", got)
+	}
+
+	// lines dropped by the sampler don't count towards those committed
+	c = newCheckpoint(0)
+	c.Track()
+	for i, end := range []int64{5, 10, 15, 20} {
+		c.sending(end)
+		c.sample(i != 1)
+		c.sent()
+	}
+	c.Commit(1)
+	if got := c.get(); got != 5 {
+		t.Errorf("expected the end of the first line, got %d", got)
+	}
+	c.Commit(2)
+	if got := c.get(); got != 15 {
+		t.Errorf("expected the end of the third line, past the dropped one, got %d", got)
+	}
+	c.Commit(3)
+	if got := c.get(); got != 20 {
+		t.Errorf("expected the end of the fourth line, got %d", got)
+	}
+
+	// a nil checkpoint can be committed to
+	var nilCheckpoint *Checkpoint
+	nilCheckpoint.Track()
+	nilCheckpoint.Commit(1)
+}
+
+func TestCheckpointStateFile(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/slow.log"
+	// the second event hasn't been finished when we stop
+	ts.writeFile(t, file, "# Time: 1\nSELECT 1;\n# Time: 2\n")
+	conf := Config{
+		Paths: []string{file},
+		Options: TailOptions{
+			ReadFrom:  "beginning",
+			StateFile: ts.tmpdir + "/slow.state",
+		},
+		StateGate: NewStateGate(),
+	}
+	sources, err := WatchEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := expectSource(t, sources, file)
+	source.Checkpoint.Track()
+	expectLine(t, source.Lines, "# Time: 1")
+	expectLine(t, source.Lines, "SELECT 1;")
+	expectLine(t, source.Lines, "# Time: 2")
+	source.Checkpoint.Commit(2)
+
+	ts.cancel()
+	checkLinesChanClosed(t, source.Lines)
+	conf.StateGate.Open()
+	state := readTestState(t, conf.Options.StateFile)
+	if state.Offset != int64(len("# Time: 1\nSELECT 1;\n")) {
+		t.Errorf("expected the statefile at the start of the second event, got %+v", state)
+	}
+}
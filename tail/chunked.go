@@ -0,0 +1,307 @@
+package tail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// backfillChunkSize is how much of a file each chunk covers when it's read by
+// several readers at once
+var backfillChunkSize int64 = 64 << 20
+
+// chunk is the part of a file made up of the lines that start from start up
+// to end. The last chunk has no end, so it reads to the end of the file.
+type chunk struct {
+	start int64
+	end   int64
+}
+
+// chunkedFile is a file being read in chunks by several readers at once, with
+// --tail.backfill_readers. Each reader is a Source of its own, so the lines
+// from different parts of the file are parsed side by side; that's only any
+// good for parsers that treat every line separately.
+type chunkedFile struct {
+	path      string
+	store     stateStore
+	chunkSize int64
+	chunks    []chunk
+
+	lock  sync.Mutex
+	state State
+	// done has the starts of the chunks that have been read
+	done map[int64]bool
+	// end is how far the last chunk got, once it's done
+	end int64
+
+	// read counts the bytes read, atomically, out of total
+	read  int64
+	total int64
+	began time.Time
+}
+
+// startChunked starts reading file in chunks, with a Source for each reader.
+// done is called once every reader has finished.
+func startChunked(ctx context.Context, conf Config, file string, store stateStore, done func()) ([]Source, error) {
+	f, err := newChunkedFile(conf, file, store)
+	if err != nil {
+		return nil, err
+	}
+	pending := make(chan chunk, len(f.chunks))
+	for _, c := range f.chunks {
+		if f.done[c.start] {
+			continue
+		}
+		pending <- c
+		if c.end < 0 {
+			f.total += f.end - c.start
+		} else {
+			f.total += c.end - c.start
+		}
+	}
+	close(pending)
+
+	numReaders := int(conf.Options.BackfillReaders)
+	if numReaders > len(pending) {
+		numReaders = len(pending)
+	}
+	if numReaders < 1 {
+		numReaders = 1
+	}
+	logrus.WithFields(logrus.Fields{
+		"file":    file,
+		"chunks":  len(pending),
+		"readers": numReaders,
+		"bytes":   f.total,
+	}).Info("Reading file in chunks")
+
+	conf.StateGate.hold()
+	wg := sync.WaitGroup{}
+	sources := make([]Source, 0, numReaders)
+	for i := 0; i < numReaders; i++ {
+		lines := make(chan Line)
+		source := Source{Path: file, Lines: lines}
+		if i == 0 {
+			source.Size = f.total
+		}
+		sources = append(sources, source)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(lines)
+			for c := range pending {
+				if !f.readChunk(ctx, conf, c, lines) {
+					return
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+	Wait:
+		for {
+			select {
+			case <-ticker.C:
+				f.write()
+			case <-finished:
+				break Wait
+			}
+		}
+		if ctx.Err() == nil {
+			logrus.WithFields(logrus.Fields{
+				"file":  file,
+				"bytes": atomic.LoadInt64(&f.read),
+				"took":  time.Since(f.began).String(),
+			}).Info("Finished reading file in chunks")
+		}
+		if done != nil {
+			done()
+		}
+		conf.StateGate.wait()
+		f.write()
+		conf.StateGate.release()
+	}()
+	return sources, nil
+}
+
+// newChunkedFile splits file into chunks, from where --tail.read_from says to
+// start. With --tail.read_from=last or --tail.resume, the chunks the
+// statefile says were already read are marked as done.
+func newChunkedFile(conf Config, file string, store stateStore) (*chunkedFile, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	f := &chunkedFile{
+		path:      file,
+		store:     store,
+		chunkSize: backfillChunkSize,
+		done:      make(map[int64]bool),
+		end:       info.Size(),
+		began:     time.Now(),
+	}
+	start := int64(0)
+	switch {
+	case conf.Options.ReadFrom == "start" || conf.Options.ReadFrom == "beginning":
+	case conf.Options.ReadFrom == "last":
+	case strings.HasPrefix(conf.Options.ReadFrom, readFromTimePrefix):
+		start, err = getTimeLocation(conf, file)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("--tail.read_from=%s can't be used to read a file in chunks", conf.Options.ReadFrom)
+	}
+	if conf.Options.ReadFrom == "last" || conf.Options.Resume {
+		state, err := store.load()
+		switch {
+		case err != nil:
+			// as when tailing, there's nothing to pick up from, so
+			// --tail.read_from=last starts at the end
+			if conf.Options.ReadFrom == "last" {
+				start = info.Size()
+			}
+		case !sameFile(state, file):
+		case state.ChunkSize == f.chunkSize && len(state.Chunks) > 0:
+			for _, done := range state.Chunks {
+				f.done[done] = true
+			}
+			logrus.WithFields(logrus.Fields{
+				"file":   file,
+				"chunks": len(state.Chunks),
+			}).Info("Resuming reading file in chunks")
+		case state.Offset > start && state.Offset <= info.Size():
+			start = state.Offset
+		}
+	}
+	for begin := start; begin < info.Size(); begin += f.chunkSize {
+		f.chunks = append(f.chunks, chunk{start: begin, end: begin + f.chunkSize})
+	}
+	if len(f.chunks) > 0 {
+		f.chunks[len(f.chunks)-1].end = -1
+	}
+	return f, nil
+}
+
+// readChunk sends the lines in c. It returns false if ctx was cancelled.
+func (f *chunkedFile) readChunk(ctx context.Context, conf Config, c chunk, lines chan Line) bool {
+	fh, err := os.Open(f.path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file": f.path,
+			"err":  err,
+		}).Error("Failed to open file to read a chunk of it")
+		return false
+	}
+	defer fh.Close()
+
+	offset := c.start
+	decoder, _ := NewDecoder(conf.Options)
+	if offset > 0 {
+		// back up a character to tell whether the chunk starts at the start
+		// of a line; if not, the line it starts in belongs to the chunk before
+		offset -= decoder.unitSize()
+	}
+	if _, err := fh.Seek(offset, io.SeekStart); err != nil {
+		return false
+	}
+	inode := inodeOfOpen(fh)
+	// lines are only numbered in the first chunk, as the number of lines
+	// before the others isn't known
+	var number int64
+	if c.start == 0 {
+		number = 1
+	}
+	records := newRecordReader(fh, decoder, conf.Options)
+	if c.start > 0 {
+		_, n, err := records.read()
+		offset += n
+		if err != nil && err != errRecordSkipped {
+			f.finish(c, offset)
+			return true
+		}
+	}
+	for c.end < 0 || offset < c.end {
+		record, n, err := records.read()
+		if hasRecord(record, err) {
+			text := records.text(record, offset == 0)
+			if pastStop(conf, text) {
+				break
+			}
+			select {
+			case lines <- Line{Text: text, Path: f.path, Inode: inode, Offset: offset, Number: number}:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if number > 0 && n > 0 {
+			number++
+		}
+		offset += n
+		atomic.AddInt64(&f.read, n)
+		if err == errRecordSkipped {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file": f.path,
+				"err":  err,
+			}).Error("Error reading file")
+			return false
+		}
+	}
+	f.finish(c, offset)
+	return true
+}
+
+// finish records that c has been read, up to offset
+func (f *chunkedFile) finish(c chunk, offset int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.done[c.start] = true
+	if c.end < 0 {
+		f.end = offset
+	}
+}
+
+// write saves the chunks that have been read to the statefile. The offset is
+// the start of the first chunk that hasn't been, so reading the file again
+// without chunks doesn't go over the start of it again.
+func (f *chunkedFile) write() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	chunks := make([]int64, 0, len(f.done))
+	for start := range f.done {
+		chunks = append(chunks, start)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i] < chunks[j] })
+	f.state.ChunkSize = f.chunkSize
+	f.state.Chunks = chunks
+	offset := f.end
+	for _, c := range f.chunks {
+		if !f.done[c.start] {
+			offset = c.start
+			break
+		}
+	}
+	setIdentity(&f.state, f.path)
+	updateStateFile(&f.state, offset, f.store)
+}
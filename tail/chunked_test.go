@@ -0,0 +1,132 @@
+package tail
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readAllSources collects the lines from all the sources, which are read at
+// the same time
+func readAllSources(t *testing.T, sources chan Source) ([]string, int) {
+	var lines []string
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	numSources := 0
+	for source := range sources {
+		numSources++
+		wg.Add(1)
+		go func(source Source) {
+			defer wg.Done()
+			for line := range source.Lines {
+				lock.Lock()
+				lines = append(lines, line.Text)
+				lock.Unlock()
+			}
+		}(source)
+	}
+	wg.Wait()
+	sort.Strings(lines)
+	return lines, numSources
+}
+
+func TestChunkedBackfill(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	defer func(size int64) { backfillChunkSize = size }(backfillChunkSize)
+	backfillChunkSize = 16
+
+	// lines of all sorts of lengths, so some cross the chunk boundaries and
+	// some chunks have no line starting in them at all
+	var expected []string
+	body := ""
+	for i := 0; i < 50; i++ {
+		line := fmt.Sprintf("%03d %s", i, strings.Repeat("x", i%40))
+		expected = append(expected, line)
+		body += line + "\n"
+	}
+	// the last line doesn't have to end in a newline
+	expected = append(expected, "last")
+	body += "last"
+	sort.Strings(expected)
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, body)
+
+	conf := Config{
+		Paths:     []string{file},
+		Options:   tailOpts,
+		StateGate: NewStateGate(),
+	}
+	conf.Options.BackfillReaders = 4
+	conf.Options.StateFile = ts.tmpdir + "/app.state"
+	sources, err := WatchEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, numSources := readAllSources(t, sources)
+	if numSources != 4 {
+		t.Errorf("expected a source for each reader, got %d", numSources)
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected each line once, got %q", lines)
+	}
+	conf.StateGate.Open()
+
+	state := readTestState(t, conf.Options.StateFile)
+	if state.Offset != int64(len(body)) || state.ChunkSize != 16 || len(state.Chunks) != (len(body)+15)/16 {
+		t.Errorf("expected every chunk to be recorded as read, got %+v", state)
+	}
+}
+
+func TestChunkedResume(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	defer func(size int64) { backfillChunkSize = size }(backfillChunkSize)
+	backfillChunkSize = 16
+
+	// two 8 byte lines to a chunk
+	body := ""
+	for i := 0; i < 8; i++ {
+		body += fmt.Sprintf("line%03d\n", i)
+	}
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, body)
+
+	conf := Config{
+		Paths:   []string{file},
+		Options: tailOpts,
+	}
+	conf.Options.ReadFrom = "beginning"
+	conf.Options.Resume = true
+	conf.Options.BackfillReaders = 2
+	conf.Options.StateFile = ts.tmpdir + "/app.state"
+	// the first and third chunks were read by an earlier run
+	state := State{ChunkSize: 16, Chunks: []int64{0, 32}}
+	setIdentity(&state, file)
+	writeTestState(t, conf.Options.StateFile, state)
+
+	sources, err := WatchEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, _ := readAllSources(t, sources)
+	expected := []string{"line002", "line003", "line006", "line007"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected only the chunks that weren't read before, got %q", lines)
+	}
+
+	// without --tail.resume, it starts again
+	conf.Options.Resume = false
+	sources, err = WatchEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines, _ := readAllSources(t, sources); len(lines) != 8 {
+		t.Errorf("expected the whole file to be read again, got %q", lines)
+	}
+}
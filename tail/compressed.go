@@ -0,0 +1,329 @@
+package tail
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// compression formats that can be read from
+const (
+	compressionGzip  = "gzip"
+	compressionBzip2 = "bzip2"
+	compressionZstd  = "zstd"
+	compressionXz    = "xz"
+)
+
+var compressionExtensions = map[string]string{
+	".gz":  compressionGzip,
+	".bz2": compressionBzip2,
+	".zst": compressionZstd,
+	".xz":  compressionXz,
+}
+
+var compressionMagic = []struct {
+	magic       []byte
+	compression string
+}{
+	{[]byte{0x1f, 0x8b}, compressionGzip},
+	{[]byte("BZh"), compressionBzip2},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, compressionZstd},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, compressionXz},
+}
+
+// zstd and xz aren't in the standard library, so they're read by running
+// these commands
+var decompressCommands = map[string]string{
+	compressionZstd: "zstd",
+	compressionXz:   "xz",
+}
+
+// compressedGroup is the compressed files matching one --file, which are read
+// one after another rather than tailed
+type compressedGroup struct {
+	path  string
+	files []string
+}
+
+// compressedToRead returns the groups to read. Compressed files aren't written
+// to, so there's nothing to follow, and they're only read with --tail.stop.
+func compressedToRead(conf Config, groups []compressedGroup) []compressedGroup {
+	if conf.Options.Stop || len(groups) == 0 {
+		return groups
+	}
+	for _, group := range groups {
+		logrus.WithFields(logrus.Fields{
+			"file":  group.path,
+			"files": group.files,
+		}).Warn("Skipping compressed files, which are only read with --tail.stop or --backfill")
+	}
+	return nil
+}
+
+// startCompressed starts reading each group of compressed files
+func startCompressed(ctx context.Context, conf Config, groups []compressedGroup, numFiles int) []Source {
+	sources := make([]Source, 0, len(groups))
+	for _, group := range groups {
+		store := getStateStore(conf, group.path, timestampedStateFileName(group.path), numFiles)
+		lines := tailCompressedFiles(ctx, conf, group, store)
+		sources = append(sources, Source{Path: group.path, Lines: lines})
+	}
+	return sources
+}
+
+// compressionOf returns the compression format of file, going by its
+// extension or failing that, its first few bytes. It returns "" for files that
+// aren't compressed.
+func compressionOf(file string) string {
+	if compression, ok := compressionExtensions[filepath.Ext(file)]; ok {
+		return compression
+	}
+	fh, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer fh.Close()
+	head := make([]byte, 6)
+	n, _ := io.ReadFull(fh, head)
+	head = head[:n]
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	return ""
+}
+
+// sortCompressed puts files in the order they should be read, oldest first
+// unless --tail.compressed_order is name
+func sortCompressed(conf Config, files []string) {
+	sort.Strings(files)
+	if conf.Options.CompressedOrder == "name" {
+		return
+	}
+	mtimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			mtimes[file] = info.ModTime()
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return mtimes[files[i]].Before(mtimes[files[j]])
+	})
+}
+
+// readCloser glues a reader to whatever needs to be done to close it
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
+
+// openCompressed returns a reader for the decompressed contents of file
+func openCompressed(file string, compression string) (io.ReadCloser, error) {
+	if command, ok := decompressCommands[compression]; ok {
+		cmd := exec.Command(command, "-dc", file)
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("reading %s files needs the %s command: %s", compression, command, err)
+		}
+		return readCloser{out, func() error {
+			// stop it early if we didn't read everything
+			out.Close()
+			if err := cmd.Wait(); err != nil {
+				return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+			}
+			return nil
+		}}, nil
+	}
+
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case compressionGzip:
+		gz, err := gzip.NewReader(fh)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		return readCloser{gz, func() error {
+			gz.Close()
+			return fh.Close()
+		}}, nil
+	case compressionBzip2:
+		return readCloser{bzip2.NewReader(fh), fh.Close}, nil
+	}
+	fh.Close()
+	return nil, fmt.Errorf("unknown compression %s", compression)
+}
+
+// tailCompressedFiles reads each of the files in group in turn. The statefile
+// records the file and the offset in its decompressed contents, so an
+// interrupted read can carry on where it stopped with --tail.read_from=last or
+// --tail.resume.
+func tailCompressedFiles(ctx context.Context, conf Config, group compressedGroup, store stateStore) chan Line {
+	first, offset := compressedStart(conf, group.files, store)
+
+	pos := &sequencePosition{}
+	// the periodic writes have to stop before the final one
+	stopTicker := everySecond(func() { pos.write(store) })
+
+	// the same window carries on from one file to the next
+	window := newTimeWindow(conf)
+	lines := make(chan Line)
+	conf.StateGate.hold()
+	go func() {
+		defer func() {
+			close(lines)
+			stopTicker()
+			conf.StateGate.wait()
+			pos.write(store)
+			conf.StateGate.release()
+		}()
+		for _, file := range group.files[first:] {
+			pos.start(file, offset)
+			if !readCompressedFile(ctx, file, offset, pos, window, conf.Options, lines) {
+				return
+			}
+			offset = 0
+		}
+	}()
+	return lines
+}
+
+// compressedStart returns the index of the file to start with and the offset
+// in its decompressed contents. Without a statefile to go by, that's the
+// beginning of the first file.
+func compressedStart(conf Config, files []string, store stateStore) (int, int64) {
+	if conf.Options.ReadFrom != "last" && !conf.Options.Resume {
+		return 0, 0
+	}
+	state, err := store.load()
+	if err != nil || state.File == "" {
+		return 0, 0
+	}
+	for i, file := range files {
+		if file != state.File {
+			continue
+		}
+		if !sameFile(state, file) {
+			// a different file by the same name
+			return i, 0
+		}
+		logrus.WithFields(logrus.Fields{
+			"file":   file,
+			"offset": state.Offset,
+		}).Info("Resuming reading compressed files")
+		return i, state.Offset
+	}
+	return 0, 0
+}
+
+// readCompressedFile sends the lines in file that are in window, split up and
+// decoded the way opts say, skipping the first offset bytes of its
+// decompressed contents. It returns false if ctx was cancelled or the end of
+// the window was reached.
+func readCompressedFile(ctx context.Context, file string, offset int64,
+	pos *sequencePosition, window *timeWindow, opts TailOptions, lines chan Line) bool {
+	compression := compressionOf(file)
+	logrus.WithFields(logrus.Fields{
+		"file":        file,
+		"compression": compression,
+	}).Debug("Reading compressed file")
+	rc, err := openCompressed(file, compression)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file": file,
+			"err":  err,
+		}).Error("Failed to open compressed file, skipping it")
+		return true
+	}
+	defer func() {
+		if err := rc.Close(); err != nil && ctx.Err() == nil {
+			logrus.WithFields(logrus.Fields{
+				"file": file,
+				"err":  err,
+			}).Error("Error reading compressed file")
+		}
+	}()
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, rc, offset); err != nil {
+			// read it all last time
+			return true
+		}
+	}
+	inode := inodeOf(file)
+	// lines are numbered when reading starts at the beginning of the file
+	var number int64
+	if offset == 0 {
+		number = 1
+	}
+	decoder, _ := NewDecoder(opts)
+	records := newRecordReader(rc, decoder, opts)
+	for {
+		record, n, err := records.read()
+		start := offset
+		offset += n
+		if hasRecord(record, err) {
+			text := records.text(record, start == 0)
+			send, done := window.check(text)
+			if done {
+				logrus.WithFields(logrus.Fields{
+					"file":    file,
+					"stop_at": window.conf.StopAt,
+				}).Info("Reached --stop_at, done reading compressed files")
+				return false
+			}
+			if !send {
+				pos.advance(n)
+			} else {
+				select {
+				case lines <- Line{Text: text, Path: file, Inode: inode, Offset: start, Number: number}:
+					pos.advance(n)
+				case <-ctx.Done():
+					return false
+				}
+			}
+		} else {
+			pos.advance(n)
+		}
+		if number > 0 && n > 0 {
+			number++
+		}
+		if err == errRecordSkipped {
+			continue
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file": file,
+				"err":  err,
+			}).Error("Error reading compressed file, moving on")
+			return true
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package tail
+
+import (
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestCompressedBackfill(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	// the oldest file is read first, whatever it's called; the last one has no
+	// extension, so it has to be recognised by its contents
+	base := ts.tmpdir + "/app.log"
+	writeGzip(t, base+".1.gz", "c\nd\n")
+	writeGzip(t, base+".2.gz", "a\nb")
+	writeGzip(t, base+".0", "e\n")
+	now := time.Now()
+	for i, file := range []string{base + ".2.gz", base + ".1.gz", base + ".0"} {
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := Config{
+		Paths:     []string{base + ".*"},
+		Options:   tailOpts,
+		StateGate: NewStateGate(),
+	}
+	conf.Options.StateFile = ts.tmpdir
+	chans, err := watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chans) != 1 {
+		t.Fatalf("expected one lines channel for the compressed files, got %d", len(chans))
+	}
+	checkLinesChan(t, chans[0], []string{"a", "b", "c", "d", "e"})
+	conf.StateGate.Open()
+
+	state := readTestState(t, ts.tmpdir+"/app.log._.leash.state")
+	if state.File != base+".0" || state.Offset != 2 {
+		t.Errorf("expected the statefile to be at the end of the last file, got %+v", state)
+	}
+
+	// by name, the file without an extension comes first
+	conf.Options.CompressedOrder = "name"
+	conf.StateGate = nil
+	chans, err = watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{"e", "c", "d", "a", "b"})
+}
+
+func TestCompressedResume(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	first := ts.tmpdir + "/app.log.1.gz"
+	second := ts.tmpdir + "/app.log.2.gz"
+	writeGzip(t, first, "a\n")
+	writeGzip(t, second, "b\nc\n")
+	conf := Config{
+		Paths:   []string{ts.tmpdir + "/app.log.*.gz"},
+		Options: tailOpts,
+	}
+	conf.Options.CompressedOrder = "name"
+	conf.Options.StateFile = ts.tmpdir + "/app.state"
+	conf.Options.ReadFrom = "beginning"
+	// as if the last run stopped after the first line of the second file
+	state := State{Offset: 2, File: second}
+	setIdentity(&state, second)
+	writeTestState(t, conf.Options.StateFile, state)
+
+	// the statefile is ignored unless asked to resume
+	conf.StateGate = NewStateGate()
+	chans, err := watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{"a", "b", "c"})
+	conf.StateGate.Open()
+
+	writeTestState(t, conf.Options.StateFile, state)
+	conf.Options.Resume = true
+	conf.StateGate = nil
+	chans, err = watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{"c"})
+}
+
+func TestCompressedCommands(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	for _, command := range []string{"bzip2", "xz", "zstd"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Logf("%s not installed, skipping it", command)
+			continue
+		}
+		plain := ts.tmpdir + "/" + command + ".log"
+		ts.writeFile(t, plain, "one\ntwo\n")
+		if err := exec.Command(command, "-q", plain).Run(); err != nil {
+			t.Fatalf("failed to compress with %s: %s", command, err)
+		}
+		conf := Config{
+			Paths:   []string{plain + ".*"},
+			Options: tailOpts,
+		}
+		conf.Options.StateFile = ts.tmpdir
+		chans, err := watchLines(t, ts.ctx, conf, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLinesChan(t, chans[0], []string{"one", "two"})
+	}
+}
+
+func TestCompressedSkippedWhenFollowing(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	writeGzip(t, ts.tmpdir+"/app.log.1.gz", "a\n")
+	conf := Config{
+		Paths:   []string{ts.tmpdir + "/app.log*"},
+		Options: TailOptions{ReadFrom: "beginning"},
+	}
+	if _, err := watchLines(t, ts.ctx, conf, 1); err == nil {
+		t.Error("expected an error when the only files are compressed and --tail.stop isn't set")
+	}
+}
+
+func writeGzip(t *testing.T, path string, body string) {
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	gz := gzip.NewWriter(fh)
+	gz.Write([]byte(body))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestState(t *testing.T, stateFile string, state State) {
+	store := &stateFileStore{path: stateFile}
+	store.save(state)
+	if store.warned {
+		t.Fatalf("failed to write %s", stateFile)
+	}
+}
@@ -0,0 +1,202 @@
+package tail
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+// ContainerOptions set how lines written by a container runtime are unwrapped
+// before they're parsed
+type ContainerOptions struct {
+	Format string `long:"format" description:"Unwrap the lines of container logs, like /var/log/containers/*.log, before they're parsed, and add fields for the pod and container from the file's path. Values: docker for Docker's json-file format, cri for the CRI format Kubernetes writes, auto to tell them apart line by line"`
+}
+
+// ContainerTimeField is the field the container runtime's time for a line is
+// put in, for it to be used as the time of the event
+const ContainerTimeField = "_container_time"
+
+// containerFields are the fields added to each line of a container log
+var containerFields = NewHeader("namespace", "pod_name", "pod_uid", "container_name", "container_id", "stream", ContainerTimeField)
+
+var (
+	// /var/log/pods/<namespace>_<pod>_<uid>/<container>/<restarts>.log, which
+	// may have had a date added when it was rotated
+	podLogPath = regexp.MustCompile(`/([^/_]+)_([^/_]+)_([^/_]+)/([^/]+)/\d+\.log(\.[^/]*)?$`)
+	// /var/log/containers/<pod>_<namespace>_<container>-<id>.log, a link to
+	// the one in /var/log/pods
+	containerLogPath = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-([0-9a-f]{64})\.log$`)
+)
+
+// Unwrapper takes the lines of container logs out of the format the container
+// runtime wrote them in, joining up the lines it split. A nil Unwrapper
+// leaves lines as they are.
+type Unwrapper struct {
+	format string
+}
+
+// containerLine is a line of a container log, once it's been unwrapped
+type containerLine struct {
+	time    string
+	stream  string
+	partial bool
+	text    string
+}
+
+// NewUnwrapper returns an Unwrapper for opts, or nil if they don't ask for
+// container logs to be unwrapped
+func NewUnwrapper(opts ContainerOptions) (*Unwrapper, error) {
+	switch opts.Format {
+	case "":
+		return nil, nil
+	case "docker", "cri", "auto":
+		return &Unwrapper{format: opts.Format}, nil
+	}
+	return nil, fmt.Errorf("--container.format %s isn't docker, cri or auto", opts.Format)
+}
+
+// Unwrap returns a Source with the lines in source unwrapped, and fields for
+// the pod and container in their Header. Lines joined back up keep the
+// position of the first part. Sources from inputs other than
+// files, which have a Header of their own, are left as they are.
+func (u *Unwrapper) Unwrap(source Source) Source {
+	if u == nil || source.Header != "" {
+		return source
+	}
+	checkpoint := source.Checkpoint.nest()
+	unwrapped := make(chan Line)
+	go u.unwrap(source.Lines, unwrapped, containerPathFields(source.Path), checkpoint)
+	source.Lines = unwrapped
+	source.Checkpoint = checkpoint
+	source.Header = containerFields.Regex()
+	return source
+}
+
+func (u *Unwrapper) unwrap(lines chan Line, unwrapped chan Line, pathFields []string, checkpoint *Checkpoint) {
+	defer close(unwrapped)
+	send := func(read Line, line containerLine, n int64) {
+		values := append(append([]string{}, pathFields...), line.stream, line.time)
+		read.Text = containerFields.Add(values, line.text)
+		checkpoint.sendingLines(n)
+		unwrapped <- read
+		checkpoint.sent()
+	}
+	// the parts of a line the runtime split up, until the last one turns up
+	var parts []string
+	var first containerLine
+	var firstRead Line
+	flush := func() {
+		if len(parts) > 0 {
+			first.text = strings.Join(parts, "")
+			send(firstRead, first, int64(len(parts)))
+			parts = parts[:0]
+		}
+	}
+	for read := range lines {
+		line, ok := u.parse(read.Text)
+		if !ok {
+			flush()
+			metrics.Increment("container_lines_unparsed")
+			send(read, containerLine{text: read.Text}, 1)
+			continue
+		}
+		// lines from stdout and stderr aren't joined to each other
+		if len(parts) > 0 && line.stream != first.stream {
+			flush()
+		}
+		if len(parts) == 0 {
+			first = line
+			firstRead = read
+		}
+		parts = append(parts, line.text)
+		if !line.partial {
+			flush()
+		}
+	}
+	flush()
+}
+
+func (u *Unwrapper) parse(text string) (containerLine, bool) {
+	switch u.format {
+	case "docker":
+		return parseDockerLine(text)
+	case "cri":
+		return parseCRILine(text)
+	}
+	if strings.HasPrefix(text, "{") {
+		return parseDockerLine(text)
+	}
+	return parseCRILine(text)
+}
+
+// parseDockerLine unwraps a line in Docker's json-file format, like
+// {"log":"message\n","stream":"stdout","time":"2017-10-16T09:00:00.000000000Z"}.
+// Lines without a newline at the end are the first parts of longer ones.
+func parseDockerLine(text string) (containerLine, bool) {
+	var wrapped struct {
+		Log    *string `json:"log"`
+		Stream string  `json:"stream"`
+		Time   string  `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(text), &wrapped); err != nil || wrapped.Log == nil {
+		return containerLine{}, false
+	}
+	line := containerLine{time: wrapped.Time, stream: wrapped.Stream}
+	line.text = strings.TrimSuffix(*wrapped.Log, "\n")
+	line.partial = line.text == *wrapped.Log
+	return line, true
+}
+
+// parseCRILine unwraps a line in the CRI format, like
+// 2017-10-16T09:00:00.000000000Z stdout F message. A tag of P rather than F
+// marks the first parts of longer lines.
+func parseCRILine(text string) (containerLine, bool) {
+	fields := strings.SplitN(text, " ", 4)
+	if len(fields) < 3 {
+		return containerLine{}, false
+	}
+	if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+		return containerLine{}, false
+	}
+	line := containerLine{time: fields[0], stream: fields[1]}
+	// more tags may follow, separated by colons
+	switch strings.SplitN(fields[2], ":", 2)[0] {
+	case "P":
+		line.partial = true
+	case "F":
+	default:
+		return containerLine{}, false
+	}
+	if len(fields) == 4 {
+		line.text = fields[3]
+	}
+	return line, true
+}
+
+// containerPathFields returns the namespace, pod name, pod UID, container
+// name and container ID found in a container log's path, where they're known
+func containerPathFields(path string) []string {
+	if m := podLogPath.FindStringSubmatch(filepath.ToSlash(path)); m != nil {
+		return []string{m[1], m[2], m[3], m[4], ""}
+	}
+	if m := containerLogPath.FindStringSubmatch(filepath.Base(path)); m != nil {
+		return []string{m[2], m[1], "", m[3], m[4]}
+	}
+	return []string{"", "", "", "", ""}
+}
+
+// LineTimestamp returns the time the container runtime gave a line
+// of a container log, as it was written
+func (u *Unwrapper) LineTimestamp(text string) (time.Time, bool) {
+	line, ok := u.parse(text)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, line.time)
+	return t, err == nil
+}
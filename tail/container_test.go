@@ -0,0 +1,187 @@
+package tail
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// unwrapped takes apart a line from an Unwrapper into its fields and text
+func unwrapped(t *testing.T, line string) (map[string]string, string) {
+	regex := regexp.MustCompile(containerFields.Regex())
+	match := regex.FindStringSubmatch(line)
+	if match == nil {
+		t.Fatalf("expected a header on %q", line)
+	}
+	fields := make(map[string]string)
+	for i, name := range regex.SubexpNames() {
+		if name != "" {
+			fields[name] = match[i]
+		}
+	}
+	return fields, line[len(match[0]):]
+}
+
+func TestUnwrap(t *testing.T) {
+	tests := []struct {
+		format string
+		lines  []string
+		texts  []string
+		times  []string
+	}{
+		{
+			format: "docker",
+			lines: []string{
+				`{"log":"one\n","stream":"stdout","time":"2017-10-16T09:00:00.000000001Z"}`,
+				`{"log":"tw","stream":"stdout","time":"2017-10-16T09:00:00.000000002Z"}`,
+				`{"log":"o\n","stream":"stdout","time":"2017-10-16T09:00:00.000000003Z"}`,
+				`not json`,
+			},
+			texts: []string{"one", "two", "not json"},
+			times: []string{"2017-10-16T09:00:00.000000001Z", "2017-10-16T09:00:00.000000002Z", ""},
+		},
+		{
+			format: "cri",
+			lines: []string{
+				"2017-10-16T09:00:00.000000001Z stdout F one",
+				"2017-10-16T09:00:00.000000002Z stdout P t",
+				"2017-10-16T09:00:00.000000003Z stdout P w",
+				"2017-10-16T09:00:00.000000004Z stdout F o",
+				"2017-10-16T09:00:00.000000005Z stderr F",
+			},
+			texts: []string{"one", "two", ""},
+			times: []string{"2017-10-16T09:00:00.000000001Z", "2017-10-16T09:00:00.000000002Z", "2017-10-16T09:00:00.000000005Z"},
+		},
+		{
+			// a partial line is passed on by itself when the stream changes
+			// or the input ends
+			format: "auto",
+			lines: []string{
+				"2017-10-16T09:00:00.000000001Z stdout P out",
+				`{"log":"err\n","stream":"stderr","time":"2017-10-16T09:00:00.000000002Z"}`,
+				"2017-10-16T09:00:00.000000003Z stdout P last",
+			},
+			texts: []string{"out", "err", "last"},
+			times: []string{"2017-10-16T09:00:00.000000001Z", "2017-10-16T09:00:00.000000002Z", "2017-10-16T09:00:00.000000003Z"},
+		},
+	}
+	for _, test := range tests {
+		u, err := NewUnwrapper(ContainerOptions{Format: test.format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := make(chan Line, len(test.lines))
+		for _, line := range test.lines {
+			in <- Line{Text: line}
+		}
+		close(in)
+		source := u.Unwrap(Source{Path: "/var/log/app.log", Lines: in})
+		var texts, times []string
+		for line := range source.Lines {
+			fields, text := unwrapped(t, line.Text)
+			texts = append(texts, text)
+			times = append(times, fields[ContainerTimeField])
+		}
+		if !reflect.DeepEqual(texts, test.texts) {
+			t.Errorf("%s: expected lines %q, got %q", test.format, test.texts, texts)
+		}
+		if !reflect.DeepEqual(times, test.times) {
+			t.Errorf("%s: expected times %q, got %q", test.format, test.times, times)
+		}
+	}
+
+	if _, err := NewUnwrapper(ContainerOptions{Format: "rkt"}); err == nil {
+		t.Error("expected an unknown format to be an error")
+	}
+	// sources with a header of their own are left alone, as is everything
+	// when there's no format
+	u, _ := NewUnwrapper(ContainerOptions{Format: "cri"})
+	if source := u.Unwrap(Source{Header: "^x"}); source.Header != "^x" {
+		t.Error("expected a source with a header to be left alone")
+	}
+	var none *Unwrapper
+	if source := none.Unwrap(Source{Path: "a"}); source.Header != "" {
+		t.Error("expected a nil Unwrapper to leave the source alone")
+	}
+}
+
+func TestContainerPathFields(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"/var/log/pods/default_web-5d8f_8a1b-2c3d/nginx/0.log", []string{"default", "web-5d8f", "8a1b-2c3d", "nginx", ""}},
+		{"/var/log/pods/default_web-5d8f_8a1b-2c3d/nginx/1.log.20171016-090000", []string{"default", "web-5d8f", "8a1b-2c3d", "nginx", ""}},
+		{"/var/log/containers/web-5d8f_default_nginx-proxy-" + id + ".log", []string{"default", "web-5d8f", "", "nginx-proxy", id}},
+		{"/var/log/app.log", []string{"", "", "", "", ""}},
+	}
+	for _, test := range tests {
+		if got := containerPathFields(test.path); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.path, test.expected, got)
+		}
+	}
+}
+
+func TestUnwrapCheckpoint(t *testing.T) {
+	u, _ := NewUnwrapper(ContainerOptions{Format: "cri"})
+	checkpoint := newCheckpoint(0)
+	in := make(chan Line)
+	source := u.Unwrap(Source{Lines: in, Checkpoint: checkpoint})
+	// a parser that builds events out of several lines tracks the unwrapped
+	// lines' checkpoint
+	source.Checkpoint.Track()
+	lines := []string{
+		"2017-10-16T09:00:00Z stdout P a",
+		"2017-10-16T09:00:00Z stdout F b",
+		"2017-10-16T09:00:00Z stdout F c",
+	}
+	go func() {
+		end := int64(0)
+		for i, line := range lines {
+			start := end
+			end += int64(len(line)) + 1
+			checkpoint.sending(end)
+			in <- Line{Text: line, Offset: start, Number: int64(i + 1)}
+			checkpoint.sent()
+		}
+		close(in)
+	}()
+	// a line joined back up has the position of its first part
+	var numbers []int64
+	for line := range source.Lines {
+		numbers = append(numbers, line.Number)
+	}
+	if !reflect.DeepEqual(numbers, []int64{1, 3}) {
+		t.Errorf("expected the unwrapped lines to start at lines 1 and 3, got %v", numbers)
+	}
+	if offset := checkpoint.get(); offset != 0 {
+		t.Errorf("expected nothing committed yet, got %d", offset)
+	}
+	// the first unwrapped line was made out of the first two in the file
+	source.Checkpoint.Commit(1)
+	if offset := checkpoint.get(); offset != 64 {
+		t.Errorf("expected the checkpoint at the end of the second line, got %d", offset)
+	}
+	source.Checkpoint.Commit(2)
+	if offset := checkpoint.get(); offset != 96 {
+		t.Errorf("expected the checkpoint at the end of the file, got %d", offset)
+	}
+
+	// untracked, the file's checkpoint follows the lines passed on
+	checkpoint = newCheckpoint(0)
+	in = make(chan Line, 1)
+	source = u.Unwrap(Source{Lines: in, Checkpoint: checkpoint})
+	checkpoint.sending(32)
+	in <- Line{Text: lines[2]}
+	checkpoint.sent()
+	<-source.Lines
+	for i := 0; i < 100 && checkpoint.get() != 32; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if offset := checkpoint.get(); offset != 32 {
+		t.Errorf("expected the checkpoint at the end of the line, got %d", offset)
+	}
+	close(in)
+}
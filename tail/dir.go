@@ -0,0 +1,212 @@
+package tail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// DirOptions set which files are tailed in the directories given with --dir,
+// and for how long
+type DirOptions struct {
+	Include        []string `long:"include" description:"Only tail the files in --dir matching this glob, relative to the directory, like **/*.log. ** matches any number of directories, and a glob without a / matches the file's name in any directory. Use this flag multiple times for more than one. Defaults to every file"`
+	Exclude        []string `long:"exclude" description:"Leave out the files and directories in --dir matching this glob, like *.gz. Takes the same globs as --dir.include, and wins over it"`
+	FollowSymlinks bool     `long:"follow_symlinks" description:"Follow symbolic links to files and directories in --dir, like those in /var/log/containers. Links leading back to a directory that's already been walked, and second links to the same file, are skipped. Without this, links are left out"`
+	IdleTimeout    uint     `long:"idle_timeout" description:"Stop tailing files in --dir that haven't been written to for this many seconds, once they've been read to the end, and carry on from there if they're written to again. It's checked every --tail.rescan_interval. 0 keeps tailing them"`
+}
+
+// DirFilter picks out the files to tail in the directories given with --dir
+type DirFilter struct {
+	include []string
+	exclude []string
+	follow  bool
+}
+
+// NewDirFilter returns a DirFilter for the globs in opts, which have to be
+// valid
+func NewDirFilter(opts DirOptions) (*DirFilter, error) {
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("--dir.include or --dir.exclude %s isn't a valid glob: %s", pattern, err)
+		}
+	}
+	return &DirFilter{
+		include: opts.Include,
+		exclude: opts.Exclude,
+		follow:  opts.FollowSymlinks,
+	}, nil
+}
+
+// fileID identifies a file or directory, wherever it's linked from
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// dirWalk finds the files to tail in one or more directories
+type dirWalk struct {
+	filter *DirFilter
+	// visited has the directories walked and the files found so far, so
+	// that symlinks don't lead round in circles or to the same file twice
+	visited map[fileID]bool
+	files   []string
+}
+
+func (d *DirFilter) newWalk() *dirWalk {
+	return &dirWalk{filter: d, visited: make(map[fileID]bool)}
+}
+
+// walk adds the files under dir that are let through by the filter. rel is
+// dir's path from the top of the walk. A directory that's gone is skipped,
+// the same as a glob that doesn't match anything.
+func (w *dirWalk) walk(dir, rel string) {
+	if w.seen(dir) {
+		logrus.WithFields(logrus.Fields{
+			"dir": dir,
+		}).Debug("Skipping directory that's already been walked, through another symlink")
+		return
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithFields(logrus.Fields{
+				"dir": dir,
+				"err": err,
+			}).Warn("Failed to look for files in directory")
+		}
+		return
+	}
+	for _, entry := range entries {
+		file := filepath.Join(dir, entry.Name())
+		name := path.Join(rel, entry.Name())
+		mode := entry.Mode()
+		if mode&os.ModeSymlink != 0 {
+			if !w.filter.follow {
+				continue
+			}
+			info, err := os.Stat(file)
+			if err != nil {
+				// the link is broken
+				continue
+			}
+			mode = info.Mode()
+		}
+		switch {
+		case mode.IsDir():
+			if !matchAny(w.filter.exclude, name) {
+				w.walk(file, name)
+			}
+		case mode.IsRegular():
+			if w.filter.matches(name) && !w.seen(file) {
+				w.files = append(w.files, file)
+			}
+		}
+	}
+}
+
+// seen reports whether file, which may be a directory, has been come across
+// before, and if not, remembers it
+func (w *dirWalk) seen(file string) bool {
+	id, ok := fileIDOf(file)
+	if !ok {
+		return false
+	}
+	if w.visited[id] {
+		return true
+	}
+	w.visited[id] = true
+	return false
+}
+
+// fileIDOf returns the device and inode number of file, which may be a
+// directory, or false if it can't be found
+func fileIDOf(file string) (fileID, bool) {
+	stat := unix.Stat_t{}
+	if err := unix.Stat(file, &stat); err != nil {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, true
+}
+
+// matches reports whether a file, by its path from the top of the walk, is
+// to be tailed
+func (d *DirFilter) matches(name string) bool {
+	if matchAny(d.exclude, name) {
+		return false
+	}
+	return len(d.include) == 0 || matchAny(d.include, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether name, a path with / between its parts, matches
+// pattern. A pattern without a / only has to match the last part.
+func matchGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchParts matches the parts of a path against those of a pattern, where
+// a part that's ** matches any number of parts, including none
+func matchParts(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchParts(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// inDirs reports whether file is in one of dirs, or under it
+func inDirs(dirs []string, file string) bool {
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, file)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+// stateFileName returns the name file's statefile is named after. Files in
+// the --dir directories go by their whole path, as files in different
+// directories often have the same name, like the 0.log of each container in
+// /var/log/pods. It's escaped so that no two paths end up with the same name.
+func stateFileName(conf Config, file string) string {
+	if inDirs(conf.Dirs, file) {
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+		return url.PathEscape(strings.TrimPrefix(file, "/"))
+	}
+	return file
+}
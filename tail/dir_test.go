@@ -0,0 +1,189 @@
+package tail
+
+import (
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*.log", "app.log", true},
+		{"*.log", "a/b/app.log", true},
+		{"*.gz", "a/app.log", false},
+		{"**/*.log", "app.log", true},
+		{"**/*.log", "a/b/app.log", true},
+		{"**/*.log", "a/b/app.log.1", false},
+		{"a/*.log", "a/app.log", true},
+		{"a/*.log", "a/b/app.log", false},
+		{"a/**", "a", true},
+		{"a/**", "a/b/app.log", true},
+		{"a/**/app.log", "a/app.log", true},
+		{"a/**/app.log", "b/a/app.log", false},
+		{"*/b/*.log", "a/b/app.log", true},
+	}
+	for _, test := range tests {
+		if got := matchGlob(test.pattern, test.name); got != test.expected {
+			t.Errorf("expected %q matching %q to be %v, got %v", test.pattern, test.name, test.expected, got)
+		}
+	}
+	if _, err := NewDirFilter(DirOptions{Exclude: []string{"a/[b"}}); err == nil {
+		t.Error("expected a bad glob to be an error")
+	}
+}
+
+func TestExpandDirs(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	dir := ts.tmpdir + "/logs"
+	for _, sub := range []string{"/app", "/old", "/pods/web"} {
+		if err := os.MkdirAll(dir+sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts.writeFile(t, dir+"/app/app.log", "a\n")
+	ts.writeFile(t, dir+"/app/app.log.1.gz", "")
+	ts.writeFile(t, dir+"/old/app.log", "o\n")
+	ts.writeFile(t, dir+"/pods/web/0.log", "w\n")
+	ts.writeFile(t, dir+"/top.log", "t\n")
+	ts.writeFile(t, dir+"/notes.txt", "n\n")
+	for link, target := range map[string]string{
+		// a link back up the tree, another to a file that's found anyway,
+		// and one that's broken
+		"/app/loop":        dir,
+		"/web.log":         dir + "/pods/web/0.log",
+		"/missing.log":     dir + "/nothing",
+		"/pods/web/up.log": "../../top.log",
+	} {
+		if err := os.Symlink(target, dir+link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := Config{
+		Dirs: []string{dir},
+		Dir: DirOptions{
+			Include: []string{"**/*.log", "*.gz"},
+			Exclude: []string{"old"},
+		},
+	}
+	filenames, groups, err := expandPaths(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// links are left out unless they're followed
+	expected := []string{dir + "/app/app.log", dir + "/pods/web/0.log", dir + "/top.log"}
+	if !reflect.DeepEqual(filenames, expected) {
+		t.Errorf("expected %q, got %q", expected, filenames)
+	}
+	if len(groups) != 1 || groups[0].path != dir || !reflect.DeepEqual(groups[0].files, []string{dir + "/app/app.log.1.gz"}) {
+		t.Errorf("expected the compressed file in a group for the directory, got %+v", groups)
+	}
+
+	// each file is only found once, through whichever link comes first
+	conf.Dir.FollowSymlinks = true
+	conf.Dir.Exclude = append(conf.Dir.Exclude, "*.gz")
+	filenames, _, err = expandPaths(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{dir + "/app/app.log", dir + "/pods/web/0.log", dir + "/pods/web/up.log"}
+	if !reflect.DeepEqual(filenames, expected) {
+		t.Errorf("expected %q following links, got %q", expected, filenames)
+	}
+}
+
+func TestStateFileName(t *testing.T) {
+	conf := Config{Dirs: []string{"/logs/a", "/logs/b", "/logs/c"}}
+	// the same path in different directories, and paths that would be the
+	// same with / swapped for _, each get their own name
+	files := []string{"/logs/a/x.log", "/logs/b/x.log", "/logs/c/d/e_f.log", "/logs/c/d_e/f.log"}
+	names := make(map[string]string)
+	for _, file := range files {
+		name := stateFileName(conf, file)
+		if other, ok := names[name]; ok {
+			t.Errorf("expected %s and %s to have different statefile names, both got %s", other, file, name)
+		}
+		names[name] = file
+	}
+	if name := stateFileName(conf, "/var/log/x.log"); name != "/var/log/x.log" {
+		t.Errorf("expected a file outside the directories to go by its path, got %s", name)
+	}
+}
+
+func TestWatchDirIdleTimeout(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/logs/web/app.log"
+	if err := os.MkdirAll(ts.tmpdir+"/logs/web", 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{
+		Dirs: []string{ts.tmpdir + "/logs"},
+		Dir:  DirOptions{IdleTimeout: 60},
+		Options: TailOptions{
+			ReadFrom:       "beginning",
+			StateFile:      ts.tmpdir,
+			RescanInterval: 1,
+		},
+	}
+	// an empty directory is watched for files to turn up in
+	sources, err := WatchEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.writeFile(t, file, "one\n")
+	source := expectSource(t, sources, file)
+	expectLine(t, source.Lines, "one")
+	// where it was is kept for the file rotated in, not the one before
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	ts.writeFile(t, file, "rotated\n")
+	expectLine(t, source.Lines, "rotated")
+
+	// once it hasn't been written to for long enough, it's finished off
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-source.Lines:
+		if ok {
+			t.Error("expected no more lines from an idle file")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle file was never finished off")
+	}
+	// and picked up again from where it was if it's written to, but not
+	// before
+	select {
+	case source := <-sources:
+		t.Errorf("expected an idle file to be left alone, got a source for %s", source.Path)
+	case <-time.After(1500 * time.Millisecond):
+	}
+	appendTo(t, file, "two\n")
+	source = expectSource(t, sources, file)
+	expectLine(t, source.Lines, "two")
+	// the statefile is named after the file's whole path, and kept when it's
+	// idle
+	name := url.PathEscape(strings.TrimPrefix(ts.tmpdir, "/")) + "%2Flogs%2Fweb%2Fapp.leash.state"
+	if _, err := os.Stat(ts.tmpdir + "/" + name); err != nil {
+		t.Errorf("expected the statefile of an idle file to be kept, got %v", err)
+	}
+
+	ts.cancel()
+	checkLinesChanClosed(t, source.Lines)
+	for range sources {
+	}
+}
@@ -0,0 +1,262 @@
+package tail
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+// charmap holds the runes for the bytes 0x80 to 0xff of a single byte
+// character set, with 0 for the ones it leaves undefined
+type charmap [128]rune
+
+var windows1252 = func() *charmap {
+	var m charmap
+	copy(m[:], []rune{
+		0x20ac, 0, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+		0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017d, 0,
+		0, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+		0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0, 0x017e, 0x0178,
+	})
+	// the rest is the same as latin1
+	for b := 0xa0; b <= 0xff; b++ {
+		m[b-0x80] = rune(b)
+	}
+	return &m
+}()
+
+var windows1251 = func() *charmap {
+	var m charmap
+	copy(m[:], []rune{
+		0x0402, 0x0403, 0x201a, 0x0453, 0x201e, 0x2026, 0x2020, 0x2021,
+		0x20ac, 0x2030, 0x0409, 0x2039, 0x040a, 0x040c, 0x040b, 0x040f,
+		0x0452, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+		0, 0x2122, 0x0459, 0x203a, 0x045a, 0x045c, 0x045b, 0x045f,
+		0x00a0, 0x040e, 0x045e, 0x0408, 0x00a4, 0x0490, 0x00a6, 0x00a7,
+		0x0401, 0x00a9, 0x0404, 0x00ab, 0x00ac, 0x00ad, 0x00ae, 0x0407,
+		0x00b0, 0x00b1, 0x0406, 0x0456, 0x0491, 0x00b5, 0x00b6, 0x00b7,
+		0x0451, 0x2116, 0x0454, 0x00bb, 0x0458, 0x0405, 0x0455, 0x0457,
+	})
+	// 0xc0 to 0xff are А to я, in order
+	for b := 0xc0; b <= 0xff; b++ {
+		m[b-0x80] = rune(0x0410 + b - 0xc0)
+	}
+	return &m
+}()
+
+// encodings are the character sets files can be read in, by the names
+// --tail.encoding takes
+var encodings = map[string]Decoder{
+	"utf-8":        {name: "utf-8", unit: 1, bom: "\xef\xbb\xbf", newline: "\n"},
+	"utf-16le":     {name: "utf-16le", unit: 2, bom: "\xff\xfe", newline: "\n\x00"},
+	"utf-16be":     {name: "utf-16be", unit: 2, bom: "\xfe\xff", newline: "\x00\n"},
+	"latin1":       {name: "latin1", unit: 1, newline: "\n"},
+	"windows-1252": {name: "windows-1252", unit: 1, newline: "\n", charmap: windows1252},
+	"windows-1251": {name: "windows-1251", unit: 1, newline: "\n", charmap: windows1251},
+}
+
+// other names the encodings go by
+var encodingAliases = map[string]string{
+	"utf8":       "utf-8",
+	"iso-8859-1": "latin1",
+	"cp1252":     "windows-1252",
+	"cp1251":     "windows-1251",
+}
+
+// Decoder turns the lines of a file in another character set into UTF-8,
+// dropping the byte order mark at the start of the file and replacing byte
+// sequences that aren't valid in it. A nil Decoder leaves lines as they are.
+type Decoder struct {
+	name string
+	// unit is the size in bytes of the character set's code units
+	unit int
+	bom  string
+	// newline is the end of a line in the character set
+	newline string
+	// charmap is the character set's upper half, for single byte sets other
+	// than utf-8. Latin1 doesn't need one.
+	charmap     *charmap
+	replacement string
+}
+
+// NewDecoder returns a Decoder for the encoding in opts, or nil if it doesn't
+// have one
+func NewDecoder(opts TailOptions) (*Decoder, error) {
+	if opts.Encoding == "" {
+		return nil, nil
+	}
+	name := strings.ToLower(opts.Encoding)
+	if alias, ok := encodingAliases[name]; ok {
+		name = alias
+	}
+	d, ok := encodings[name]
+	if !ok {
+		return nil, fmt.Errorf("--tail.encoding %s isn't utf-8, utf-16le, utf-16be, latin1, windows-1252 or windows-1251", opts.Encoding)
+	}
+	if d.unit > 1 && opts.RotateStyle == "timestamp" {
+		return nil, fmt.Errorf("--tail.encoding=%s can't be used with --tail.rotate_style=timestamp", d.name)
+	}
+	if d.unit > 1 && (opts.Framing == framingNUL || opts.Framing == framingLength) {
+		return nil, fmt.Errorf("--tail.encoding=%s can't be used with --tail.framing=%s", d.name, opts.Framing)
+	}
+	d.replacement = opts.EncodingReplacement
+	return &d, nil
+}
+
+// unitSize returns the size in bytes of the code units lines are made of
+func (d *Decoder) unitSize() int64 {
+	if d == nil {
+		return 1
+	}
+	return int64(d.unit)
+}
+
+// text returns a record, as read by a recordReader, in UTF-8, counting the
+// invalid byte sequences replaced. The byte order mark is dropped from the
+// record at the start of the file.
+func (d *Decoder) text(line string, start bool) string {
+	text, replaced := d.convert(line, start)
+	if replaced > 0 {
+		metrics.Add("encoding_replacements", int64(replaced))
+	}
+	return text
+}
+
+// convert is text without counting the replacements, for lines that are
+// only looked at rather than sent on
+func (d *Decoder) convert(line string, start bool) (string, int) {
+	if d == nil {
+		return line, 0
+	}
+	if start {
+		line = strings.TrimPrefix(line, d.bom)
+	}
+	return d.decode(line)
+}
+
+// decode returns raw in UTF-8, along with the number of invalid byte
+// sequences replaced
+func (d *Decoder) decode(raw string) (string, int) {
+	switch {
+	case d.unit == 2:
+		return d.decodeUTF16(raw)
+	case d.name == "utf-8":
+		if utf8.ValidString(raw) {
+			return raw, 0
+		}
+	default:
+		if !hasHighBytes(raw) {
+			return raw, 0
+		}
+	}
+	var b bytes.Buffer
+	b.Grow(len(raw))
+	replaced := 0
+	for i := 0; i < len(raw); {
+		if raw[i] < utf8.RuneSelf {
+			b.WriteByte(raw[i])
+			i++
+			continue
+		}
+		if d.name == "utf-8" {
+			r, size := utf8.DecodeRuneInString(raw[i:])
+			if r == utf8.RuneError && size == 1 {
+				b.WriteString(d.replacement)
+				replaced++
+			} else {
+				b.WriteString(raw[i : i+size])
+			}
+			i += size
+			continue
+		}
+		r := rune(raw[i])
+		if d.charmap != nil {
+			r = d.charmap[raw[i]-0x80]
+		}
+		if r == 0 {
+			b.WriteString(d.replacement)
+			replaced++
+		} else {
+			b.WriteRune(r)
+		}
+		i++
+	}
+	return b.String(), replaced
+}
+
+// decodeUTF16 returns raw, in UTF-16 with the Decoder's byte order, in UTF-8
+func (d *Decoder) decodeUTF16(raw string) (string, int) {
+	var b bytes.Buffer
+	b.Grow(len(raw))
+	replaced := 0
+	unit := func(i int) rune {
+		if d.name == "utf-16le" {
+			return rune(raw[i]) | rune(raw[i+1])<<8
+		}
+		return rune(raw[i])<<8 | rune(raw[i+1])
+	}
+	i := 0
+	for ; i+1 < len(raw); i += 2 {
+		r := unit(i)
+		if utf16.IsSurrogate(r) {
+			// a surrogate is only valid as the first of a pair followed by
+			// the second
+			if i+3 < len(raw) {
+				if pair := utf16.DecodeRune(r, unit(i+2)); pair != utf8.RuneError {
+					b.WriteRune(pair)
+					i += 2
+					continue
+				}
+			}
+			b.WriteString(d.replacement)
+			replaced++
+			continue
+		}
+		b.WriteRune(r)
+	}
+	if i < len(raw) {
+		// half a code unit at the end
+		b.WriteString(d.replacement)
+		replaced++
+	}
+	return b.String(), replaced
+}
+
+// cut returns where to cut record short, when next is the first byte left
+// out, so as not to leave part of a character at the end
+func (d *Decoder) cut(record []byte, next byte) int {
+	n := len(record)
+	switch {
+	case d.unitSize() == 2:
+		return n - n%2
+	case d != nil && d.name != "utf-8":
+		// every byte is a character of its own
+		return n
+	case utf8.RuneStart(next):
+		return n
+	}
+	// back up to the start of the character next is in the middle of
+	for i := n - 1; i >= 0 && i > n-utf8.UTFMax; i-- {
+		if record[i] < utf8.RuneSelf {
+			break
+		}
+		if utf8.RuneStart(record[i]) {
+			return i
+		}
+	}
+	return n
+}
+
+// hasHighBytes reports whether s has any bytes outside of ASCII
+func hasHighBytes(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package tail
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+// decodeLines reads the lines in content with d the way the tailers do
+func decodeLines(t *testing.T, d *Decoder, content string) []string {
+	records := newRecordReader(strings.NewReader(content), d, TailOptions{})
+	var texts []string
+	var offset int64
+	for {
+		record, n, err := records.read()
+		if hasRecord(record, err) {
+			texts = append(texts, records.text(record, offset == 0))
+		}
+		offset += n
+		if err == io.EOF {
+			return texts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		encoding string
+		content  string
+		expected []string
+		replaced int64
+	}{
+		{
+			encoding: "utf-8",
+			content:  "\xef\xbb\xbfcafé\nbad \xff\xfe byte\n\xef\xbb\xbfkept",
+			expected: []string{"café", "bad ?? byte", "\ufeffkept"},
+			replaced: 2,
+		},
+		{
+			encoding: "latin1",
+			content:  "caf\xe9\n\xff\n",
+			expected: []string{"café", "ÿ"},
+		},
+		{
+			encoding: "cp1252",
+			content:  "\x93quoted\x94 \x80\n\x81\n",
+			expected: []string{"“quoted” €", "?"},
+			replaced: 1,
+		},
+		{
+			encoding: "windows-1251",
+			content:  "\xcf\xf0\xe8\xe2\xe5\xf2 \xb9\xa8\n\x98\n",
+			expected: []string{"Привет №Ё", "?"},
+			replaced: 1,
+		},
+		{
+			// U+0A0A has the newline byte in both halves, which isn't the end
+			// of the line
+			encoding: "utf-16le",
+			content:  "\xff\xfea\x00\n\n\n\x00\x3d\xd8\x00\xde\n\x00\x00\xd8b\x00\n\x00c\x00\n",
+			expected: []string{"a\u0a0a", "\U0001f600", "?b", "c?"},
+			replaced: 2,
+		},
+		{
+			encoding: "UTF-16BE",
+			content:  "\xfe\xff\x00a\x0a\x41\x00\n\x00b",
+			expected: []string{"a\u0a41", "b"},
+		},
+	}
+	for _, test := range tests {
+		d, err := NewDecoder(TailOptions{Encoding: test.encoding, EncodingReplacement: "?"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := metrics.Get("encoding_replacements")
+		if texts := decodeLines(t, d, test.content); !reflect.DeepEqual(texts, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.encoding, test.expected, texts)
+		}
+		if replaced := metrics.Get("encoding_replacements") - before; replaced != test.replaced {
+			t.Errorf("%s: expected %d replacements counted, got %d", test.encoding, test.replaced, replaced)
+		}
+	}
+
+	// without an encoding, lines are passed on as they are
+	if texts := decodeLines(t, nil, "\xef\xbb\xbfa\xff\nb"); !reflect.DeepEqual(texts, []string{"\xef\xbb\xbfa\xff", "b"}) {
+		t.Errorf("expected lines to be left alone without a decoder, got %q", texts)
+	}
+	if _, err := NewDecoder(TailOptions{Encoding: "ebcdic"}); err == nil {
+		t.Error("expected an unknown encoding to be an error")
+	}
+	if _, err := NewDecoder(TailOptions{Encoding: "utf-16le", RotateStyle: "timestamp"}); err == nil {
+		t.Error("expected utf-16 to be rejected for timestamped files")
+	}
+}
+
+func TestFollowUTF16(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	defer func(interval time.Duration) { followCheckInterval = interval }(followCheckInterval)
+	followCheckInterval = 10 * time.Millisecond
+
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "\xff\xfea\x00\n\x00b\x00\n")
+	follower, err := newFollower(file, nil, true, TailOptions{Encoding: "utf-16le"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go follower.run(ts.ctx)
+	// offsets are in the file as it's written
+	expectFileLine(t, follower.lines, fileLine{Line: Line{Text: "a", Offset: 0, Number: 1}, end: 6})
+	// lines are only passed on once they're whole, even when the newline is
+	// split up
+	appendTo(t, file, "\x00")
+	expectFileLine(t, follower.lines, fileLine{Line: Line{Text: "b", Offset: 6, Number: 2}, end: 10})
+	for _, b := range []string{"c", "\x00", "\n", "\x00"} {
+		time.Sleep(20 * time.Millisecond)
+		appendTo(t, file, b)
+	}
+	expectFileLine(t, follower.lines, fileLine{Line: Line{Text: "c", Offset: 10, Number: 3}, end: 14})
+}
@@ -0,0 +1,328 @@
+package tail
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hpcloud/tail"
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+// how often a followed file is checked for more lines with --tail.poll, and
+// for truncation and rotation otherwise, in case no change events arrive
+var (
+	followPollInterval  = 250 * time.Millisecond
+	followCheckInterval = time.Second
+)
+
+// fileLine is a line read from a file, along with the offset just past its
+// end, which is where to pick up from once the line has been sent on
+type fileLine struct {
+	Line
+	end int64
+}
+
+// follower reads lines from a file, like tail -F. It keeps track of the offset
+// itself, and checks for the file being truncated or replaced whenever it
+// gets to the end.
+type follower struct {
+	path string
+	// follow keeps reading at the end of the file, and reopens the path if
+	// the file is replaced
+	follow bool
+	poll   bool
+	lines  chan fileLine
+	// stop is closed to finish once the end of the file is reached
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	fh      *os.File
+	records *recordReader
+	// offset is where the next byte from reader comes from
+	offset int64
+	// start is where the line being read starts
+	start int64
+	// inode is the inode number of the file being read
+	inode uint64
+	// number is the number of the line being read, or 0 if it isn't known
+	number int64
+
+	// lock guards fh and identity, which change when the file is replaced,
+	// against the statefile writes
+	lock sync.Mutex
+	// identity has the device, inode number and fingerprint of the file
+	// being read
+	identity State
+	// read has the devices and inode numbers of the files read so far,
+	// including the one being read
+	read []fileID
+}
+
+// newFollower opens path and seeks to loc, or the beginning if it's nil.
+// Records are split up and decoded the way opts say.
+func newFollower(path string, loc *tail.SeekInfo, follow bool, opts TailOptions) (*follower, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(0)
+	if loc != nil {
+		offset, err = fh.Seek(loc.Offset, loc.Whence)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+	}
+	decoder, _ := NewDecoder(opts)
+	f := &follower{
+		path:    path,
+		follow:  follow,
+		poll:    opts.Poll,
+		lines:   make(chan fileLine),
+		stop:    make(chan struct{}),
+		fh:      fh,
+		records: newRecordReader(fh, decoder, opts),
+		offset:  offset,
+		start:   offset,
+		inode:   inodeOfOpen(fh),
+	}
+	if offset == 0 {
+		f.number = 1
+	}
+	setOpenIdentity(&f.identity, fh)
+	f.read = []fileID{f.identity.fileID()}
+	return f, nil
+}
+
+// identify records which file is being read in state. It's taken from the
+// open file rather than the path, which may already have a newer file.
+func (f *follower) identify(state *State) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// the fingerprint may not be complete yet; once the file's closed it's
+	// left as it is
+	setOpenIdentity(&f.identity, f.fh)
+	state.INode = f.identity.INode
+	state.Device = f.identity.Device
+	state.Fingerprint = f.identity.Fingerprint
+	state.FingerprintSize = f.identity.FingerprintSize
+}
+
+// currentFile returns the device and inode number of the file being read
+func (f *follower) currentFile() fileID {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.identity.fileID()
+}
+
+// readFiles returns the devices and inode numbers of the files read so far,
+// which includes the ones that have been rotated away from the path
+func (f *follower) readFiles() []fileID {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]fileID{}, f.read...)
+}
+
+// close closes the file, once its fingerprint has been brought up to date
+func (f *follower) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	setOpenIdentity(&f.identity, f.fh)
+	f.fh.Close()
+}
+
+// stopAtEOF finishes reading once the end of the file is reached
+func (f *follower) stopAtEOF() {
+	f.stopOnce.Do(func() { close(f.stop) })
+}
+
+// run sends the lines until the end of the file, or when following, until
+// ctx is cancelled or stopAtEOF is called. It closes f.lines when it's done.
+func (f *follower) run(ctx context.Context) {
+	defer close(f.lines)
+	defer f.close()
+
+	var changes chan fsnotify.Event
+	var watcher *fsnotify.Watcher
+	if f.follow && !f.poll {
+		var err error
+		watcher, err = fsnotify.NewWatcher()
+		if err == nil {
+			err = watcher.Add(f.path)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file": f.path,
+				"err":  err,
+			}).Debug("Failed to watch file for changes, polling it instead")
+			f.poll = true
+		} else {
+			defer watcher.Close()
+			changes = watcher.Events
+		}
+	}
+	interval := followCheckInterval
+	if f.poll {
+		interval = followPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// the start of a line that hasn't been finished yet
+	partial := ""
+	for {
+		line, n, err := f.records.read()
+		f.offset += n
+		if err == errRecordSkipped {
+			f.skip()
+			partial = ""
+			continue
+		}
+		if err == nil {
+			if !f.send(ctx, line) {
+				return
+			}
+			partial = ""
+			continue
+		}
+		partial = line
+		if err != io.EOF {
+			logrus.WithFields(logrus.Fields{
+				"file": f.path,
+				"err":  err,
+			}).Error("Error reading file")
+			return
+		}
+
+		// at the end of the file
+		stopping := !f.follow
+		select {
+		case <-f.stop:
+			stopping = true
+		default:
+		}
+		if stopping {
+			// the last line doesn't have to end in a newline
+			if partial != "" {
+				f.send(ctx, partial)
+			}
+			return
+		}
+		if f.truncated() {
+			partial = ""
+			continue
+		}
+		if fh := f.replacement(); fh != nil {
+			// the old file is done with, whether or not its last line ended
+			if partial != "" && !f.send(ctx, partial) {
+				fh.Close()
+				return
+			}
+			partial = ""
+			f.switchTo(fh)
+			if watcher != nil {
+				watcher.Add(f.path)
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.stop:
+		case <-changes:
+		case <-ticker.C:
+		}
+	}
+}
+
+// send decodes and passes on a line, returning false if ctx was cancelled
+// first
+func (f *follower) send(ctx context.Context, raw string) bool {
+	text := f.records.text(raw, f.start == 0)
+	line := Line{Text: text, Path: f.path, Inode: f.inode, Offset: f.start, Number: f.number}
+	select {
+	case f.lines <- fileLine{Line: line, end: f.offset}:
+	case <-ctx.Done():
+		return false
+	}
+	f.skip()
+	return true
+}
+
+// skip moves on to the next line
+func (f *follower) skip() {
+	f.start = f.offset
+	if f.number > 0 {
+		f.number++
+	}
+}
+
+// truncated checks whether the file has shrunk below the offset, like when
+// logrotate's copytruncate empties it, and if so starts again from the
+// beginning
+func (f *follower) truncated() bool {
+	info, err := f.fh.Stat()
+	if err != nil || info.Size() >= f.offset {
+		return false
+	}
+	logrus.WithFields(logrus.Fields{
+		"file":   f.path,
+		"offset": f.offset,
+		"size":   info.Size(),
+	}).Info("File was truncated, reading it again from the beginning")
+	metrics.Increment("files_truncated")
+	if _, err := f.fh.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	f.records.reset(f.fh)
+	f.offset = 0
+	f.start = 0
+	f.number = 1
+	return true
+}
+
+// replacement checks whether there's a new file at the path, like after the
+// old one was moved aside, and if so opens it. It's only called once the old
+// file has been read to the end.
+func (f *follower) replacement() *os.File {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		// not there yet; keep reading the old one
+		return nil
+	}
+	current, err := f.fh.Stat()
+	if err != nil || os.SameFile(info, current) {
+		return nil
+	}
+	fh, err := os.Open(f.path)
+	if err != nil {
+		return nil
+	}
+	return fh
+}
+
+// switchTo starts reading the new file fh from the beginning
+func (f *follower) switchTo(fh *os.File) {
+	logrus.WithFields(logrus.Fields{
+		"file": f.path,
+	}).Info("File was replaced, reading the new one")
+	f.lock.Lock()
+	f.fh.Close()
+	f.fh = fh
+	f.identity = State{}
+	setOpenIdentity(&f.identity, fh)
+	f.read = append(f.read, f.identity.fileID())
+	f.lock.Unlock()
+	f.records.reset(fh)
+	f.offset = 0
+	f.start = 0
+	f.inode = inodeOfOpen(fh)
+	f.number = 1
+}
@@ -0,0 +1,188 @@
+package tail
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+func TestFollowTruncated(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	defer func(interval time.Duration) { followCheckInterval = interval }(followCheckInterval)
+	followCheckInterval = 10 * time.Millisecond
+
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "a\nbb\n")
+	conf := Config{
+		Paths: []string{file},
+		Options: TailOptions{
+			ReadFrom:  "beginning",
+			StateFile: ts.tmpdir + "/app.state",
+		},
+	}
+	chans, err := watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := chans[0]
+	expectLine(t, lines, "a")
+	expectLine(t, lines, "bb")
+
+	// copytruncate keeps the file but empties it; whatever's written next is
+	// read from the beginning
+	before := metrics.Get("files_truncated")
+	if err := os.Truncate(file, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendTo(t, file, "c\n")
+	expectLine(t, lines, "c")
+	if got := metrics.Get("files_truncated") - before; got != 1 {
+		t.Errorf("expected one truncation to be counted, got %d", got)
+	}
+
+	ts.cancel()
+	checkLinesChanClosed(t, lines)
+}
+
+func TestFollowTruncatedAcrossRestart(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "a\nb\n")
+	conf := Config{
+		Paths:   []string{file},
+		Options: tailOpts,
+	}
+	conf.Options.ReadFrom = "last"
+	conf.Options.StateFile = ts.tmpdir + "/app.state"
+	// an old statefile that only has the inode, from before the file was
+	// truncated and written to again
+	writeTestState(t, conf.Options.StateFile, State{INode: inodeOf(file), Offset: 100})
+
+	before := metrics.Get("files_truncated")
+	chans, err := watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{"a", "b"})
+	if got := metrics.Get("files_truncated") - before; got != 1 {
+		t.Errorf("expected one truncation to be counted, got %d", got)
+	}
+}
+
+func TestReplacedAcrossRestart(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "a\nb\n")
+	conf := Config{
+		Paths:   []string{file},
+		Options: tailOpts,
+	}
+	conf.Options.ReadFrom = "last"
+	conf.Options.StateFile = ts.tmpdir + "/app.state"
+	// a statefile for a longer file that's been rotated away since
+	writeTestState(t, conf.Options.StateFile, State{INode: inodeOf(file) + 1, Offset: 100})
+
+	before := metrics.Get("files_truncated")
+	chans, err := watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{"a", "b"})
+	if got := metrics.Get("files_truncated") - before; got != 0 {
+		t.Errorf("expected a different file not to count as truncated, got %d", got)
+	}
+}
+
+func TestFollowerIdentity(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "a\n")
+	follower, err := newFollower(file, nil, true, TailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.close()
+	// the path moves on to a new file before the old one has been read
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	ts.writeFile(t, file, "b\n")
+
+	state := State{}
+	follower.identify(&state)
+	if !sameFile(state, file+".1") || sameFile(state, file) {
+		t.Errorf("expected the identity of the file being read, got %+v", state)
+	}
+	if id, _ := fileIDOf(file + ".1"); follower.currentFile() != id {
+		t.Errorf("expected the inode of the file being read, got %+v", follower.currentFile())
+	}
+}
+
+func TestFollowReplaced(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	defer func(interval time.Duration) { followCheckInterval = interval }(followCheckInterval)
+	followCheckInterval = 10 * time.Millisecond
+
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "a\n")
+	follower, err := newFollower(file, nil, true, TailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go follower.run(ts.ctx)
+	expectFileLine(t, follower.lines, fileLine{Line: Line{Text: "a", Offset: 0, Number: 1}, end: 2})
+
+	// lines written to the old file before the new one shows up aren't lost
+	appendTo(t, file, "b")
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	ts.writeFile(t, file, "cc\n")
+	expectFileLine(t, follower.lines, fileLine{Line: Line{Text: "b", Offset: 2, Number: 2}, end: 3})
+	expectFileLine(t, follower.lines, fileLine{Line: Line{Text: "cc", Offset: 0, Number: 1}, end: 3})
+
+	// stopping at the end still sends the last line
+	appendTo(t, file, "d")
+	follower.stopAtEOF()
+	expectFileLine(t, follower.lines, fileLine{Line: Line{Text: "d", Offset: 3, Number: 2}, end: 4})
+	if _, ok := <-follower.lines; ok {
+		t.Error("expected the lines channel to be closed after stopping")
+	}
+}
+
+func appendTo(t *testing.T, file string, body string) {
+	fh, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	fh.WriteString(body)
+}
+
+func expectFileLine(t *testing.T, lines chan fileLine, expected fileLine) {
+	select {
+	case line := <-lines:
+		// the path and inode are left out, being the same for every line
+		line.Path, line.Inode = "", 0
+		if line != expected {
+			t.Errorf("got %+v, expected %+v", line, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %+v", expected)
+	}
+}
@@ -0,0 +1,275 @@
+package tail
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+// the ways records can be split up in files and stdin, for --tail.framing
+const (
+	framingNewline = "newline"
+	framingCRLF    = "crlf"
+	framingNUL     = "nul"
+	framingLength  = "length"
+)
+
+// maxLengthDigits is the most digits the length of a length-prefixed record
+// can have
+const maxLengthDigits = 10
+
+// errRecordSkipped is returned by recordReader.read for a record that was
+// dropped for being too big
+var errRecordSkipped = errors.New("record is bigger than --tail.max_record_bytes")
+
+// recordReader reads the records in a file or stdin, split up the way
+// --tail.framing says, and keeps no more than --tail.max_record_bytes of each
+// in memory
+type recordReader struct {
+	r       *bufio.Reader
+	decoder *Decoder
+	framing string
+	max     int
+	skip    bool
+	// buf is where length-prefixed records are read into
+	buf []byte
+	// uncounted is set for readers that only look at the records, to leave
+	// them out of the metrics
+	uncounted bool
+
+	// record is what's kept of the record being read
+	record []byte
+	// size is the size of the record so far, including anything dropped
+	size int64
+	// over is set once some of the record has been dropped
+	over bool
+	// half is the first byte of a UTF-16 code unit, when odd is set
+	half byte
+	odd  bool
+	// prefix is the length of a length-prefixed record read so far, and
+	// length the length once it's all been read, or -1 before then
+	prefix []byte
+	length int64
+	// unframed is set when what should have been a length turned out not to
+	// be, and the rest of the line is being read as a record
+	unframed bool
+}
+
+func newRecordReader(r io.Reader, decoder *Decoder, opts TailOptions) *recordReader {
+	rr := &recordReader{
+		r:       bufio.NewReader(r),
+		decoder: decoder,
+		framing: opts.Framing,
+		max:     int(opts.MaxRecordBytes),
+		skip:    opts.OversizeRecord == "skip",
+		length:  -1,
+	}
+	if rr.framing == framingLength {
+		rr.buf = make([]byte, 4096)
+	}
+	return rr
+}
+
+// reset starts reading records from r, forgetting about any record that was
+// partly read
+func (rr *recordReader) reset(r io.Reader) {
+	rr.r.Reset(r)
+	rr.clear()
+}
+
+func (rr *recordReader) clear() {
+	rr.record = rr.record[:0]
+	rr.size = 0
+	rr.over = false
+	rr.odd = false
+	rr.prefix = rr.prefix[:0]
+	rr.length = -1
+	rr.unframed = false
+}
+
+// read returns the next record, still in the input's character set, along
+// with the number of bytes of the input read to get it. If the input runs
+// out first, it returns what it has of the record with the error, and
+// carries on with the same record next time. Records that are too big are
+// cut short, or dropped with --tail.oversize_record=skip, in which case the
+// error is errRecordSkipped, or for a record that isn't finished, what's
+// returned is empty.
+func (rr *recordReader) read() (string, int64, error) {
+	var n int64
+	var done bool
+	var err error
+	switch {
+	case rr.framing == framingLength && !rr.unframed:
+		n, done, err = rr.readLengthPrefixed()
+	case rr.framing == framingNUL:
+		n, done, err = rr.readDelimited(0)
+	case rr.decoder.unitSize() == 2:
+		n, done, err = rr.readUTF16Line()
+	default:
+		n, done, err = rr.readDelimited('\n')
+	}
+	if !done {
+		if rr.over && rr.skip {
+			return "", n, err
+		}
+		if rr.odd {
+			// the last byte is half a code unit
+			return string(rr.record) + string([]byte{rr.half}), n, err
+		}
+		return string(rr.record), n, err
+	}
+
+	record := string(rr.record)
+	size, over := rr.size, rr.over
+	rr.clear()
+	if over && rr.skip {
+		rr.count("oversize_records_skipped", size)
+		return "", n, errRecordSkipped
+	}
+	if over {
+		rr.count("oversize_records_truncated", size)
+	}
+	return record, n, nil
+}
+
+// count adds a record that was too big to the metric
+func (rr *recordReader) count(metric string, size int64) {
+	if rr.uncounted {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"bytes": size,
+		"max":   rr.max,
+	}).Debug("Record too big")
+	metrics.Increment(metric)
+}
+
+// hasRecord reports whether read returned a record to pass on, either a whole
+// one or the last one in the input, which doesn't have to be ended
+func hasRecord(record string, err error) bool {
+	return err == nil || (err != errRecordSkipped && record != "")
+}
+
+// text returns record, as read by read, in UTF-8. With --tail.framing=crlf,
+// the \r of a \r\n at the end is dropped.
+func (rr *recordReader) text(record string, start bool) string {
+	text := rr.decoder.text(record, start)
+	if rr.framing == framingCRLF {
+		text = strings.TrimSuffix(text, "\r")
+	}
+	return text
+}
+
+// readDelimited reads up to and including delim, reporting whether it got to
+// it
+func (rr *recordReader) readDelimited(delim byte) (int64, bool, error) {
+	var n int64
+	for {
+		chunk, err := rr.r.ReadSlice(delim)
+		n += int64(len(chunk))
+		if err == nil {
+			rr.add(chunk[:len(chunk)-1])
+			return n, true, nil
+		}
+		rr.add(chunk)
+		if err != bufio.ErrBufferFull {
+			return n, false, err
+		}
+	}
+}
+
+// readUTF16Line reads up to and including the next newline, which has to be
+// a whole code unit of its own rather than part of another character
+func (rr *recordReader) readUTF16Line() (int64, bool, error) {
+	var n int64
+	for {
+		b, err := rr.r.ReadByte()
+		if err != nil {
+			return n, false, err
+		}
+		n++
+		if rr.odd = !rr.odd; rr.odd {
+			rr.half = b
+			continue
+		}
+		unit := []byte{rr.half, b}
+		if string(unit) == rr.decoder.newline {
+			return n, true, nil
+		}
+		rr.add(unit)
+	}
+}
+
+// readLengthPrefixed reads a record that starts with its length in bytes, in
+// decimal, followed by a space, like "5 hello". Newlines between records are
+// skipped over.
+func (rr *recordReader) readLengthPrefixed() (int64, bool, error) {
+	var n int64
+	for rr.length < 0 {
+		b, err := rr.r.ReadByte()
+		if err != nil {
+			return n, false, err
+		}
+		n++
+		switch {
+		case (b == '\n' || b == '\r') && len(rr.prefix) == 0:
+		case b >= '0' && b <= '9' && len(rr.prefix) < maxLengthDigits:
+			rr.prefix = append(rr.prefix, b)
+		case b == ' ' && len(rr.prefix) > 0:
+			rr.length, _ = strconv.ParseInt(string(rr.prefix), 10, 64)
+			rr.prefix = rr.prefix[:0]
+		default:
+			// it's not a length after all, so the rest of the line is passed
+			// on as it is
+			if !rr.uncounted {
+				metrics.Increment("records_unframed")
+			}
+			rr.add(rr.prefix)
+			rr.prefix = rr.prefix[:0]
+			if b == '\n' {
+				return n, true, nil
+			}
+			rr.add([]byte{b})
+			rr.unframed = true
+			m, done, err := rr.readDelimited('\n')
+			return n + m, done, err
+		}
+	}
+	for rr.length > 0 {
+		want := rr.length
+		if want > int64(len(rr.buf)) {
+			want = int64(len(rr.buf))
+		}
+		got, err := rr.r.Read(rr.buf[:want])
+		n += int64(got)
+		rr.length -= int64(got)
+		rr.add(rr.buf[:got])
+		if err != nil {
+			return n, false, err
+		}
+	}
+	return n, true, nil
+}
+
+// add keeps as much of chunk, the next part of the record, as fits in
+// --tail.max_record_bytes
+func (rr *recordReader) add(chunk []byte) {
+	rr.size += int64(len(chunk))
+	if rr.over {
+		return
+	}
+	if rr.max > 0 && len(rr.record)+len(chunk) > rr.max {
+		keep := rr.max - len(rr.record)
+		rr.record = append(rr.record, chunk[:keep]...)
+		rr.record = rr.record[:rr.decoder.cut(rr.record, chunk[keep])]
+		rr.over = true
+		return
+	}
+	rr.record = append(rr.record, chunk...)
+}
@@ -0,0 +1,129 @@
+package tail
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+// readRecords reads all the records in content with opts, returning their
+// texts and the number of bytes read
+func readRecords(t *testing.T, opts TailOptions, content string) ([]string, int64) {
+	decoder, err := NewDecoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := newRecordReader(strings.NewReader(content), decoder, opts)
+	var texts []string
+	var offset int64
+	for {
+		record, n, err := records.read()
+		if hasRecord(record, err) {
+			texts = append(texts, records.text(record, offset == 0))
+		}
+		offset += n
+		if err == io.EOF {
+			return texts, offset
+		}
+		if err != nil && err != errRecordSkipped {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecordReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     TailOptions
+		content  string
+		expected []string
+		metrics  map[string]int64
+	}{
+		{
+			name:     "truncate",
+			opts:     TailOptions{MaxRecordBytes: 5, OversizeRecord: "truncate"},
+			content:  "hello world\nhi\n",
+			expected: []string{"hello", "hi"},
+			metrics:  map[string]int64{"oversize_records_truncated": 1},
+		},
+		{
+			name:     "skip",
+			opts:     TailOptions{MaxRecordBytes: 5, OversizeRecord: "skip"},
+			content:  "hello world\nhi\nlast one",
+			expected: []string{"hi"},
+			metrics:  map[string]int64{"oversize_records_skipped": 1},
+		},
+		{
+			// a record isn't cut in the middle of a character
+			name:     "truncate utf-8",
+			opts:     TailOptions{MaxRecordBytes: 4},
+			content:  "caf\xc3\xa9s\n",
+			expected: []string{"caf"},
+			metrics:  map[string]int64{"oversize_records_truncated": 1},
+		},
+		{
+			name:     "truncate utf-16",
+			opts:     TailOptions{Encoding: "utf-16le", MaxRecordBytes: 5, EncodingReplacement: "?"},
+			content:  "a\x00b\x00c\x00\n\x00",
+			expected: []string{"ab"},
+			metrics:  map[string]int64{"oversize_records_truncated": 1, "encoding_replacements": 0},
+		},
+		{
+			name:     "nul",
+			opts:     TailOptions{Framing: "nul"},
+			content:  "a\nb\x00c\r\n\x00d",
+			expected: []string{"a\nb", "c\r\n", "d"},
+		},
+		{
+			name:     "crlf",
+			opts:     TailOptions{Framing: "crlf"},
+			content:  "a\r\nb\nc\r",
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			// what isn't a length is passed on up to the end of the line
+			name:     "length",
+			opts:     TailOptions{Framing: "length"},
+			content:  "5 hello\n3 a\nb\noops\n0 \r\n2 hi",
+			expected: []string{"hello", "a\nb", "oops", "", "hi"},
+			metrics:  map[string]int64{"records_unframed": 1},
+		},
+	}
+	for _, test := range tests {
+		before := metrics.Snapshot()
+		texts, n := readRecords(t, test.opts, test.content)
+		if !reflect.DeepEqual(texts, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, texts)
+		}
+		if n != int64(len(test.content)) {
+			t.Errorf("%s: expected all %d bytes to be counted, got %d", test.name, len(test.content), n)
+		}
+		for name, expected := range test.metrics {
+			if got := metrics.Get(name) - before[name]; got != expected {
+				t.Errorf("%s: expected %s to go up by %d, got %d", test.name, name, expected, got)
+			}
+		}
+	}
+}
+
+func TestRecordReaderPartial(t *testing.T) {
+	// a record that's still being written is carried on with once there's
+	// more to read
+	var input bytes.Buffer
+	records := newRecordReader(&input, nil, TailOptions{Framing: "length"})
+	input.WriteString("11 hello")
+	if record, n, err := records.read(); record != "hello" || n != 8 || err != io.EOF {
+		t.Errorf("expected the start of the record, got %q, %d, %v", record, n, err)
+	}
+	input.WriteString(" world5 again")
+	if record, n, err := records.read(); record != "hello world" || n != 6 || err != nil {
+		t.Errorf("expected the whole record, got %q, %d, %v", record, n, err)
+	}
+	if record, n, err := records.read(); record != "again" || n != 7 || err != nil {
+		t.Errorf("expected the next record, got %q, %d, %v", record, n, err)
+	}
+}
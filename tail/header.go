@@ -0,0 +1,59 @@
+package tail
+
+import "strings"
+
+// The separators in a header. They're control characters that shouldn't turn
+// up in the fields, and are taken out if they do.
+const (
+	headerEnd       = "\x1e"
+	headerSeparator = "\x1f"
+)
+
+var headerCleaner = strings.NewReplacer(headerEnd, " ", headerSeparator, " ")
+
+// Header puts fields at the start of the lines a Source passes on, in a form
+// its regex can take apart again. That way they make it into the events made
+// out of the line the same way as the fields from --log_prefix do, whichever
+// parser is used.
+type Header struct {
+	names []string
+}
+
+// NewHeader returns a Header for fields with names
+func NewHeader(names ...string) *Header {
+	return &Header{names: names}
+}
+
+// Add returns line with the header for values, which go with the names the
+// header was made with, in front of it
+func (h *Header) Add(values []string, line string) string {
+	cleaned := make([]string, len(values))
+	for i, value := range values {
+		cleaned[i] = headerCleaner.Replace(value)
+	}
+	return headerEnd + strings.Join(cleaned, headerSeparator) + headerEnd + line
+}
+
+// Regex returns the regex matching the header, with a named group for each
+// field
+func (h *Header) Regex() string {
+	groups := make([]string, len(h.names))
+	for i, name := range h.names {
+		groups[i] = "(?P<" + name + ">[^" + headerEnd + headerSeparator + "]*)"
+	}
+	return "^" + headerEnd + strings.Join(groups, headerSeparator) + headerEnd
+}
+
+// cutHeader splits line into the header an input put at its start, if it has
+// one, and the rest of it
+func cutHeader(line string) (string, string) {
+	if !strings.HasPrefix(line, headerEnd) {
+		return "", line
+	}
+	end := strings.Index(line[len(headerEnd):], headerEnd)
+	if end < 0 {
+		return "", line
+	}
+	end += 2 * len(headerEnd)
+	return line[:end], line[end:]
+}
@@ -0,0 +1,167 @@
+package tail
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/metrics"
+)
+
+// MultilineOptions set how lines are joined into records before they're
+// parsed, for logs such as stack traces where a record takes several lines
+type MultilineOptions struct {
+	Start    string `long:"start" description:"Regex matching the first line of each record, like '^\\d{4}-\\d\\d-\\d\\d '. Lines that don't match are joined onto the record before them"`
+	Continue string `long:"continue" description:"Regex matching the lines that carry on the record before them, like '^(\\s|Caused by:)'. Lines that don't match start a new record"`
+	Indented bool   `long:"indented" description:"Join lines that start with a space or tab onto the record before them. Can be used along with --multiline.continue"`
+	MaxLines uint   `long:"max_lines" description:"Maximum number of lines in a record. The line after that starts a new one. 0 means no limit" default:"500"`
+	MaxBytes uint   `long:"max_bytes" description:"Maximum size of a record in bytes. A line that would take it over starts a new one. 0 means no limit" default:"1048576"`
+	Timeout  uint   `long:"timeout" description:"How long, in milliseconds, to wait for more of a record when no more lines are coming in before passing it on. 0 waits until the next record starts" default:"1000"`
+}
+
+// Joiner joins the lines of a record into one, separated by newlines, so
+// parsers that take a line at a time can handle records that take several.
+// A nil Joiner leaves lines as they are.
+type Joiner struct {
+	opts  MultilineOptions
+	start *regexp.Regexp
+	cont  *regexp.Regexp
+}
+
+// NewJoiner returns a Joiner for opts, or nil if they don't say how to join
+// lines
+func NewJoiner(opts MultilineOptions) (*Joiner, error) {
+	if opts.Start == "" && opts.Continue == "" && !opts.Indented {
+		return nil, nil
+	}
+	if opts.Start != "" && (opts.Continue != "" || opts.Indented) {
+		return nil, errors.New("--multiline.start can't be used along with --multiline.continue or --multiline.indented")
+	}
+	j := &Joiner{opts: opts}
+	var err error
+	if opts.Start != "" {
+		if j.start, err = regexp.Compile(opts.Start); err != nil {
+			return nil, fmt.Errorf("--multiline.start regex %s doesn't compile: %s", opts.Start, err)
+		}
+	}
+	if opts.Continue != "" {
+		if j.cont, err = regexp.Compile(opts.Continue); err != nil {
+			return nil, fmt.Errorf("--multiline.continue regex %s doesn't compile: %s", opts.Continue, err)
+		}
+	}
+	return j, nil
+}
+
+// Join returns a Source with the records made out of source's lines. The
+// statefile is kept at the start of a record, so source's checkpoint is
+// moved along by the joiner as each record is passed on, and the Source
+// returned doesn't have one. Each record keeps the position of its first
+// line.
+func (j *Joiner) Join(source Source) Source {
+	if j == nil {
+		return source
+	}
+	source.Checkpoint.Track()
+	records := make(chan Line)
+	go j.join(source.Lines, records, source.Checkpoint)
+	source.Lines = records
+	source.Checkpoint = nil
+	return source
+}
+
+func (j *Joiner) join(lines chan Line, records chan Line, checkpoint *Checkpoint) {
+	defer close(records)
+	var record []string
+	// first is the first line of the record
+	var first Line
+	size := 0
+	// committed counts the lines in the records passed on
+	var committed int64
+	flush := func() {
+		if len(record) == 0 {
+			return
+		}
+		first.Text = strings.Join(record, "\n")
+		records <- first
+		committed += int64(len(record))
+		checkpoint.Commit(committed)
+		record = record[:0]
+		size = 0
+	}
+
+	// the timer is only running while there's a record waiting
+	var timeout <-chan time.Time
+	var timer *time.Timer
+	if j.opts.Timeout > 0 {
+		timer = time.NewTimer(time.Hour)
+		timer.Stop()
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			// lines from inputs with a header are joined on what follows it,
+			// and only the first line of a record keeps its header
+			text := line.Text
+			_, body := cutHeader(text)
+			if !j.continues(record, size, body) {
+				flush()
+			}
+			if len(record) > 0 {
+				size++
+				text = body
+			} else {
+				first = line
+			}
+			record = append(record, text)
+			size += len(text)
+			if timer != nil {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(time.Duration(j.opts.Timeout) * time.Millisecond)
+				timeout = timer.C
+			}
+		case <-timeout:
+			flush()
+			timeout = nil
+		}
+	}
+}
+
+// continues reports whether line carries on record, which is size bytes long
+func (j *Joiner) continues(record []string, size int, line string) bool {
+	if len(record) == 0 {
+		return false
+	}
+	var continues bool
+	if j.start != nil {
+		continues = !j.start.MatchString(line)
+	} else {
+		continues = (j.opts.Indented && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"))) ||
+			(j.cont != nil && j.cont.MatchString(line))
+	}
+	if !continues {
+		return false
+	}
+	if (j.opts.MaxLines > 0 && uint(len(record)) >= j.opts.MaxLines) ||
+		(j.opts.MaxBytes > 0 && uint(size+1+len(line)) > j.opts.MaxBytes) {
+		logrus.WithFields(logrus.Fields{
+			"lines": len(record),
+			"bytes": size,
+		}).Debug("Record too long, starting a new one")
+		metrics.Increment("multiline_records_split")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+package tail
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// joinLines runs lines through a Joiner for opts and returns the records
+func joinLines(t *testing.T, opts MultilineOptions, lines []string) []string {
+	joiner, err := NewJoiner(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan Line)
+	go func() {
+		for _, line := range lines {
+			in <- Line{Text: line}
+		}
+		close(in)
+	}()
+	var records []string
+	for record := range joiner.Join(Source{Lines: in}).Lines {
+		records = append(records, record.Text)
+	}
+	return records
+}
+
+func TestJoiner(t *testing.T) {
+	trace := []string{
+		"2017-10-16 09:00:00 ERROR oops",
+		"java.lang.NullPointerException",
+		"\tat Foo.bar(Foo.java:10)",
+		"Caused by: java.io.IOException",
+		"\tat Foo.baz(Foo.java:20)",
+		"2017-10-16 09:00:01 INFO fine",
+		"2017-10-16 09:00:02 INFO",
+		"  still fine",
+	}
+	tests := []struct {
+		name     string
+		opts     MultilineOptions
+		lines    []string
+		expected []string
+	}{
+		{
+			name:  "start",
+			opts:  MultilineOptions{Start: `^\d{4}-`},
+			lines: trace,
+			expected: []string{
+				"2017-10-16 09:00:00 ERROR oops\njava.lang.NullPointerException\n\tat Foo.bar(Foo.java:10)\nCaused by: java.io.IOException\n\tat Foo.baz(Foo.java:20)",
+				"2017-10-16 09:00:01 INFO fine",
+				"2017-10-16 09:00:02 INFO\n  still fine",
+			},
+		},
+		{
+			name:  "indented",
+			opts:  MultilineOptions{Indented: true},
+			lines: trace,
+			expected: []string{
+				"2017-10-16 09:00:00 ERROR oops",
+				"java.lang.NullPointerException\n\tat Foo.bar(Foo.java:10)",
+				"Caused by: java.io.IOException\n\tat Foo.baz(Foo.java:20)",
+				"2017-10-16 09:00:01 INFO fine",
+				"2017-10-16 09:00:02 INFO\n  still fine",
+			},
+		},
+		{
+			name:  "continue",
+			opts:  MultilineOptions{Continue: `^(java\.|Caused by:)`, Indented: true},
+			lines: trace,
+			expected: []string{
+				"2017-10-16 09:00:00 ERROR oops\njava.lang.NullPointerException\n\tat Foo.bar(Foo.java:10)\nCaused by: java.io.IOException\n\tat Foo.baz(Foo.java:20)",
+				"2017-10-16 09:00:01 INFO fine",
+				"2017-10-16 09:00:02 INFO\n  still fine",
+			},
+		},
+		{
+			name:     "max lines",
+			opts:     MultilineOptions{Indented: true, MaxLines: 2},
+			lines:    []string{"a", " b", " c", " d", " e", "f"},
+			expected: []string{"a\n b", " c\n d", " e", "f"},
+		},
+		{
+			name:     "max bytes",
+			opts:     MultilineOptions{Indented: true, MaxBytes: 6},
+			lines:    []string{"a", " b", " c", "toolong", " d"},
+			expected: []string{"a\n b", " c", "toolong", " d"},
+		},
+		{
+			// a record can be started by a line that doesn't match
+			name:     "no start",
+			opts:     MultilineOptions{Start: `^start`},
+			lines:    []string{"middle", "start", "more"},
+			expected: []string{"middle", "start\nmore"},
+		},
+		{
+			// lines with a header from an input are matched on what follows
+			// it, and the header is only kept on the first
+			name:     "header",
+			opts:     MultilineOptions{Start: `^start`},
+			lines:    []string{"\x1eh1\x1estart", "\x1eh2\x1emore", "\x1eh3\x1estart"},
+			expected: []string{"\x1eh1\x1estart\nmore", "\x1eh3\x1estart"},
+		},
+	}
+	for _, test := range tests {
+		if records := joinLines(t, test.opts, test.lines); !reflect.DeepEqual(records, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, records)
+		}
+	}
+}
+
+func TestJoinerOptions(t *testing.T) {
+	if joiner, err := NewJoiner(MultilineOptions{MaxLines: 10}); joiner != nil || err != nil {
+		t.Error("expected no joiner when there's nothing to join lines by")
+	}
+	if _, err := NewJoiner(MultilineOptions{Start: "a", Indented: true}); err == nil {
+		t.Error("expected --multiline.start and --multiline.indented to be rejected together")
+	}
+	if _, err := NewJoiner(MultilineOptions{Continue: "("}); err == nil {
+		t.Error("expected a bad regex to be rejected")
+	}
+}
+
+func TestJoinerTimeout(t *testing.T) {
+	joiner, _ := NewJoiner(MultilineOptions{Indented: true, Timeout: 10})
+	in := make(chan Line)
+	records := joiner.Join(Source{Lines: in}).Lines
+	in <- Line{Text: "a"}
+	in <- Line{Text: " b"}
+	// no more lines are coming for now, so the record is passed on
+	select {
+	case record := <-records:
+		if record.Text != "a\n b" {
+			t.Errorf("expected the record so far, got %q", record.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the record to be passed on after the timeout")
+	}
+	in <- Line{Text: " c"}
+	close(in)
+	if record := <-records; record.Text != " c" {
+		t.Errorf("expected the line after the timeout to start a new record, got %q", record.Text)
+	}
+}
+
+func TestJoinerCheckpoint(t *testing.T) {
+	joiner, _ := NewJoiner(MultilineOptions{Start: `^@`})
+	checkpoint := newCheckpoint(0)
+	in := make(chan Line)
+	source := joiner.Join(Source{Lines: in, Checkpoint: checkpoint})
+	if source.Checkpoint != nil {
+		t.Error("expected the joined source to leave the checkpoint to the joiner")
+	}
+	// send the lines the way the tailer does, each 3 bytes long
+	go func() {
+		end := int64(0)
+		for i, line := range []string{"@a", " b", "@c", " d", " e", "@f"} {
+			start := end
+			end += int64(len(line)) + 1
+			checkpoint.sending(end)
+			in <- Line{Text: line, Offset: start, Number: int64(i + 1)}
+			checkpoint.sent()
+		}
+		close(in)
+	}()
+	// the first record is passed on once the second starts, and the statefile
+	// is kept at the start of the second. Each record has the position of its
+	// first line.
+	starts := []Line{{Offset: 0, Number: 1}, {Offset: 6, Number: 3}, {Offset: 15, Number: 6}}
+	for n, expected := range []int64{6, 15, 18} {
+		if record := <-source.Lines; record.Offset != starts[n].Offset || record.Number != starts[n].Number {
+			t.Errorf("expected record %d to start at line %d, offset %d, got line %d, offset %d",
+				n, starts[n].Number, starts[n].Offset, record.Number, record.Offset)
+		}
+		// the checkpoint moves just after the record is passed on
+		for i := 0; i < 100 && checkpoint.get() != expected; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if offset := checkpoint.get(); offset != expected {
+			t.Errorf("expected the checkpoint at the end of a record, %d, got %d", expected, offset)
+		}
+	}
+}
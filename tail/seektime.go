@@ -0,0 +1,210 @@
+package tail
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/httime"
+)
+
+// readFromTimePrefix starts a --tail.read_from value that gives the time to
+// start reading from
+const readFromTimePrefix = "time:"
+
+// timeFormats are the formats accepted by ParseTime. Those without a time zone
+// are in the one set by --timezone or --localtime.
+var timeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseTime parses the times given to --tail.read_from=time: and --stop_at.
+// They can be RFC3339, a date and time with or without the T, seconds or time
+// zone, just a date, or seconds since the epoch.
+func ParseTime(value string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	for _, format := range timeFormats {
+		if ts, err := httime.Parse(format, value); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse the time %q; use a format like 2006-01-02T15:04:05Z", value)
+}
+
+// readFromTime returns the time given by --tail.read_from=time:<timestamp>,
+// and false if it isn't set
+func readFromTime(conf Config) (time.Time, bool) {
+	if !strings.HasPrefix(conf.Options.ReadFrom, readFromTimePrefix) {
+		return time.Time{}, false
+	}
+	ts, err := ParseTime(strings.TrimPrefix(conf.Options.ReadFrom, readFromTimePrefix))
+	return ts, err == nil
+}
+
+// reachedStart reports whether line starts an event at or after start, the
+// time given by --tail.read_from=time:
+func reachedStart(conf Config, start time.Time, line string) bool {
+	ts, ok := conf.LineTimestamp(line)
+	return ok && !ts.Before(start)
+}
+
+// pastStop reports whether line starts an event from after --stop_at, which
+// is where to stop reading
+func pastStop(conf Config, line string) bool {
+	if conf.StopAt.IsZero() || conf.LineTimestamp == nil {
+		return false
+	}
+	ts, ok := conf.LineTimestamp(line)
+	return ok && ts.After(conf.StopAt)
+}
+
+// timeWindow picks out the lines from --tail.read_from=time: up to --stop_at
+// while reading from the beginning, for files that can't be bisected
+type timeWindow struct {
+	conf  Config
+	start time.Time
+	// skipping is set until the first event at or after start
+	skipping bool
+}
+
+func newTimeWindow(conf Config) *timeWindow {
+	start, skipping := readFromTime(conf)
+	return &timeWindow{
+		conf:     conf,
+		start:    start,
+		skipping: skipping && conf.LineTimestamp != nil,
+	}
+}
+
+// check returns whether line should be sent, and whether it's past --stop_at
+// so there's nothing more to read
+func (w *timeWindow) check(line string) (bool, bool) {
+	if w.skipping && reachedStart(w.conf, w.start, line) {
+		w.skipping = false
+	}
+	if pastStop(w.conf, line) {
+		return false, true
+	}
+	return !w.skipping, false
+}
+
+// getTimeLocation finds where to start reading file for
+// --tail.read_from=time:<timestamp>
+func getTimeLocation(conf Config, file string) (int64, error) {
+	start, ok := readFromTime(conf)
+	if !ok {
+		return 0, fmt.Errorf("can't parse the time in --tail.read_from=%s", conf.Options.ReadFrom)
+	}
+	if conf.LineTimestamp == nil {
+		return 0, fmt.Errorf("--tail.read_from=%s needs a parser that can find the time of each event", conf.Options.ReadFrom)
+	}
+	offset, err := seekTime(file, start, conf.Options, conf.LineTimestamp)
+	if err != nil {
+		return 0, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"file":   file,
+		"time":   start,
+		"offset": offset,
+	}).Info("Found where to start reading the file")
+	return offset, nil
+}
+
+// seekTime returns the offset of the first line in path that starts an event
+// at or after t, or the size of the file if there isn't one. It bisects the
+// file rather than reading all of it, so it relies on the times in it only
+// ever going up. Lines are split up and decoded the way opts say.
+func seekTime(path string, t time.Time, opts TailOptions, timestamp func(line string) (time.Time, bool)) (int64, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	info, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	decoder, _ := NewDecoder(opts)
+
+	// found is the earliest line known to be at or after t. Any earlier one
+	// starts somewhere from lo up to hi.
+	found := size
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		// lines start on a whole character
+		mid -= mid % decoder.unitSize()
+		offset, ts, ok, err := nextTimestamp(fh, mid, hi, decoder, opts, timestamp)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case !ok:
+			// there are no times from mid up to hi
+			hi = mid
+		case ts.Before(t):
+			lo = offset + 1
+		default:
+			found = offset
+			hi = mid
+		}
+	}
+	return found, nil
+}
+
+// nextTimestamp finds the first line starting at or after from and before to
+// that has a time in it. It returns the line's offset and time, and false if
+// there's no such line.
+func nextTimestamp(fh *os.File, from int64, to int64, decoder *Decoder, opts TailOptions,
+	timestamp func(line string) (time.Time, bool)) (int64, time.Time, bool, error) {
+	offset := from
+	if from > 0 {
+		// back up a character to tell whether from is at the start of a line
+		offset -= decoder.unitSize()
+	}
+	records := newRecordReader(io.NewSectionReader(fh, offset, 1<<62), decoder, opts)
+	records.uncounted = true
+	if from > 0 {
+		_, n, err := records.read()
+		offset += n
+		if err == io.EOF {
+			return 0, time.Time{}, false, nil
+		}
+		if err != nil && err != errRecordSkipped {
+			return 0, time.Time{}, false, err
+		}
+	}
+	for offset < to {
+		record, n, err := records.read()
+		if hasRecord(record, err) {
+			text, _ := decoder.convert(record, offset == 0)
+			if ts, ok := timestamp(text); ok {
+				return offset, ts, true, nil
+			}
+		}
+		offset += n
+		if err == errRecordSkipped {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, time.Time{}, false, err
+		}
+	}
+	return 0, time.Time{}, false, nil
+}
@@ -0,0 +1,139 @@
+package tail
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLineTimestamp finds the time in lines like "@<seconds> ...". Other lines
+// carry on the event before them.
+func testLineTimestamp(line string) (time.Time, bool) {
+	if !strings.HasPrefix(line, "@") {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(strings.Fields(line[1:])[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+func TestParseTime(t *testing.T) {
+	expected := time.Date(2017, 10, 16, 9, 0, 0, 0, time.UTC)
+	for _, value := range []string{
+		"2017-10-16T09:00:00Z",
+		"2017-10-16T11:00:00+02:00",
+		"2017-10-16T09:00:00",
+		"2017-10-16 09:00:00",
+		"2017-10-16 09:00",
+		"1508144400",
+	} {
+		ts, err := ParseTime(value)
+		if err != nil {
+			t.Errorf("failed to parse %s: %s", value, err)
+		} else if !ts.Equal(expected) {
+			t.Errorf("parsed %s as %s, expected %s", value, ts, expected)
+		}
+	}
+	if _, err := ParseTime("09:00"); err == nil {
+		t.Error("expected a time without a date to be rejected")
+	}
+}
+
+func TestSeekTime(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	// events at every 10 seconds, most of them with a continuation line and
+	// some with several events at the same time
+	body := ""
+	offsets := map[int]int{}
+	for i := 0; i < 200; i++ {
+		secs := i / 2 * 10
+		if _, ok := offsets[secs]; !ok {
+			offsets[secs] = len(body)
+		}
+		body += fmt.Sprintf("@%d event %d\n", secs, i)
+		if i%3 != 0 {
+			body += "  more of it\n"
+		}
+	}
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, body)
+
+	for secs := -5; secs <= 1000; secs += 5 {
+		expected := len(body)
+		for at := secs; at < 1000; at++ {
+			if offset, ok := offsets[at]; ok && at >= secs {
+				expected = offset
+				break
+			}
+		}
+		offset, err := seekTime(file, time.Unix(int64(secs), 0), TailOptions{}, testLineTimestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != int64(expected) {
+			t.Errorf("for %d, expected offset %d, got %d", secs, expected, offset)
+		}
+	}
+
+	// no times at all
+	ts.writeFile(t, file, "a\nb\nc")
+	offset, err := seekTime(file, time.Unix(0, 0), TailOptions{}, testLineTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 5 {
+		t.Errorf("expected to start at the end of a file without times, got %d", offset)
+	}
+}
+
+func TestReadFromTimeAndStopAt(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "@10 a\n  a2\n@20 b\n  b2\n@30 c\n@40 d\n  d2\n")
+	conf := Config{
+		Paths:         []string{file},
+		Options:       tailOpts,
+		LineTimestamp: testLineTimestamp,
+		StopAt:        time.Unix(30, 0),
+	}
+	conf.Options.ReadFrom = "time:15"
+	conf.Options.StateFile = ts.tmpdir + "/app.state"
+	chans, err := watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{"@20 b", "  b2", "@30 c"})
+
+	// compressed files are read from the beginning, skipping what's before
+	// the time, and no more are read after stopping
+	old := ts.tmpdir + "/old.log"
+	writeGzip(t, old+".2.gz", "@1 x\n@11 y\n  y2\n")
+	writeGzip(t, old+".1.gz", "@21 z\n@31 w\n")
+	writeGzip(t, old+".0.gz", "@41 v\n")
+	now := time.Now()
+	for i, name := range []string{old + ".2.gz", old + ".1.gz", old + ".0.gz"} {
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf.Paths = []string{old + ".*"}
+	conf.Options.ReadFrom = "time:5"
+	conf.Options.StateFile = ts.tmpdir
+	chans, err = watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{"@11 y", "  y2", "@21 z"})
+}
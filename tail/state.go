@@ -0,0 +1,300 @@
+package tail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// how many bytes from the start of a file go into its fingerprint. Inode
+// numbers get reused, so a file is only taken to be the one in the statefile
+// if these bytes haven't changed either.
+var fingerprintSize int64 = 1024
+
+// stateStore is where the position reached in a file, or a sequence of files,
+// is kept between runs
+type stateStore interface {
+	// load returns the saved state, or an error if there isn't one
+	load() (State, error)
+	save(state State)
+	remove()
+}
+
+// getStateStore returns the store for the file or pattern key. name is what
+// the statefile is named after when there's no state database.
+func getStateStore(conf Config, key string, name string, numFiles int) stateStore {
+	if conf.StateDB != nil {
+		if abs, err := filepath.Abs(key); err == nil {
+			key = abs
+		}
+		return &stateDBEntry{db: conf.StateDB, key: key}
+	}
+	return &stateFileStore{path: getStateFile(conf, name, numFiles)}
+}
+
+// stateFileStore keeps the state in a statefile of its own
+type stateFileStore struct {
+	path string
+	// warned is set once a failure to save has been logged
+	warned bool
+	// saved is the state last written, if there is one, so that it isn't
+	// written again every time it's saved without having changed
+	saved *State
+}
+
+func (s *stateFileStore) load() (State, error) {
+	state := State{}
+	content, err := ioutil.ReadFile(s.path)
+	if err == nil {
+		err = json.Unmarshal(content, &state)
+	}
+	return state, err
+}
+
+func (s *stateFileStore) save(state State) {
+	if s.saved != nil && reflect.DeepEqual(*s.saved, state) {
+		return
+	}
+	out, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(s.path, append(out, '\n'))
+	}
+	if err == nil {
+		s.saved = &state
+	}
+	if err != nil && !s.warned {
+		s.warned = true
+		logrus.WithFields(logrus.Fields{
+			"statefile": s.path,
+			"err":       err,
+		}).Warn("Failed to write statefile. File location will not be saved.")
+	}
+}
+
+func (s *stateFileStore) remove() {
+	s.saved = nil
+	os.Remove(s.path)
+}
+
+func (s *stateFileStore) String() string {
+	return s.path
+}
+
+// StateDB keeps the states of every file in one JSON file, keyed by path,
+// instead of a statefile for each
+type StateDB struct {
+	path   string
+	lock   sync.Mutex
+	states map[string]State
+	// warned is set once a failure to save has been logged
+	warned bool
+}
+
+// OpenStateDB reads the state database at path, creating it if it doesn't
+// exist yet
+func OpenStateDB(path string) (*StateDB, error) {
+	db := &StateDB{
+		path:   path,
+		states: make(map[string]State),
+	}
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(content, &db.states)
+	} else if os.IsNotExist(err) {
+		// make sure it can be written before we start
+		err = db.write()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// write saves every state. The lock must be held.
+func (db *StateDB) write() error {
+	out, err := json.MarshalIndent(db.states, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(db.path, append(out, '\n'))
+}
+
+// update makes a change to the states and saves them
+func (db *StateDB) update(change func(states map[string]State)) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	change(db.states)
+	if err := db.write(); err != nil && !db.warned {
+		db.warned = true
+		logrus.WithFields(logrus.Fields{
+			"state_db": db.path,
+			"err":      err,
+		}).Warn("Failed to write the state database. File locations will not be saved.")
+	}
+}
+
+// stateDBEntry keeps the state in a StateDB
+type stateDBEntry struct {
+	db  *StateDB
+	key string
+}
+
+func (e *stateDBEntry) load() (State, error) {
+	e.db.lock.Lock()
+	defer e.db.lock.Unlock()
+	state, ok := e.db.states[e.key]
+	if !ok {
+		return state, os.ErrNotExist
+	}
+	return state, nil
+}
+
+func (e *stateDBEntry) save(state State) {
+	e.db.lock.Lock()
+	unchanged := reflect.DeepEqual(e.db.states[e.key], state)
+	e.db.lock.Unlock()
+	if unchanged {
+		return
+	}
+	e.db.update(func(states map[string]State) {
+		states[e.key] = state
+	})
+}
+
+func (e *stateDBEntry) remove() {
+	e.db.update(func(states map[string]State) {
+		delete(states, e.key)
+	})
+}
+
+func (e *stateDBEntry) String() string {
+	return e.db.path + ":" + e.key
+}
+
+// writeFileAtomic replaces the contents of path with data by writing a
+// temporary file and renaming it over the top, so a crash can't leave path
+// empty or half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := atomicTempFile(path)
+	fh, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// make the rename itself durable
+	if dirFh, err := os.Open(filepath.Dir(path)); err == nil {
+		dirFh.Sync()
+		dirFh.Close()
+	}
+	return nil
+}
+
+// atomicTempFile returns the temporary file writeFileAtomic uses for path. It's
+// hidden, and for statefiles still ends in .leash.state, so globs over the
+// same directory skip it.
+func atomicTempFile(path string) string {
+	dir, base := filepath.Split(path)
+	return filepath.Join(dir, "."+base)
+}
+
+// setIdentity records which file state is for: its device, inode number and
+// a fingerprint of its first bytes
+func setIdentity(state *State, file string) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	setOpenIdentity(state, fh)
+}
+
+// setOpenIdentity is setIdentity for a file that's already open, which stays
+// the same file whatever happens to its path. Nothing is changed once it's
+// been closed.
+func setOpenIdentity(state *State, fh *os.File) {
+	info, err := fh.Stat()
+	if err != nil {
+		return
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if state.INode == stat.Ino && state.Device == uint64(stat.Dev) &&
+		state.FingerprintSize >= fingerprintSize {
+		// the fingerprint is complete and can't have changed
+		return
+	}
+	state.INode = stat.Ino
+	state.Device = uint64(stat.Dev)
+	state.Fingerprint, state.FingerprintSize = fingerprintOf(fh, fingerprintSize)
+}
+
+// fileID returns the device and inode number the state was saved for
+func (s State) fileID() fileID {
+	return fileID{dev: s.Device, ino: s.INode}
+}
+
+// sameFile returns true if file is the one state was saved for. Statefiles
+// written before fingerprints were added only have the inode to go by.
+func sameFile(state State, file string) bool {
+	stat := unix.Stat_t{}
+	if err := unix.Stat(file, &stat); err != nil {
+		return false
+	}
+	if state.INode != stat.Ino {
+		return false
+	}
+	if state.Device != 0 && state.Device != uint64(stat.Dev) {
+		return false
+	}
+	if state.Fingerprint != "" {
+		sum, size := fingerprint(file, state.FingerprintSize)
+		if size != state.FingerprintSize || sum != state.Fingerprint {
+			return false
+		}
+	}
+	return true
+}
+
+// fingerprint returns a hash of up to the first n bytes of file, and how many
+// bytes went into it
+func fingerprint(file string, n int64) (string, int64) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return "", 0
+	}
+	defer fh.Close()
+	return fingerprintOf(fh, n)
+}
+
+// fingerprintOf is fingerprint for a file that's already open. It doesn't
+// move the file's offset.
+func fingerprintOf(fh *os.File, n int64) (string, int64) {
+	hash := sha256.New()
+	size, _ := io.Copy(hash, io.NewSectionReader(fh, 0, n))
+	return hex.EncodeToString(hash.Sum(nil)), size
+}
@@ -0,0 +1,151 @@
+package tail
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSameFile(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "first line\n")
+	state := State{}
+	setIdentity(&state, file)
+	if state.Device == 0 || state.Fingerprint == "" || state.FingerprintSize != 11 {
+		t.Fatalf("expected the identity to be filled in, got %+v", state)
+	}
+	if !sameFile(state, file) {
+		t.Error("expected a file to be the same as itself")
+	}
+
+	// appending doesn't change the start of the file
+	fh, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString("second line\n")
+	fh.Close()
+	if !sameFile(state, file) {
+		t.Error("expected a file that was appended to to be the same file")
+	}
+
+	// rewriting it in place keeps the inode, like a new file that reused it
+	ts.writeFile(t, file, "something else\n")
+	if !sameFile(State{INode: state.INode}, file) {
+		t.Error("expected an old statefile with only an inode to match")
+	}
+	if sameFile(state, file) {
+		t.Error("expected different contents to be a different file")
+	}
+}
+
+func TestStateFileAtomic(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	store := &stateFileStore{path: ts.tmpdir + "/app.leash.state"}
+	if _, err := store.load(); err == nil {
+		t.Error("expected an error loading a missing statefile")
+	}
+	store.save(State{INode: 1, Offset: 100})
+	store.save(State{INode: 1, Offset: 5})
+	state, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Offset != 5 {
+		t.Errorf("expected the last state saved, got %+v", state)
+	}
+	// nothing is left behind but the statefile
+	files, _ := ioutil.ReadDir(ts.tmpdir)
+	if len(files) != 1 {
+		t.Errorf("expected only the statefile, got %d files", len(files))
+	}
+	// a state that hasn't changed isn't written again
+	inode := inodeOf(store.path)
+	store.save(State{INode: 1, Offset: 5})
+	if inodeOf(store.path) != inode {
+		t.Error("expected an unchanged state not to replace the statefile")
+	}
+	store.remove()
+	if _, err := os.Stat(store.path); !os.IsNotExist(err) {
+		t.Errorf("expected the statefile to be removed, got %v", err)
+	}
+	// but it is once the statefile's been removed
+	store.save(State{INode: 1, Offset: 5})
+	if _, err := os.Stat(store.path); err != nil {
+		t.Errorf("expected the statefile to be written again, got %v", err)
+	}
+}
+
+func TestStateDB(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	dbFile := ts.tmpdir + "/state.json"
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "a\nb\n")
+	conf := Config{
+		Paths:   []string{ts.tmpdir + "/*"},
+		Options: tailOpts,
+	}
+	conf.Options.StateDB = dbFile
+	conf.StateGate = NewStateGate()
+	db, err := OpenStateDB(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.StateDB = db
+
+	// the database isn't mistaken for a log file
+	chans, err := watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chans) != 1 {
+		t.Fatalf("expected one lines channel, got %d", len(chans))
+	}
+	checkLinesChan(t, chans[0], []string{"a", "b"})
+	conf.StateGate.Open()
+
+	// the position is in the database, not a statefile of its own
+	if _, err := os.Stat(ts.tmpdir + "/app.leash.state"); !os.IsNotExist(err) {
+		t.Errorf("expected no statefile, got %v", err)
+	}
+	db, err = OpenStateDB(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &stateDBEntry{db: db, key: file}
+	state, err := entry.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameFile(state, file) {
+		t.Errorf("expected the database to have the file's identity, got %+v", state)
+	}
+
+	// and it's picked up on the next run
+	state.Offset = 4
+	entry.save(state)
+	fh, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString("c\n")
+	fh.Close()
+	conf.Options.ReadFrom = "last"
+	conf.StateDB = db
+	conf.StateGate = nil
+	chans, err = watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{"c"})
+}
@@ -5,20 +5,22 @@
 package tail
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/hpcloud/tail"
 	"golang.org/x/sys/unix"
+
+	"github.com/honeycombio/honeytail/metrics"
 )
 
 type RotateStyle int
@@ -26,16 +28,28 @@ type RotateStyle int
 const (
 	// foo.log gets rotated to foo.log.1, new entries go to foo.log
 	RotateStyleSyslog RotateStyle = iota
-	// foo.log.OLDSTAMP gets closed, new entries go to foo.log.NEWSTAMP
-	// NOT YET IMPLEMENTED
+	// foo.log.OLDSTAMP gets closed, new entries go to foo.log.NEWSTAMP. Paths
+	// are globs matching the whole sequence of files.
 	RotateStyleTimestamp
 )
 
 type TailOptions struct {
-	ReadFrom  string `long:"read_from" description:"Location in the file from which to start reading. Values: beginning, end, last. Last picks up where it left off, if the file has not been rotated, otherwise beginning. When --backfill is set, it will override this option=beginning" default:"last"`
-	Stop      bool   `long:"stop" description:"Stop reading the file after reaching the end rather than continuing to tail. When --backfill is set, it will override this option=true"`
-	Poll      bool   `long:"poll" description:"use poll instead of inotify to tail files"`
-	StateFile string `long:"statefile" description:"File in which to store the last read position. Defaults to a file in /tmp named $logfile.leash.state. If tailing multiple files, default is forced."`
+	ReadFrom            string `long:"read_from" description:"Location in the file from which to start reading. Values: beginning, end, last, time:<timestamp>. Last picks up where it left off, if the file has not been rotated, otherwise beginning. Time starts at the first event at or after the timestamp, like time:2017-10-16T09:00:00Z, going by the times the parser finds in the file. When --backfill is set, it will override this option=beginning, except for time" default:"last"`
+	Stop                bool   `long:"stop" description:"Stop reading the file after reaching the end rather than continuing to tail. When --backfill is set, it will override this option=true"`
+	Poll                bool   `long:"poll" description:"use poll instead of inotify to tail files"`
+	StateFile           string `long:"statefile" description:"File in which to store the last read position. Defaults to a file in /tmp named $logfile.leash.state. If tailing multiple files, default is forced."`
+	RotateStyle         string `long:"rotate_style" description:"How the log files are rotated. Values: syslog, timestamp. Syslog means foo.log is moved aside and a new foo.log is started. Timestamp means a new file is started with a later date stamp in its name, like app.log.2017-10-16; --file is then a glob matching all of them, and the names must sort in the order they're written" default:"syslog"`
+	RescanInterval      uint   `long:"rescan_interval" description:"How often, in seconds, to look for new files matching the --file globs, and to stop tailing files that have been deleted. 0 turns it off. Not used with --tail.stop" default:"10"`
+	MaxOpenFiles        uint   `long:"max_open_files" description:"Maximum number of files to tail at once. Files found beyond that wait until another file is deleted and fully read, or with --tail.stop, until another file is done. 0 means no limit"`
+	CompressedOrder     string `long:"compressed_order" description:"Order in which to read the compressed files (.gz, .bz2, .zst, .xz) matching each --file with --tail.stop. Values: mtime, name. Mtime reads the oldest first" default:"mtime"`
+	Resume              bool   `long:"resume" description:"Carry on reading compressed files, and files read with --tail.backfill_readers, from where the statefile says an earlier run stopped, even though --backfill sets --tail.read_from=beginning"`
+	StateDB             string `long:"state_db" description:"File in which to keep the last read positions of all the files, keyed by path, instead of a statefile for each. Overrides --tail.statefile"`
+	BackfillReaders     uint   `long:"backfill_readers" description:"With --tail.stop, split each file into chunks and read this many of them at once, each feeding a parser of its own. Only for parsers that treat every line separately, so not mysql or postgresql. 0 or 1 reads each file straight through"`
+	Encoding            string `long:"encoding" description:"Character set the files and stdin are written in, to turn them into UTF-8 before they're parsed. A byte order mark at the start is dropped. Values: utf-8, utf-16le, utf-16be, latin1, windows-1252, windows-1251. utf-8 only replaces invalid bytes. Leave empty to pass lines on as they are"`
+	EncodingReplacement string `long:"encoding_replacement" description:"What to put in place of bytes that aren't valid in --tail.encoding. Empty drops them" default:"�"`
+	Framing             string `long:"framing" description:"How records are split up in files and stdin. Values: newline, crlf, nul, length. Crlf also drops the \\r of a \\r\\n. Nul splits them at NUL bytes, so records can have newlines in them. Length means each record starts with its size in bytes and a space, like '5 hello'" default:"newline"`
+	MaxRecordBytes      uint   `long:"max_record_bytes" description:"Maximum size of a record read from a file or stdin, in bytes. What happens to bigger ones is set by --tail.oversize_record. 0 means no limit"`
+	OversizeRecord      string `long:"oversize_record" description:"What to do with records bigger than --tail.max_record_bytes. Values: truncate, skip" default:"truncate"`
 }
 
 // Statefile mechanics when ReadFrom is 'last'
@@ -43,53 +57,148 @@ type TailOptions struct {
 // empty statefile => ReadFrom = end
 // permission denied => WARN and ReadFrom = end
 // invalid location (aka logfile's been rotated) => ReadFrom = beginning
+// offset past the end (aka logfile's been truncated) => ReadFrom = beginning
 
 type Config struct {
 	// Path to the log file to tail
 	Paths []string
+	// Dirs are directories to tail the files in, and in the directories under
+	// them, picked out by Dir
+	Dirs []string
+	Dir  DirOptions
 	// Type of log rotation we expect on this file
 	Type RotateStyle
 	// Tail specific options
 	Options TailOptions
+	// StateGate, if set, holds back the statefile write each file makes when
+	// tailing stops until the gate is opened
+	StateGate *StateGate
+	// StateDB, if set, is where the read positions are kept instead of
+	// statefiles
+	StateDB *StateDB
+	// LineTimestamp, if set, returns the time of the event a line starts. It's
+	// needed for --tail.read_from=time: and StopAt.
+	LineTimestamp func(line string) (time.Time, bool)
+	// StopAt, if set, stops reading each file at the first event after it
+	StopAt time.Time
+}
+
+// StateGate lets the caller delay the final statefile writes made when tailing
+// stops until everything that was read has made it all the way through the
+// pipeline, so a restart doesn't skip over lines that were never sent.
+type StateGate struct {
+	open    chan struct{}
+	writers sync.WaitGroup
+}
+
+// NewStateGate returns a closed gate
+func NewStateGate() *StateGate {
+	return &StateGate{open: make(chan struct{})}
+}
+
+// Open lets the held back statefile writes go ahead, and waits for them all to
+// finish. It must only be called once tailing has stopped for every file.
+func (g *StateGate) Open() {
+	close(g.open)
+	g.writers.Wait()
+}
+
+// hold registers a statefile write that has to wait for the gate
+func (g *StateGate) hold() {
+	if g != nil {
+		g.writers.Add(1)
+	}
+}
+
+// wait blocks until the gate is opened
+func (g *StateGate) wait() {
+	if g != nil {
+		<-g.open
+	}
+}
+
+// release marks a held back statefile write as done
+func (g *StateGate) release() {
+	if g != nil {
+		g.writers.Done()
+	}
 }
 
 // State is what's stored in a statefile
 type State struct {
 	INode  uint64 // the inode
 	Offset int64
+	// File is the file being read, when following timestamped files
+	File string `json:",omitempty"`
+	// Device, along with the inode, identifies the file
+	Device uint64 `json:",omitempty"`
+	// Fingerprint is a hash of the first FingerprintSize bytes of the file,
+	// which tells it apart from a new file that reused the inode
+	Fingerprint     string `json:",omitempty"`
+	FingerprintSize int64  `json:",omitempty"`
+	// ChunkSize and Chunks record which chunks of the file have been read,
+	// by where they start, when it's read with --tail.backfill_readers
+	ChunkSize int64   `json:",omitempty"`
+	Chunks    []int64 `json:",omitempty"`
 }
 
-// GetSampledEntries wraps GetEntries and returns a list of channels that
-// provide sampled entries
-func GetSampledEntries(ctx context.Context, conf Config, sampleRate uint) ([]chan string, error) {
-	unsampledLinesChans, err := GetEntries(ctx, conf)
-	if err != nil {
-		return nil, err
-	}
-	if sampleRate == 1 {
-		return unsampledLinesChans, nil
-	}
+// SampleRate is a sample rate that can be changed while lines are being read
+type SampleRate struct {
+	rate uint64
+}
 
-	sampledLinesChans := make([]chan string, 0, len(unsampledLinesChans))
+// NewSampleRate returns a SampleRate starting out at rate
+func NewSampleRate(rate uint) *SampleRate {
+	return &SampleRate{rate: uint64(rate)}
+}
 
-	for _, lines := range unsampledLinesChans {
-		sampledLines := make(chan string)
-		go func(pLines chan string) {
-			defer close(sampledLines)
-			for line := range pLines {
-				if shouldDrop(sampleRate) {
-					logrus.WithFields(logrus.Fields{
-						"line":       line,
-						"samplerate": sampleRate,
-					}).Debug("Sampler says skip this line")
-				} else {
-					sampledLines <- line
-				}
+// Get returns the current rate
+func (s *SampleRate) Get() uint {
+	return uint(atomic.LoadUint64(&s.rate))
+}
+
+// Set changes the rate for all lines read from now on
+func (s *SampleRate) Set(rate uint) {
+	atomic.StoreUint64(&s.rate, uint64(rate))
+}
+
+// SampleSourceLines passes on about one in every sampleRate of the source's
+// lines, and tells its checkpoint which lines were dropped, so lines committed
+// by the parser can still be matched up with where they came from
+func SampleSourceLines(source Source, sampleRate *SampleRate) chan Line {
+	return sampleLines(source.Lines, sampleRate, source.Checkpoint)
+}
+
+func sampleLines(lines chan Line, sampleRate *SampleRate, checkpoint *Checkpoint) chan Line {
+	sampledLines := make(chan Line)
+	go func() {
+		defer close(sampledLines)
+		for line := range lines {
+			if rate := sampleRate.Get(); shouldDrop(rate) {
+				logrus.WithFields(logrus.Fields{
+					"line":       line.Text,
+					"samplerate": rate,
+				}).Debug("Sampler says skip this line")
+				checkpoint.sample(false)
+			} else {
+				checkpoint.sample(true)
+				sampledLines <- line
 			}
-		}(lines)
-		sampledLinesChans = append(sampledLinesChans, sampledLines)
-	}
-	return sampledLinesChans, nil
+		}
+	}()
+	return sampledLines
+}
+
+// Texts passes on the text of each of lines, for a parser
+func Texts(lines chan Line) chan string {
+	texts := make(chan string)
+	go func() {
+		defer close(texts)
+		for line := range lines {
+			texts <- line.Text
+		}
+	}()
+	return texts
 }
 
 // shouldDrop returns true if the line should be dropped
@@ -100,48 +209,74 @@ func shouldDrop(rate uint) bool {
 	return rand.Intn(int(rate)) != 0
 }
 
-// GetEntries sets up a list of channels that get one line at a time from each
-// file down each channel.
-func GetEntries(ctx context.Context, conf Config) ([]chan string, error) {
-	if conf.Type != RotateStyleSyslog {
-		return nil, errors.New("Only Syslog style rotation currently supported")
-	}
-	// expand any globs in the list of files so our list all represents real files
+// expandPaths expands any globs in the list of files so our list all
+// represents real files, and adds the files found in the directories.
+// Compressed files are returned separately, grouped by the glob or directory
+// they were found with.
+func expandPaths(conf Config) ([]string, []compressedGroup, error) {
 	var filenames []string
+	var groups []compressedGroup
+	add := func(path string, files []string) {
+		files = removeStateFiles(files, conf)
+		var compressed []string
+		for _, file := range files {
+			if compressionOf(file) != "" {
+				compressed = append(compressed, file)
+			} else {
+				filenames = append(filenames, file)
+			}
+		}
+		if len(compressed) > 0 {
+			sortCompressed(conf, compressed)
+			groups = append(groups, compressedGroup{path: path, files: compressed})
+		}
+	}
 	for _, filePath := range conf.Paths {
 		if filePath == "-" {
 			filenames = append(filenames, filePath)
 		} else {
 			files, err := filepath.Glob(filePath)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			files = removeStateFiles(files, conf)
-			filenames = append(filenames, files...)
+			add(filePath, files)
 		}
 	}
-	if len(filenames) == 0 {
-		return nil, errors.New("After removing missing files and state files from the list, there are no files left to tail")
+	if len(conf.Dirs) > 0 {
+		filter, err := NewDirFilter(conf.Dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		// a file linked to from more than one of the directories is only
+		// tailed once
+		walk := filter.newWalk()
+		for _, dir := range conf.Dirs {
+			found := len(walk.files)
+			walk.walk(dir, "")
+			add(dir, walk.files[found:])
+		}
 	}
+	return filenames, groups, nil
+}
 
-	// make our lines channel list; we'll get one channel for each file
-	linesChans := make([]chan string, 0, len(filenames))
-	numFiles := len(filenames)
-	for _, file := range filenames {
-		var lines chan string
-		if file == "-" {
-			lines = tailStdIn(ctx)
+// getTimestampedEntries sets up a lines channel for each sequence of
+// timestamped files
+func getTimestampedEntries(ctx context.Context, conf Config) ([]chan Line, error) {
+	linesChans := make([]chan Line, 0, len(conf.Paths))
+	for _, pattern := range conf.Paths {
+		var lines chan Line
+		if pattern == "-" {
+			lines = tailStdIn(ctx, conf)
 		} else {
-			stateFile := getStateFile(conf, file, numFiles)
-			tailer, err := getTailer(conf, file, stateFile)
+			store := getStateStore(conf, pattern, timestampedStateFileName(pattern), len(conf.Paths))
+			var err error
+			lines, err = tailTimestampedFiles(ctx, conf, pattern, store)
 			if err != nil {
 				return nil, err
 			}
-			lines = tailSingleFile(ctx, tailer, file, stateFile)
 		}
 		linesChans = append(linesChans, lines)
 	}
-
 	return linesChans, nil
 }
 
@@ -157,6 +292,13 @@ func removeStateFiles(files []string, conf Config) []string {
 			}).Debug("skipping tailing file because it is named the same as the statefile flag")
 			continue
 		}
+		if conf.Options.StateDB != "" &&
+			(file == conf.Options.StateDB || file == atomicTempFile(conf.Options.StateDB)) {
+			logrus.WithFields(logrus.Fields{
+				"file": file,
+			}).Debug("skipping tailing file because it is the state database")
+			continue
+		}
 		if strings.HasSuffix(file, ".leash.state") {
 			logrus.WithFields(logrus.Fields{
 				"file": file,
@@ -169,62 +311,106 @@ func removeStateFiles(files []string, conf Config) []string {
 	return newFiles
 }
 
-func tailSingleFile(ctx context.Context, tailer *tail.Tail, file string, stateFile string) chan string {
-	lines := make(chan string)
+// tailRetirableFile sends the lines the tailer reads from file, keeping the
+// statefile up to date as it goes, for files that may be deleted. Closing
+// retire finishes reading what's left of the file, closes the lines channel
+// and removes the statefile. Closing idle does the same for a file that's
+// stopped being written to, but writes the statefile straight away instead,
+// so it can be picked up again. done, if set, is called once the lines
+// channel is closed. The statefile is kept at checkpoint.
+func tailRetirableFile(ctx context.Context, conf Config, tailer *follower, file string, store stateStore,
+	checkpoint *Checkpoint, retire, idle <-chan struct{}, done func()) chan Line {
+	lines := make(chan Line)
 	// TODO report some metric to indicate whether we're keeping up with the
 	// front of the file, of if it's being written faster than we can send
 	// events
 
-	stateFh, err := os.OpenFile(stateFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"logfile":   file,
-			"statefile": stateFile,
-		}).Warn("Failed to open statefile for writing. File location will not be saved.")
-	}
-
-	ticker := time.NewTicker(time.Second)
 	state := State{}
-	go func() {
-		for range ticker.C {
-			updateStateFile(&state, tailer, file, stateFh)
-		}
-	}()
+	// the periodic updates have to stop before the final one
+	stopTicker := everySecond(func() {
+		tailer.identify(&state)
+		updateStateFile(&state, checkpoint.get(), store)
+	})
 
+	conf.StateGate.hold()
+
+	// the follower is cancelled on its own when reaching StopAt
+	tailerCtx, stopTailer := context.WithCancel(ctx)
+	go tailer.run(tailerCtx)
 	go func() {
+		defer stopTailer()
+		retired, idled := false, false
 	ReadLines:
 		for {
 			select {
-			case line, ok := <-tailer.Lines:
+			case line, ok := <-tailer.lines:
 				if !ok {
-					// tailer.Lines is closed
+					// tailer.lines is closed
 					break ReadLines
 				}
-				if line.Err != nil {
-					// skip errored lines
-					continue
+				if pastStop(conf, line.Text) {
+					logrus.WithFields(logrus.Fields{
+						"file":    file,
+						"stop_at": conf.StopAt,
+					}).Info("Reached --stop_at, done reading the file")
+					break ReadLines
 				}
-				lines <- line.Text
+				checkpoint.sending(line.end)
+				lines <- line.Line
+				checkpoint.sent()
+			case <-retire:
+				// the follower keeps going to the end of the file
+				retired = true
+				retire = nil
+				tailer.stopAtEOF()
+			case <-idle:
+				idled = true
+				idle = nil
+				tailer.stopAtEOF()
 			case <-ctx.Done():
 				// will only trigger when the context is cancelled
 				break ReadLines
 			}
 		}
 		close(lines)
-		ticker.Stop()
-		updateStateFile(&state, tailer, file, stateFh)
-		stateFh.Close()
+		stopTicker()
+		if idled && !retired {
+			// the file is tailed again if it's written to, and the new
+			// tailer's statefile writes mustn't be undone by this one's once
+			// the gate opens
+			tailer.identify(&state)
+			updateStateFile(&state, checkpoint.get(), store)
+			conf.StateGate.release()
+			if done != nil {
+				done()
+			}
+			return
+		}
+		if done != nil {
+			done()
+		}
+		conf.StateGate.wait()
+		if retired {
+			// the file is gone, so there's nothing to pick up from
+			store.remove()
+		} else {
+			tailer.identify(&state)
+			updateStateFile(&state, checkpoint.get(), store)
+		}
+		conf.StateGate.release()
 	}()
 	return lines
 }
 
 // tailStdIn is a special case to tail STDIN without any of the
 // fancy stuff that the tail module provides
-func tailStdIn(ctx context.Context) chan string {
-	lines := make(chan string)
-	input := bufio.NewReader(os.Stdin)
+func tailStdIn(ctx context.Context, conf Config) chan Line {
+	lines := make(chan Line)
+	decoder, _ := NewDecoder(conf.Options)
+	records := newRecordReader(os.Stdin, decoder, conf.Options)
 	go func() {
 		defer close(lines)
+		var offset, number int64
 		for {
 			// check for signal triggered exit
 			select {
@@ -232,19 +418,21 @@ func tailStdIn(ctx context.Context) chan string {
 				return
 			default:
 			}
-			line, partialLine, err := input.ReadLine()
-			if err != nil {
+			record, n, err := records.read()
+			if hasRecord(record, err) {
+				// a \r before the newline is always dropped
+				text := strings.TrimSuffix(records.text(record, offset == 0), "\r")
+				number++
+				lines <- Line{Text: text, Path: "-", Offset: offset, Number: number}
+			} else if err == errRecordSkipped {
+				number++
+			}
+			offset += n
+			if err != nil && err != errRecordSkipped {
 				logrus.Debug("stdin is closed")
 				// bail when STDIN closes
 				return
 			}
-			var parts []string
-			parts = append(parts, string(line))
-			for partialLine {
-				line, partialLine, _ = input.ReadLine()
-				parts = append(parts, string(line))
-			}
-			lines <- strings.Join(parts, "")
 		}
 	}()
 	return lines
@@ -252,33 +440,15 @@ func tailStdIn(ctx context.Context) chan string {
 
 // getStartLocation reads the state file and creates an appropriate start
 // location.  See details at the top of this file on how the loc is chosen.
-func getStartLocation(stateFile string, logfile string) *tail.SeekInfo {
+func getStartLocation(store stateStore, logfile string) *tail.SeekInfo {
 	beginning := &tail.SeekInfo{}
 	end := &tail.SeekInfo{0, 2}
-	fh, err := os.Open(stateFile)
+	// read and decode the saved state
+	state, err := store.load()
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to open the statefile")
-		return end
-	}
-	defer fh.Close()
-	// read the contents of the state file (JSON)
-	content := make([]byte, 1024)
-	bytesRead, err := fh.Read(content)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to read the statefile contents")
-		return end
-	}
-	content = content[:bytesRead]
-	// decode the contents of the statefile
-	state := State{}
-	if err := json.Unmarshal(content, &state); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to json decode the statefile")
+		}).Debug("getStartLocation failed to read the statefile")
 		return end
 	}
 	// get the details of the existing log file
@@ -289,14 +459,25 @@ func getStartLocation(stateFile string, logfile string) *tail.SeekInfo {
 		}).Debug("getStartLocation failed to get unix.stat() on the logfile")
 		return end
 	}
-	// compare inode numbers of the last-seen and existing log files
-	if state.INode != logStat.Ino {
+	// compare the identity of the last-seen and existing log files
+	if !sameFile(state, logfile) {
 		logrus.WithFields(logrus.Fields{
-			"starting at": "beginning", "error": err,
-		}).Debug("getStartLocation found a different inode number for the logfile")
+			"starting at": "beginning",
+		}).Debug("getStartLocation found a different file by the same name")
 		// file's been rotated
 		return beginning
 	}
+	// copytruncate empties the file without replacing it, which only tells
+	// if it's still the same file
+	if state.Offset > logStat.Size {
+		logrus.WithFields(logrus.Fields{
+			"file":   logfile,
+			"offset": state.Offset,
+			"size":   logStat.Size,
+		}).Info("File was truncated since the statefile was written, reading it from the beginning")
+		metrics.Increment("files_truncated")
+		return beginning
+	}
 	logrus.WithFields(logrus.Fields{
 		"starting at": state.Offset,
 	}).Debug("getStartLocation seeking to offset in logfile")
@@ -307,12 +488,11 @@ func getStartLocation(stateFile string, logfile string) *tail.SeekInfo {
 	}
 }
 
-// getTailer configures the *tail.Tail correctly to begin actually tailing the
+// getTailer configures a follower correctly to begin actually tailing the
 // specified file.
-func getTailer(conf Config, file string, stateFile string) (*tail.Tail, error) {
+func getTailer(conf Config, file string, store stateStore) (*follower, error) {
 	// tail a real file
 	var loc *tail.SeekInfo // 0 value means start at beginning
-	var reOpen, follow bool = true, true
 	switch conf.Options.ReadFrom {
 	case "start", "beginning":
 		// 0 value for tail.SeekInfo means start at beginning
@@ -322,31 +502,30 @@ func getTailer(conf Config, file string, stateFile string) (*tail.Tail, error) {
 			Whence: 2,
 		}
 	case "last":
-		loc = getStartLocation(stateFile, file)
+		loc = getStartLocation(store, file)
 	default:
+		if strings.HasPrefix(conf.Options.ReadFrom, readFromTimePrefix) {
+			offset, err := getTimeLocation(conf, file)
+			if err != nil {
+				return nil, err
+			}
+			loc = &tail.SeekInfo{Offset: offset}
+			break
+		}
 		errMsg := fmt.Sprintf("unknown option to --read_from: %s",
 			conf.Options.ReadFrom)
 		return nil, errors.New(errMsg)
 	}
-	if conf.Options.Stop {
-		reOpen = false
-		follow = false
-	}
-	tailConf := tail.Config{
-		Location:  loc,
-		ReOpen:    reOpen, // keep reading on rotation, aka tail -F
-		MustExist: true,   // fail if log file doesn't exist
-		Follow:    follow, // don't stop at EOF, aka tail -f
-		Logger:    tail.DiscardingLogger,
-		Poll:      conf.Options.Poll, // use poll instead of inotify
-	}
+	// don't stop at EOF, and keep reading on rotation, aka tail -F
+	follow := !conf.Options.Stop
 	logrus.WithFields(logrus.Fields{
-		"tailConf":  tailConf,
+		"follow":    follow,
 		"conf":      conf,
-		"statefile": stateFile,
+		"statefile": store,
 		"location":  loc,
-	}).Debug("about to call tail.TailFile")
-	return tail.TailFile(file, tailConf)
+	}).Debug("about to start following file")
+	// fails if log file doesn't exist
+	return newFollower(file, loc, follow, conf.Options)
 }
 
 // getStateFile returns the filename to use to track honeytail state.
@@ -386,22 +565,32 @@ func getStateFile(conf Config, filename string, numFiles int) string {
 }
 
 // updateStateFile updates the state file once per second with the current
-// values for the logfile's inode number and offset
-func updateStateFile(state *State, t *tail.Tail, file string, stateFh *os.File) {
-	logStat := unix.Stat_t{}
-	unix.Stat(file, &logStat)
-	currentPos, err := t.Tell()
-	if err != nil {
-		return
-	}
-	state.INode = logStat.Ino
-	state.Offset = currentPos
-	out, err := json.Marshal(state)
-	if err != nil {
-		return
+// offset, along with the logfile's identity, which has been set in state
+func updateStateFile(state *State, offset int64, store stateStore) {
+	state.Offset = offset
+	store.save(*state)
+}
+
+// everySecond calls update once a second until the returned func is called,
+// which waits for the last update to finish before returning
+func everySecond(update func()) func() {
+	ticker := time.NewTicker(time.Second)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				update()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-stopped
 	}
-	stateFh.Truncate(0)
-	out = append(out, '\n')
-	stateFh.WriteAt(out, 0)
-	stateFh.Sync()
 }
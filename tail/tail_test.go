@@ -26,18 +26,18 @@ func TestTailSingleFile(t *testing.T) {
 	defer ts.stop()
 
 	filename := ts.tmpdir + "/first.log"
-	statefilename := filename + ".mystate"
+	store := &stateFileStore{path: filename + ".mystate"}
 	jsonLines := []string{"{\"a\":1}", "{\"b\":2}", "{\"c\":3}"}
 	ts.writeFile(t, filename, strings.Join(jsonLines, "\n"))
 
 	conf := Config{
 		Options: tailOpts,
 	}
-	tailer, err := getTailer(conf, filename, statefilename)
+	tailer, err := getTailer(conf, filename, store)
 	if err != nil {
 		t.Fatal(err)
 	}
-	lines := tailSingleFile(ts.ctx, tailer, filename, statefilename)
+	lines := tailRetirableFile(ts.ctx, conf, tailer, filename, store, newCheckpoint(tailer.offset), nil, nil, nil)
 	checkLinesChan(t, lines, jsonLines)
 }
 
@@ -50,16 +50,17 @@ func TestTailSTDIN(t *testing.T) {
 		Paths:   make([]string, 1),
 	}
 	conf.Paths[0] = "-"
-	lineChans, err := GetEntries(ts.ctx, conf)
+	sources, err := WatchEntries(ts.ctx, conf)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(lineChans) != 1 {
-		t.Errorf("lines chans should have had one channel; instead was length %d", len(lineChans))
+	expectSource(t, sources, "-")
+	if _, ok := <-sources; ok {
+		t.Error("expected only a source for stdin")
 	}
 }
 
-func TestGetSampledEntries(t *testing.T) {
+func TestSampleSourceLines(t *testing.T) {
 	ts := &testSetup{}
 	ts.start(t)
 	defer ts.stop()
@@ -83,10 +84,13 @@ func TestGetSampledEntries(t *testing.T) {
 		ts.writeFile(t, filename, strings.Join(jsonLines[i], "\n"))
 	}
 
-	chanArr, err := GetSampledEntries(ts.ctx, conf, 2)
+	chanArr, err := watchLines(t, ts.ctx, conf, 3)
 	if err != nil {
 		t.Fatal(err)
 	}
+	for i, ch := range chanArr {
+		chanArr[i] = SampleSourceLines(Source{Lines: ch}, NewSampleRate(2))
+	}
 	// can't check each line because the parallel goroutines screw with the random
 	// dropping lines, so you can't know which channel will drop which messages.
 	// But the overall count of messages is predictable.
@@ -103,7 +107,7 @@ func TestGetSampledEntries(t *testing.T) {
 	}
 }
 
-func TestGetEntries(t *testing.T) {
+func TestWatchEntries(t *testing.T) {
 	ts := &testSetup{}
 	ts.start(t)
 	defer ts.stop()
@@ -126,7 +130,7 @@ func TestGetEntries(t *testing.T) {
 		ts.writeFile(t, filename, strings.Join(jsonLines[i], "\n"))
 	}
 
-	chanArr, err := GetEntries(ts.ctx, conf)
+	chanArr, err := watchLines(t, ts.ctx, conf, 3)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -146,12 +150,12 @@ func TestGetEntries(t *testing.T) {
 			StateFile: fn1,
 		},
 	}
-	nilChan, err := GetEntries(ts.ctx, conf)
+	nilChan, err := WatchEntries(ts.ctx, conf)
 	if nilChan != nil {
-		t.Error("errored getEntries was supposed to respond with a nil channel list")
+		t.Error("errored WatchEntries was supposed to respond with a nil channel")
 	}
 	if err == nil {
-		t.Error("expected error from GetEntries; got nil instead.")
+		t.Error("expected error from WatchEntries; got nil instead.")
 	}
 }
 
@@ -183,7 +187,7 @@ func TestAbortChannel(t *testing.T) {
 		ts.writeFile(t, filename, strings.Join(jsonLines[i], "\n"))
 	}
 
-	chanArr, err := GetEntries(ts.ctx, conf)
+	chanArr, err := watchLines(t, ts.ctx, conf, 3)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -305,11 +309,33 @@ func (ts *testSetup) stop() {
 	os.RemoveAll(ts.tmpdir)
 }
 
-func checkLinesChan(t *testing.T, actual chan string, expected []string) {
+// watchLines returns the lines channels of the first n sources WatchEntries
+// starts, in the order it starts them
+func watchLines(t *testing.T, ctx context.Context, conf Config, n int) ([]chan Line, error) {
+	sources, err := WatchEntries(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	linesChans := make([]chan Line, 0, n)
+	for len(linesChans) < n {
+		select {
+		case source, ok := <-sources:
+			if !ok {
+				t.Fatalf("expected %d sources, got %d", n, len(linesChans))
+			}
+			linesChans = append(linesChans, source.Lines)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for source %d of %d", len(linesChans)+1, n)
+		}
+	}
+	return linesChans, nil
+}
+
+func checkLinesChan(t *testing.T, actual chan Line, expected []string) {
 	idx := 0
 	for line := range actual {
-		if idx < len(expected) && expected[idx] != line {
-			t.Errorf("got line '%s', expected line '%s'", line, expected[idx])
+		if idx < len(expected) && expected[idx] != line.Text {
+			t.Errorf("got line '%s', expected line '%s'", line.Text, expected[idx])
 		}
 		idx++
 	}
@@ -318,7 +344,7 @@ func checkLinesChan(t *testing.T, actual chan string, expected []string) {
 	}
 }
 
-func checkLinesChanClosed(t *testing.T, actual chan string) {
+func checkLinesChanClosed(t *testing.T, actual chan Line) {
 	// this will block if actual never gets closed
 	for {
 		select {
@@ -0,0 +1,287 @@
+package tail
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hpcloud/tail"
+)
+
+// how often to look for a newer file when following timestamped files
+var timestampRescanInterval = time.Second
+
+// tailTimestampedFiles follows a sequence of files matching pattern whose
+// names sort in the order they were written, like app.log.2017-10-16 or
+// access-20171016.log. It reads the current file until a newer one shows up,
+// finishes reading it, then moves on to the next. The statefile remembers
+// which file it was in as well as the offset.
+func tailTimestampedFiles(ctx context.Context, conf Config, pattern string, store stateStore) (chan Line, error) {
+	files, err := timestampedFiles(conf, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files match " + pattern)
+	}
+	file, offset, err := timestampedStart(conf, files, store)
+	if err != nil {
+		return nil, err
+	}
+
+	// pos tracks how far through the sequence we've got, for the statefile
+	pos := &sequencePosition{}
+	// the periodic writes have to stop before the final one
+	stopTicker := everySecond(func() { pos.write(store) })
+
+	lines := make(chan Line)
+	conf.StateGate.hold()
+	go func() {
+		defer func() {
+			close(lines)
+			stopTicker()
+			conf.StateGate.wait()
+			pos.write(store)
+			conf.StateGate.release()
+		}()
+		for {
+			pos.start(file, offset)
+			if !readTimestampedFile(ctx, conf, pattern, pos, lines) {
+				return
+			}
+			pos.finish()
+
+			// move on to the next file, waiting for it if we're following
+			next := ""
+			for {
+				files, _ = timestampedFiles(conf, pattern)
+				next = nextTimestampedFile(files, file)
+				if next != "" || conf.Options.Stop {
+					break
+				}
+				select {
+				case <-time.After(timestampRescanInterval):
+				case <-ctx.Done():
+					return
+				}
+			}
+			if next == "" {
+				return
+			}
+			logrus.WithFields(logrus.Fields{
+				"previous": file,
+				"next":     next,
+			}).Info("Finished reading file, moving on to the next one")
+			file, offset = next, 0
+		}
+	}()
+	return lines, nil
+}
+
+// readTimestampedFile sends lines from the file pos is in until it's done with
+// it. When following, that's once a newer file shows up and this one has been
+// read to the end. It returns false if ctx was cancelled.
+func readTimestampedFile(ctx context.Context, conf Config, pattern string,
+	pos *sequencePosition, lines chan Line) bool {
+	file, offset := pos.get()
+	follow := !conf.Options.Stop
+	follower, err := newFollower(file, &tail.SeekInfo{Offset: offset, Whence: 0}, follow, conf.Options)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file": file,
+			"err":  err,
+		}).Error("Failed to open file, skipping it")
+		return true
+	}
+	pos.follow(follower)
+	go follower.run(ctx)
+
+	// newer files are looked for while following
+	var rescan <-chan time.Time
+	if follow {
+		ticker := time.NewTicker(timestampRescanInterval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+	for {
+		select {
+		case line, ok := <-follower.lines:
+			if !ok {
+				// the follower stops early when ctx is cancelled
+				return ctx.Err() == nil
+			}
+			select {
+			case lines <- line.Line:
+				pos.moveTo(line.end)
+			case <-ctx.Done():
+				return false
+			}
+		case <-rescan:
+			files, _ := timestampedFiles(conf, pattern)
+			if nextTimestampedFile(files, file) != "" {
+				// read whatever is left without waiting for more to be
+				// written
+				follower.stopAtEOF()
+				rescan = nil
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// timestampedFiles returns the files matching pattern in the order they were
+// written
+func timestampedFiles(conf Config, pattern string) ([]string, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	files = removeStateFiles(files, conf)
+	sort.Strings(files)
+	return files, nil
+}
+
+// nextTimestampedFile returns the file that comes after current, or "" if
+// there isn't one yet
+func nextTimestampedFile(files []string, current string) string {
+	i := sort.SearchStrings(files, current)
+	if i < len(files) && files[i] == current {
+		i++
+	}
+	if i < len(files) {
+		return files[i]
+	}
+	return ""
+}
+
+// timestampedStart works out which file in the sequence to start with and
+// the offset in it, following the same rules as for a single file. If the
+// file in the statefile is gone, it starts at the beginning of the one after
+// it.
+func timestampedStart(conf Config, files []string, store stateStore) (string, int64, error) {
+	newest := files[len(files)-1]
+	switch conf.Options.ReadFrom {
+	case "start", "beginning":
+		return files[0], 0, nil
+	case "end":
+		return newest, fileSize(newest), nil
+	case "last":
+	default:
+		return "", 0, errors.New("unknown option to --read_from: " + conf.Options.ReadFrom)
+	}
+
+	state, err := store.load()
+	if err != nil || state.File == "" {
+		logrus.WithFields(logrus.Fields{
+			"starting at": "end", "error": err,
+		}).Debug("timestampedStart found no usable statefile")
+		return newest, fileSize(newest), nil
+	}
+	if _, err := os.Stat(state.File); err != nil {
+		next := nextTimestampedFile(files, state.File)
+		if next == "" {
+			return newest, fileSize(newest), nil
+		}
+		return next, 0, nil
+	}
+	if !sameFile(state, state.File) {
+		// the name has been reused for a new file
+		return state.File, 0, nil
+	}
+	return state.File, state.Offset, nil
+}
+
+// fileSize returns the size of file, or 0 if it can't be found
+func fileSize(file string) int64 {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// timestampedStateFileName turns a pattern into something that can be used
+// to name its statefile
+func timestampedStateFileName(pattern string) string {
+	return strings.NewReplacer("*", "_", "?", "_", "[", "_", "]", "_").Replace(pattern)
+}
+
+// sequencePosition is the file and offset reached in a sequence of files.
+// The offset counts the bytes in the lines that have been sent on, rather than
+// what the tailer has read.
+type sequencePosition struct {
+	lock  sync.Mutex
+	state State
+	// follower is reading the file when it's followed, and the file's
+	// identity is kept up to date from the file it has open
+	follower *follower
+}
+
+// start records that file is being read from offset
+func (p *sequencePosition) start(file string, offset int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state = State{Offset: offset, File: file}
+	p.follower = nil
+	setIdentity(&p.state, file)
+}
+
+// follow records that the file is being read by f, rather than whichever
+// file its path leads to later on
+func (p *sequencePosition) follow(f *follower) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.follower = f
+	f.identify(&p.state)
+}
+
+// advance moves the offset along by n bytes
+func (p *sequencePosition) advance(n int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state.Offset += n
+}
+
+// moveTo moves the offset along to offset, once everything before it has
+// been sent on
+func (p *sequencePosition) moveTo(offset int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state.Offset = offset
+}
+
+// finish records that the current file has been read to the end
+func (p *sequencePosition) finish() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// the last line might not have ended in a newline
+	if size := fileSize(p.state.File); size < p.state.Offset {
+		p.state.Offset = size
+	}
+}
+
+// get returns the current file and offset
+func (p *sequencePosition) get() (string, int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.state.File, p.state.Offset
+}
+
+// write saves the current position to the statefile
+func (p *sequencePosition) write(store stateStore) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.state.File != "" {
+		if p.follower != nil {
+			p.follower.identify(&p.state)
+		}
+		store.save(p.state)
+	}
+}
@@ -0,0 +1,155 @@
+package tail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTimestampedBackfill(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	// written out of order to make sure they're read by name
+	ts.writeFile(t, ts.tmpdir+"/app.log.2017-10-16", "c\nd\n")
+	ts.writeFile(t, ts.tmpdir+"/app.log.2017-10-15", "a\nb\n")
+	ts.writeFile(t, ts.tmpdir+"/app.log.2017-10-17", "e\n")
+
+	conf := Config{
+		Paths:   []string{ts.tmpdir + "/app.log.*"},
+		Type:    RotateStyleTimestamp,
+		Options: tailOpts,
+	}
+	conf.Options.StateFile = ts.tmpdir + "/app.state"
+	conf.StateGate = NewStateGate()
+	chans, err := watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{"a", "b", "c", "d", "e"})
+	// wait for the statefile to be written
+	conf.StateGate.Open()
+
+	// the statefile should point at the end of the last file, so picking up
+	// where we left off reads nothing new
+	state := readTestState(t, conf.Options.StateFile)
+	if state.File != ts.tmpdir+"/app.log.2017-10-17" || state.Offset != 2 {
+		t.Errorf("expected the statefile to be at the end of the last file, got %+v", state)
+	}
+	conf.Options.ReadFrom = "last"
+	conf.StateGate = nil
+	chans, err = watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLinesChan(t, chans[0], []string{})
+}
+
+func TestTimestampedFollow(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+	defer func(interval time.Duration) { timestampRescanInterval = interval }(timestampRescanInterval)
+	timestampRescanInterval = 10 * time.Millisecond
+
+	first := ts.tmpdir + "/access-20171015.log"
+	ts.writeFile(t, first, "a\n")
+	conf := Config{
+		Paths: []string{ts.tmpdir + "/access-*.log"},
+		Type:  RotateStyleTimestamp,
+		Options: TailOptions{
+			ReadFrom:  "beginning",
+			StateFile: ts.tmpdir + "/access.state",
+		},
+	}
+	chans, err := watchLines(t, ts.ctx, conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := chans[0]
+	expectLine(t, lines, "a")
+
+	// the last lines written to the old file still get read after the switch
+	fh, err := os.OpenFile(first, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString("b\n")
+	fh.Close()
+	ts.writeFile(t, ts.tmpdir+"/access-20171016.log", "c\n")
+	expectLine(t, lines, "b")
+	expectLine(t, lines, "c")
+
+	ts.cancel()
+	checkLinesChanClosed(t, lines)
+}
+
+func TestSequencePositionIdentity(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/app.log.2017-10-16"
+	ts.writeFile(t, file, "a\n")
+	pos := &sequencePosition{}
+	pos.start(file, 0)
+	follower, err := newFollower(file, nil, true, TailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.close()
+	pos.follow(follower)
+	// something else turns up at the path while the file's being read
+	if err := os.Rename(file, file+".old"); err != nil {
+		t.Fatal(err)
+	}
+	ts.writeFile(t, file, "b\n")
+
+	store := &stateFileStore{path: ts.tmpdir + "/app.leash.state"}
+	pos.write(store)
+	state := readTestState(t, store.path)
+	if !sameFile(state, file+".old") || sameFile(state, file) {
+		t.Errorf("expected the identity of the file being read, got %+v", state)
+	}
+}
+
+func TestNextTimestampedFile(t *testing.T) {
+	files := []string{"a.1", "a.2", "a.4"}
+	tests := map[string]string{
+		"a.0": "a.1",
+		"a.1": "a.2",
+		"a.3": "a.4",
+		"a.4": "",
+	}
+	for current, expected := range tests {
+		if next := nextTimestampedFile(files, current); next != expected {
+			t.Errorf("after %s expected %q, got %q", current, expected, next)
+		}
+	}
+}
+
+func expectLine(t *testing.T, lines chan Line, expected string) {
+	select {
+	case line := <-lines:
+		if line.Text != expected {
+			t.Errorf("got line '%s', expected line '%s'", line.Text, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for line '%s'", expected)
+	}
+}
+
+func readTestState(t *testing.T, stateFile string) State {
+	content, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := State{}
+	if err := json.Unmarshal(content, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
@@ -0,0 +1,427 @@
+package tail
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hpcloud/tail"
+	"golang.org/x/sys/unix"
+)
+
+// Source is a stream of lines from one file, or from one of the other inputs
+type Source struct {
+	// Path is the file the lines come from; "-" for STDIN, or the glob for
+	// timestamped or compressed files. Other inputs give a name of their own.
+	Path  string
+	Lines chan Line
+	// Checkpoint decides where the statefile picks up from. It's nil for
+	// STDIN, timestamped and compressed files, which only go by the lines
+	// passed on.
+	Checkpoint *Checkpoint
+	// Size is how many bytes there are to read, as far as it's known when
+	// reading starts; 0 if it isn't, as for STDIN, timestamped and
+	// compressed files. When a file is read in chunks, it's all on the first
+	// reader's Source.
+	Size int64
+	// Header, if set, is the Regex of the Header put at the start of each
+	// line, by an input other than a file or by unwrapping container logs. Its
+	// named groups are fields to add to the events made out of the line, like
+	// those of --log_prefix.
+	Header string
+}
+
+// Line is a line passed on by a Source, along with where it was read from.
+// Lines from inputs other than files only have their Text.
+type Line struct {
+	Text string
+	// Path is the file the line was read from
+	Path string
+	// Inode is the inode number of the file
+	Inode uint64
+	// Offset is where the line starts in the file, or in its decompressed
+	// contents for compressed files
+	Offset int64
+	// Number is the line's number in the file, counting from 1. It's 0 when
+	// reading didn't start at the beginning of the file, so it isn't known.
+	Number int64
+}
+
+// a file has to be missing for this many rescans in a row before it's
+// retired, so one that's in the middle of being rotated isn't dropped
+const missedRescansBeforeRetiring = 2
+
+// WatchEntries sends a Source for each file or stdin as it starts tailing it,
+// with a channel that gets one line at a time from it. Unless --tail.stop is set, it keeps looking for new files
+// matching the globs in conf.Paths or in conf.Dirs, and retires files that
+// have been deleted once they've been read to the end. Files in conf.Dirs are
+// also finished off once they've been idle for --dir.idle_timeout, until
+// they're written to again. No more than --tail.max_open_files are
+// tailed at once; the rest wait their turn. The returned channel is closed
+// once ctx is cancelled, or with --tail.stop, once every file has been
+// started.
+func WatchEntries(ctx context.Context, conf Config) (chan Source, error) {
+	if conf.Type == RotateStyleTimestamp {
+		// each sequence of timestamped files already picks up new files
+		linesChans, err := getTimestampedEntries(ctx, conf)
+		if err != nil {
+			return nil, err
+		}
+		sources := make(chan Source, len(linesChans))
+		for i, lines := range linesChans {
+			sources <- Source{Path: conf.Paths[i], Lines: lines}
+		}
+		close(sources)
+		return sources, nil
+	}
+
+	filenames, groups, err := expandPaths(conf)
+	if err != nil {
+		return nil, err
+	}
+	groups = compressedToRead(conf, groups)
+	// directories are kept an eye on for files to turn up in later
+	if len(filenames)+len(groups) == 0 && (len(conf.Dirs) == 0 || conf.Options.Stop) {
+		return nil, errors.New("After removing missing files and state files from the list, there are no files left to tail")
+	}
+	w := &watcher{
+		ctx:      ctx,
+		conf:     conf,
+		numFiles: len(filenames) + len(groups),
+		sources:  make(chan Source),
+		finished: make(chan string),
+		stopped:  make(chan struct{}),
+		active:   make(map[string]*watchedFile),
+		idled:    make(map[string]idledFile),
+	}
+	// compressed files are read one at a time per group, so they don't count
+	// towards --tail.max_open_files
+	initial := startCompressed(ctx, conf, groups, w.numFiles)
+	// open the files we already know about up front so problems with them are
+	// reported straight away
+	for _, file := range filenames {
+		if w.full() {
+			w.pending = append(w.pending, file)
+			continue
+		}
+		sources, err := w.start(file)
+		if err != nil {
+			return nil, err
+		}
+		initial = append(initial, sources...)
+	}
+	go w.run(initial)
+	return w.sources, nil
+}
+
+// watcher keeps track of the files being tailed
+type watcher struct {
+	ctx  context.Context
+	conf Config
+	// numFiles is how many files were found at startup, which decides how
+	// statefiles are named
+	numFiles int
+	// started counts the files started so far
+	started int
+	sources chan Source
+	// finished gets the path of each file once its lines channel is closed
+	finished chan string
+	// stopped is closed when run returns
+	stopped chan struct{}
+	// files being tailed, by path
+	active map[string]*watchedFile
+	// files waiting for a free slot
+	pending []string
+	// files that were finished off for being idle, by path
+	idled map[string]idledFile
+}
+
+// watchedFile is a file that's being tailed
+type watchedFile struct {
+	// id is the file's device and inode number, for files that aren't
+	// followed
+	id fileID
+	// tailer is the follower reading the file, which moves on to a new file
+	// when it's rotated
+	tailer *follower
+	retire chan struct{}
+	// idle is closed to finish the file off for being idle, and set to nil
+	// once it is
+	idle       chan struct{}
+	checkpoint *Checkpoint
+	// missed counts the rescans in a row that didn't find the file
+	missed int
+}
+
+// idledFile is where a file that was finished off for being idle had been
+// read up to, to carry on from there if it's written to again
+type idledFile struct {
+	id     fileID
+	offset int64
+	// rotated has the devices and inode numbers of the files read before
+	// that were rotated away from the path, which are still skipped
+	rotated []fileID
+}
+
+// run hands out the sources and looks after the files until ctx is cancelled
+// or, with --tail.stop, there are no more files to start
+func (w *watcher) run(initial []Source) {
+	defer close(w.sources)
+	defer close(w.stopped)
+	for _, source := range initial {
+		select {
+		case w.sources <- source:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+	var rescan <-chan time.Time
+	if !w.conf.Options.Stop && w.conf.Options.RescanInterval != 0 {
+		ticker := time.NewTicker(time.Duration(w.conf.Options.RescanInterval) * time.Second)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+	for {
+		if w.conf.Options.Stop && len(w.pending) == 0 {
+			return
+		}
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-rescan:
+			w.rescan()
+		case file := <-w.finished:
+			if f := w.active[file]; f != nil && f.checkpoint != nil && f.idle == nil {
+				idled := idledFile{id: f.currentFile(), offset: f.checkpoint.passed()}
+				for _, id := range f.files() {
+					if id != idled.id {
+						idled.rotated = append(idled.rotated, id)
+					}
+				}
+				w.idled[file] = idled
+			}
+			delete(w.active, file)
+		}
+		w.startPending()
+	}
+}
+
+// rescan queues up new files matching the globs and retires deleted ones
+func (w *watcher) rescan() {
+	// compressed files are only read with --tail.stop, when there are no rescans
+	filenames, _, err := expandPaths(w.conf)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Warn("Failed to look for new files")
+		return
+	}
+	// a file that's been renamed to something else that matches is still the
+	// same file. Inode numbers are only unique on one device.
+	known := make(map[fileID]bool, len(w.active))
+	for _, f := range w.active {
+		for _, id := range f.files() {
+			known[id] = true
+		}
+	}
+	for _, idled := range w.idled {
+		for _, id := range idled.rotated {
+			known[id] = true
+		}
+	}
+	for _, file := range w.pending {
+		if id, ok := fileIDOf(file); ok {
+			known[id] = true
+		}
+	}
+	for _, file := range filenames {
+		if _, ok := w.active[file]; ok || file == "-" || w.idle(file) {
+			continue
+		}
+		id, ok := fileIDOf(file)
+		if !ok || known[id] {
+			continue
+		}
+		known[id] = true
+		logrus.WithFields(logrus.Fields{"file": file}).Info("Found a new file to tail")
+		w.pending = append(w.pending, file)
+	}
+
+	for file, f := range w.active {
+		if file == "-" || f.retire == nil {
+			continue
+		}
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			f.missed = 0
+			if f.idle != nil && w.idle(file) {
+				logrus.WithFields(logrus.Fields{"file": file}).Info(
+					"File hasn't been written to for --dir.idle_timeout, finishing it off")
+				close(f.idle)
+				f.idle = nil
+			}
+			continue
+		}
+		f.missed++
+		if f.missed >= missedRescansBeforeRetiring {
+			logrus.WithFields(logrus.Fields{"file": file}).Info(
+				"File was deleted, finishing it off")
+			close(f.retire)
+			f.retire = nil
+		}
+	}
+	for file := range w.idled {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			delete(w.idled, file)
+		}
+	}
+}
+
+// idle reports whether file is in one of the --dir directories and hasn't
+// been written to for --dir.idle_timeout
+func (w *watcher) idle(file string) bool {
+	timeout := time.Duration(w.conf.Dir.IdleTimeout) * time.Second
+	if timeout == 0 || !inDirs(w.conf.Dirs, file) {
+		return false
+	}
+	info, err := os.Stat(file)
+	return err == nil && time.Since(info.ModTime()) > timeout
+}
+
+// startPending starts as many of the waiting files as there's room for
+func (w *watcher) startPending() {
+	for len(w.pending) > 0 && !w.full() {
+		file := w.pending[0]
+		w.pending = w.pending[1:]
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			// gone before we got to it
+			continue
+		}
+		sources, err := w.start(file)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file": file,
+				"err":  err,
+			}).Error("Failed to start tailing file")
+			continue
+		}
+		for _, source := range sources {
+			select {
+			case w.sources <- source:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}
+	if len(w.pending) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"waiting":        len(w.pending),
+			"max_open_files": w.conf.Options.MaxOpenFiles,
+		}).Debug("Too many files open, some are waiting their turn")
+	}
+}
+
+// full returns true if no more files may be opened
+func (w *watcher) full() bool {
+	max := w.conf.Options.MaxOpenFiles
+	return max != 0 && uint(len(w.active)) >= max
+}
+
+// start begins tailing file. There's a Source for each reader when it's read
+// in chunks, otherwise just the one.
+func (w *watcher) start(file string) ([]Source, error) {
+	if file == "-" {
+		w.active[file] = &watchedFile{}
+		return []Source{{Path: file, Lines: tailStdIn(w.ctx, w.conf)}}, nil
+	}
+	numFiles := w.numFiles
+	if w.started != 0 && numFiles < 2 {
+		// a --tail.statefile for a single file isn't shared with files found
+		// later
+		numFiles = 2
+	}
+	store := getStateStore(w.conf, file, stateFileName(w.conf, file), numFiles)
+	done := func() {
+		select {
+		case w.finished <- file:
+		case <-w.stopped:
+		}
+	}
+	if w.conf.Options.Stop && w.conf.Options.BackfillReaders > 1 {
+		sources, err := startChunked(w.ctx, w.conf, file, store, done)
+		if err != nil {
+			return nil, err
+		}
+		id, _ := fileIDOf(file)
+		w.active[file] = &watchedFile{id: id}
+		w.started++
+		return sources, nil
+	}
+	var tailer *follower
+	var err error
+	id, _ := fileIDOf(file)
+	if idled, ok := w.idled[file]; ok && idled.id == id {
+		// it's been written to again since it was finished off for being idle
+		delete(w.idled, file)
+		var loc *tail.SeekInfo
+		if info, err := os.Stat(file); err == nil && info.Size() >= idled.offset {
+			loc = &tail.SeekInfo{Offset: idled.offset}
+		}
+		tailer, err = newFollower(file, loc, true, w.conf.Options)
+	} else {
+		tailer, err = getTailer(w.conf, file, store)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &watchedFile{
+		tailer: tailer,
+		retire: make(chan struct{}),
+		idle:   make(chan struct{}),
+	}
+	w.active[file] = f
+	w.started++
+	var size int64
+	if info, err := os.Stat(file); err == nil && info.Size() > tailer.offset {
+		size = info.Size() - tailer.offset
+	}
+	checkpoint := newCheckpoint(tailer.offset)
+	f.checkpoint = checkpoint
+	lines := tailRetirableFile(w.ctx, w.conf, tailer, file, store, checkpoint, f.retire, f.idle, done)
+	return []Source{{Path: file, Lines: lines, Checkpoint: checkpoint, Size: size}}, nil
+}
+
+// files returns the devices and inode numbers of the files read from f's
+// path, which for a followed file includes the ones rotated away from it
+func (f *watchedFile) files() []fileID {
+	if f.tailer == nil {
+		return []fileID{f.id}
+	}
+	return f.tailer.readFiles()
+}
+
+// currentFile returns the device and inode number of the file being read
+// from f's path, which is the last one its follower moved on to
+func (f *watchedFile) currentFile() fileID {
+	if f.tailer == nil {
+		return f.id
+	}
+	return f.tailer.currentFile()
+}
+
+// inodeOf returns the inode number of file, or 0 if it can't be found
+func inodeOf(file string) uint64 {
+	stat := unix.Stat_t{}
+	if err := unix.Stat(file, &stat); err != nil {
+		return 0
+	}
+	return stat.Ino
+}
+
+// inodeOfOpen is inodeOf for a file that's already open
+func inodeOfOpen(fh *os.File) uint64 {
+	stat := unix.Stat_t{}
+	if err := unix.Fstat(int(fh.Fd()), &stat); err != nil {
+		return 0
+	}
+	return stat.Ino
+}
@@ -0,0 +1,209 @@
+package tail
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWatchEntriesFindsNewFiles(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	ts.writeFile(t, ts.tmpdir+"/a.log", "a1\n")
+	conf := Config{
+		Paths: []string{ts.tmpdir + "/*.log"},
+		Options: TailOptions{
+			ReadFrom:       "beginning",
+			StateFile:      ts.tmpdir,
+			RescanInterval: 1,
+		},
+	}
+	sources, err := WatchEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := expectSource(t, sources, ts.tmpdir+"/a.log")
+	expectLine(t, a.Lines, "a1")
+
+	// a file created later gets picked up on the next rescan
+	ts.writeFile(t, ts.tmpdir+"/b.log", "b1\n")
+	b := expectSource(t, sources, ts.tmpdir+"/b.log")
+	expectLine(t, b.Lines, "b1")
+
+	// once a file is deleted it's retired, along with its statefile
+	if err := os.Remove(ts.tmpdir + "/a.log"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-a.Lines:
+		if ok {
+			t.Error("expected no more lines from a deleted file")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deleted file was never retired")
+	}
+	// the statefile is removed after the lines channel is closed
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(ts.tmpdir + "/a.leash.state"); !os.IsNotExist(err) {
+		t.Errorf("expected the statefile of a retired file to be removed, got %v", err)
+	}
+
+	ts.cancel()
+	checkLinesChanClosed(t, b.Lines)
+	for range sources {
+	}
+}
+
+func TestWatchEntriesRotatedFiles(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/app.log"
+	ts.writeFile(t, file, "one\n")
+	conf := Config{
+		Paths: []string{file + "*"},
+		Options: TailOptions{
+			ReadFrom:       "beginning",
+			StateFile:      ts.tmpdir,
+			RescanInterval: 1,
+		},
+	}
+	sources, err := WatchEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := expectSource(t, sources, file)
+	expectLine(t, source.Lines, "one")
+
+	// the rotated files match the glob too, but they've been read already
+	// by the follower of app.log
+	for i, line := range []string{"two", "three"} {
+		for n := i; n >= 0; n-- {
+			from := file
+			if n > 0 {
+				from = file + "." + strconv.Itoa(n)
+			}
+			if err := os.Rename(from, file+"."+strconv.Itoa(n+1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ts.writeFile(t, file, line+"\n")
+		expectLine(t, source.Lines, line)
+	}
+	select {
+	case source := <-sources:
+		t.Errorf("expected rotated files to be left alone, got a source for %s", source.Path)
+	case <-time.After(2500 * time.Millisecond):
+	}
+
+	ts.cancel()
+	checkLinesChanClosed(t, source.Lines)
+	for range sources {
+	}
+}
+
+func TestRescanOtherDevice(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/b.log"
+	ts.writeFile(t, file, "b\n")
+	id, _ := fileIDOf(file)
+	w := &watcher{
+		ctx:    ts.ctx,
+		conf:   Config{Paths: []string{ts.tmpdir + "/*.log"}},
+		active: make(map[string]*watchedFile),
+		idled:  make(map[string]idledFile),
+	}
+	// a file on another filesystem can have the same inode number
+	w.active["/mnt/a.log"] = &watchedFile{id: fileID{dev: id.dev + 1, ino: id.ino}}
+	w.rescan()
+	if len(w.pending) != 1 || w.pending[0] != file {
+		t.Errorf("expected %s to be picked up, got %q", file, w.pending)
+	}
+	// but not one that's already being read under another name
+	w.pending = nil
+	w.active["/mnt/a.log"] = &watchedFile{id: id}
+	w.rescan()
+	if len(w.pending) != 0 {
+		t.Errorf("expected a file that's already being read to be skipped, got %q", w.pending)
+	}
+}
+
+func TestWatchEntriesMaxOpenFiles(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		ts.writeFile(t, ts.tmpdir+"/"+name+".log", name+"\n")
+	}
+	conf := Config{
+		Paths:   []string{ts.tmpdir + "/*.log"},
+		Options: tailOpts,
+	}
+	conf.Options.MaxOpenFiles = 1
+	sources, err := WatchEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only one file is open at a time, so each has to be finished before the
+	// next one shows up
+	for _, name := range names {
+		source := expectSource(t, sources, ts.tmpdir+"/"+name+".log")
+		checkLinesChan(t, source.Lines, []string{name})
+	}
+	if _, ok := <-sources; ok {
+		t.Error("expected the sources channel to be closed once every file was started")
+	}
+}
+
+func expectSource(t *testing.T, sources chan Source, path string) Source {
+	select {
+	case source, ok := <-sources:
+		if !ok {
+			t.Fatalf("sources closed while waiting for %s", path)
+		}
+		if source.Path != path {
+			t.Errorf("got source for %s, expected %s", source.Path, path)
+		}
+		return source
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a source for %s", path)
+	}
+	return Source{}
+}
+
+func TestLinePositions(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t)
+	defer ts.stop()
+
+	file := ts.tmpdir + "/a.log"
+	ts.writeFile(t, file, "one\ntwo\n")
+	conf := Config{
+		Paths:   []string{file},
+		Options: TailOptions{ReadFrom: "beginning", StateFile: ts.tmpdir, Stop: true},
+	}
+	sources, err := WatchEntries(ts.ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := expectSource(t, sources, file)
+	inode := inodeOf(file)
+	for _, expected := range []Line{
+		{Text: "one", Path: file, Inode: inode, Offset: 0, Number: 1},
+		{Text: "two", Path: file, Inode: inode, Offset: 4, Number: 2},
+	} {
+		if line := <-source.Lines; line != expected {
+			t.Errorf("expected %+v, got %+v", expected, line)
+		}
+	}
+	checkLinesChanClosed(t, source.Lines)
+}
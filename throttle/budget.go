@@ -0,0 +1,72 @@
+package throttle
+
+import "sync"
+
+// Budget caps the total estimated size of events that are in flight, from the
+// time they leave a parser until ClickHouse has answered for them. Acquire
+// blocks while the budget is spent, which holds up the parser and in turn the
+// tailer feeding it.
+//
+// A Budget with a limit of zero never blocks, but still keeps count of what's
+// in flight.
+type Budget struct {
+	lock   sync.Mutex
+	limit  int64
+	bytes  int64
+	events int64
+	// freed is closed and replaced every time something is released, waking up
+	// anyone waiting in Acquire
+	freed chan struct{}
+}
+
+// NewBudget returns a Budget allowing up to limit bytes in flight.
+func NewBudget(limit int64) *Budget {
+	return &Budget{
+		limit: limit,
+		freed: make(chan struct{}),
+	}
+}
+
+// Acquire reserves size bytes for one event, waiting for room if needed. An
+// event bigger than the whole budget is let through once nothing else is in
+// flight so it can't wedge the pipeline.
+func (b *Budget) Acquire(size int) {
+	for {
+		freed := b.TryAcquire(size)
+		if freed == nil {
+			return
+		}
+		<-freed
+	}
+}
+
+// TryAcquire is Acquire without the waiting. If there isn't room for the
+// event, it returns a channel that's closed once something is released, to
+// try again then; otherwise it returns nil.
+func (b *Budget) TryAcquire(size int) <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.limit == 0 || b.bytes+int64(size) <= b.limit || b.events == 0 {
+		b.bytes += int64(size)
+		b.events++
+		return nil
+	}
+	return b.freed
+}
+
+// Release returns size bytes for one event to the budget.
+func (b *Budget) Release(size int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.bytes -= int64(size)
+	b.events--
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// InFlight returns the number of events and bytes currently acquired.
+func (b *Budget) InFlight() (events int64, bytes int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.events, b.bytes
+}
@@ -0,0 +1,114 @@
+// Package throttle limits how fast events are handed off to be sent, and how
+// much memory they may tie up while they're on their way.
+//
+// A Limiter holds a token bucket for events per second and another for bytes
+// per second. A Budget caps the bytes in flight. Callers block until there's
+// room, which slows down whatever is feeding them rather than dropping
+// anything.
+package throttle
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket refills at a steady rate up to a maximum burst. Taking more
+// tokens than are available puts the bucket in debt, and the caller waits
+// until the debt is paid off, so a single request larger than the burst still
+// goes through at the configured average rate.
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // maximum number of tokens held
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket that refills at rate tokens per second.
+// It holds at most one second's worth of tokens.
+func NewTokenBucket(rate float64) *TokenBucket {
+	burst := math.Max(rate, 1)
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n tokens from the bucket, blocking until they have been paid for
+// or ctx is cancelled.
+func (b *TokenBucket) Wait(ctx context.Context, n float64) error {
+	wait := b.take(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take removes n tokens and returns how long the caller has to wait for the
+// bucket to get back out of debt
+func (b *TokenBucket) take(n float64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limiter throttles on events per second and estimated bytes per second. A nil
+// *Limiter never blocks.
+type Limiter struct {
+	events *TokenBucket
+	bytes  *TokenBucket
+}
+
+// New returns a Limiter allowing eventsPerSec events and bytesPerSec bytes per
+// second. A zero for either means that dimension is unlimited; if both are
+// zero, New returns nil.
+func New(eventsPerSec, bytesPerSec uint) *Limiter {
+	if eventsPerSec == 0 && bytesPerSec == 0 {
+		return nil
+	}
+	l := &Limiter{}
+	if eventsPerSec != 0 {
+		l.events = NewTokenBucket(float64(eventsPerSec))
+	}
+	if bytesPerSec != 0 {
+		l.bytes = NewTokenBucket(float64(bytesPerSec))
+	}
+	return l
+}
+
+// Wait blocks until one event of the given size may be sent, or until ctx is
+// cancelled.
+func (l *Limiter) Wait(ctx context.Context, size int) error {
+	if l == nil {
+		return nil
+	}
+	if l.events != nil {
+		if err := l.events.Wait(ctx, 1); err != nil {
+			return err
+		}
+	}
+	if l.bytes != nil {
+		if err := l.bytes.Wait(ctx, float64(size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
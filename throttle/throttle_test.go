@@ -0,0 +1,148 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurst(t *testing.T) {
+	b := NewTokenBucket(10)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := b.Wait(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("a full bucket should not block; took %v", elapsed)
+	}
+}
+
+func TestTokenBucketRate(t *testing.T) {
+	b := NewTokenBucket(100)
+	// drain the initial burst, then ten more tokens should take ~100ms
+	b.take(100)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := b.Wait(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < 80*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("expected 10 tokens at 100/s to take about 100ms, took %v", elapsed)
+	}
+}
+
+func TestTokenBucketLargerThanBurst(t *testing.T) {
+	b := NewTokenBucket(1000)
+	start := time.Now()
+	// 1500 tokens from a bucket holding 1000 puts it 500 in debt
+	if err := b.Wait(context.Background(), 1500); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected to wait about 500ms, waited %v", elapsed)
+	}
+}
+
+func TestTokenBucketCancel(t *testing.T) {
+	b := NewTokenBucket(1)
+	b.take(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if err := b.Wait(ctx, 10); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled wait should return promptly, took %v", elapsed)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	if New(0, 0) != nil {
+		t.Error("a limiter with no limits should be nil")
+	}
+	var nilLimiter *Limiter
+	if err := nilLimiter.Wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("nil limiter should never fail, got %v", err)
+	}
+
+	l := New(0, 1000)
+	if l.events != nil {
+		t.Error("events bucket should be unset when only bytes are limited")
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		// 3 x 500 bytes at 1000 bytes/s with a 1000 byte burst
+		if err := l.Wait(context.Background(), 500); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected to wait about 500ms for bytes, waited %v", elapsed)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(100)
+	b.Acquire(60)
+	acquired := make(chan struct{})
+	go func() {
+		b.Acquire(60)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second acquire should block while the budget is spent")
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.Release(60)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("acquire should go through once there's room")
+	}
+	if events, bytes := b.InFlight(); events != 1 || bytes != 60 {
+		t.Errorf("expected 1 event and 60 bytes in flight, got %d and %d", events, bytes)
+	}
+	b.Release(60)
+
+	// an event bigger than the whole budget still goes through on its own
+	b.Acquire(1000)
+	if events, bytes := b.InFlight(); events != 1 || bytes != 1000 {
+		t.Errorf("expected 1 event and 1000 bytes in flight, got %d and %d", events, bytes)
+	}
+
+	// trying without room gives something to wait on instead
+	freed := b.TryAcquire(10)
+	if freed == nil {
+		t.Fatal("expected TryAcquire to fail while the budget is spent")
+	}
+	b.Release(1000)
+	select {
+	case <-freed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the channel from TryAcquire to be closed on release")
+	}
+	if b.TryAcquire(10) != nil {
+		t.Error("expected TryAcquire to go through once there's room")
+	}
+}
+
+func TestBudgetUnlimited(t *testing.T) {
+	b := NewBudget(0)
+	for i := 0; i < 10; i++ {
+		b.Acquire(1 << 20)
+	}
+	if events, _ := b.InFlight(); events != 10 {
+		t.Errorf("expected 10 events in flight, got %d", events)
+	}
+}